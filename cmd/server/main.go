@@ -10,9 +10,14 @@ import (
 	"time"
 
 	"golang-rtmp/config"
+	"golang-rtmp/internal/hooks"
 	"golang-rtmp/internal/http"
+	"golang-rtmp/internal/pull"
+	"golang-rtmp/internal/record"
+	"golang-rtmp/internal/relay"
 	"golang-rtmp/internal/rtmp"
 	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/whip"
 
 	"github.com/sirupsen/logrus"
 )
@@ -50,14 +55,88 @@ func main() {
 	logger.Info("Starting RTMP to HLS server")
 
 	streamManager := stream.NewStreamManager(logger)
+	streamManager.SetGOPCacheSize(cfg.RTMP.GOPCacheSize)
+	streamManager.SetLogBufferSize(cfg.FFmpeg.LogLines)
+	streamManager.SetRestartPolicy(stream.RestartPolicy{
+		InitialBackoff: time.Duration(cfg.FFmpeg.Restart.InitialBackoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(cfg.FFmpeg.Restart.MaxBackoff) * time.Millisecond,
+		Multiplier:     cfg.FFmpeg.Restart.Multiplier,
+		MaxRestarts:    cfg.FFmpeg.Restart.MaxRestarts,
+		Window:         time.Duration(cfg.FFmpeg.Restart.Window) * time.Second,
+	})
 
 	rtmpAddr := fmt.Sprintf(":%d", cfg.RTMP.Port)
 	rtmpServer := rtmp.NewServer(rtmpAddr, streamManager, logger)
 	rtmpServer.SetFFmpegConfig(cfg.FFmpeg.BinaryPath, cfg.FFmpeg.Params)
+	rtmpServer.SetRenditions(renditionsFromConfig(cfg.FFmpeg.Renditions))
 	rtmpServer.SetHLSConfig(cfg.HLS.OutputDir, cfg.HLS.SegmentDuration, cfg.HLS.PlaylistWindow)
+	if err := rtmpServer.SetSegmenter(cfg.HLS.Segmenter); err != nil {
+		logger.Fatalf("Invalid HLS configuration: %v", err)
+	}
+	if cfg.HLS.LowLatency {
+		rtmpServer.SetLowLatency(time.Duration(cfg.HLS.PartDurationMs) * time.Millisecond)
+	}
+	rtmpServer.SetPlayerQueueSize(cfg.RTMP.PlayerQueueSize)
+	recorder := record.NewManager(cfg.Recording.Dir, logger)
+	rtmpServer.SetRecorder(recorder)
+	relayManager := relay.NewManager(logger)
+	rtmpServer.SetRelay(relayManager)
+	for app, appConfig := range cfg.Apps {
+		err := rtmpServer.SetAppConfig(app, rtmp.AppConfig{
+			Passthrough: appConfig.Passthrough,
+			Container:   appConfig.Container,
+			DASH:        appConfig.DASH,
+			DVRWindow:   time.Duration(appConfig.DVRWindow) * time.Second,
+			Record:      recordConfigFromConfig(appConfig.Record),
+			Push:        appConfig.Push,
+		})
+		if err != nil {
+			logger.Fatalf("Invalid configuration for app %s: %v", app, err)
+		}
+	}
+
+	authorizer, err := rtmp.NewPublishAuthorizer(cfg.RTMP.Auth.Mode, cfg.RTMP.Auth.Keys, cfg.RTMP.Auth.Secret)
+	if err != nil {
+		logger.Fatalf("Invalid publish auth configuration: %v", err)
+	}
+	rtmpServer.SetPublishAuthorizer(authorizer)
+
+	hooksClient := hooks.NewClient(map[hooks.Event]string{
+		hooks.EventPublish:     cfg.Hooks.OnPublish,
+		hooks.EventPublishDone: cfg.Hooks.OnPublishDone,
+		hooks.EventPlay:        cfg.Hooks.OnPlay,
+		hooks.EventPlayDone:    cfg.Hooks.OnPlayDone,
+	}, time.Duration(cfg.Hooks.Timeout)*time.Second, cfg.Hooks.Retries, logger)
+	rtmpServer.SetHooks(hooksClient)
 
 	httpAddr := fmt.Sprintf(":%d", cfg.Server.HTTPPort)
 	httpServer := http.NewServer(httpAddr, streamManager, logger, cfg.HLS.OutputDir)
+	httpServer.SetRecordings(recorder)
+	httpServer.SetRelay(relayManager)
+	httpServer.SetViewerQueueSize(cfg.RTMP.PlayerQueueSize)
+	httpServer.SetHooks(hooksClient)
+
+	pullManager := pull.NewManager(rtmpServer, cfg.Pull.FileDir, logger)
+	httpServer.SetPulls(pullManager)
+	httpServer.SetRTMP(rtmpServer)
+
+	bans := rtmp.NewBanList()
+	rtmpServer.SetBans(bans)
+	httpServer.SetBans(bans)
+	for _, pc := range cfg.Pull.Streams {
+		if err := pullManager.Configure(pull.Config{App: pc.App, Stream: pc.Stream, URL: pc.URL}); err != nil {
+			logger.Fatalf("Invalid pull configuration for %s/%s: %v", pc.App, pc.Stream, err)
+		}
+		if pc.AutoStart {
+			pullManager.Start(pc.App + "/" + pc.Stream)
+		}
+	}
+
+	whipManager := whip.NewManager(rtmpServer, streamManager, logger)
+	whipManager.SetICEServers(cfg.WebRTC.ICEServers)
+	whipManager.SetNAT1To1IPs(cfg.WebRTC.NAT1To1IPs)
+	whipManager.SetFFmpegPath(cfg.FFmpeg.BinaryPath)
+	httpServer.SetWebRTC(whipManager)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -91,15 +170,56 @@ func main() {
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
+	pullManager.StopAll()
+	whipManager.CloseAll()
+
 	streams := streamManager.ListStreams()
 	for _, stream := range streams {
+		// Ending the stream closes its subscribers, so recorders finalize
+		// their files and pushes end their upstream streams.
+		stream.WriteTrailer()
 		stream.Stop()
+		relayManager.StopStream(stream.ID)
 	}
 
+	finished := make(chan struct{})
+	go func() {
+		recorder.Wait()
+		relayManager.Wait()
+		pullManager.Wait()
+		whipManager.Wait()
+		close(finished)
+	}()
+
 	select {
+	case <-finished:
+		logger.Info("Server shutdown completed")
 	case <-shutdownCtx.Done():
 		logger.Warn("Shutdown timeout reached")
-	default:
-		logger.Info("Server shutdown completed")
+	}
+}
+
+func renditionsFromConfig(configs []config.RenditionConfig) []stream.Rendition {
+	renditions := make([]stream.Rendition, 0, len(configs))
+	for _, rc := range configs {
+		renditions = append(renditions, stream.Rendition{
+			Name:         rc.Name,
+			Resolution:   rc.Resolution,
+			VideoBitrate: rc.VideoBitrate,
+			AudioBitrate: rc.AudioBitrate,
+			Profile:      rc.Profile,
+		})
+	}
+	return renditions
+}
+
+func recordConfigFromConfig(rc config.RecordConfig) *record.Config {
+	if !rc.Enabled {
+		return nil
+	}
+	return &record.Config{
+		PathTemplate: rc.Path,
+		MaxDuration:  time.Duration(rc.MaxDuration) * time.Second,
+		MaxSize:      int64(rc.MaxSizeMB) * 1024 * 1024,
 	}
 }
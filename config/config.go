@@ -7,12 +7,54 @@ import (
 )
 
 type Config struct {
-	Server  ServerConfig  `yaml:"server"`
-	RTMP    RTMPConfig    `yaml:"rtmp"`
-	HLS     HLSConfig     `yaml:"hls"`
-	FFmpeg  FFmpegConfig  `yaml:"ffmpeg"`
-	Logging LoggingConfig `yaml:"logging"`
-	Metrics MetricsConfig `yaml:"metrics"`
+	Server    ServerConfig         `yaml:"server"`
+	RTMP      RTMPConfig           `yaml:"rtmp"`
+	HLS       HLSConfig            `yaml:"hls"`
+	FFmpeg    FFmpegConfig         `yaml:"ffmpeg"`
+	Logging   LoggingConfig        `yaml:"logging"`
+	Metrics   MetricsConfig        `yaml:"metrics"`
+	Hooks     HooksConfig          `yaml:"hooks"`
+	Recording RecordingConfig      `yaml:"recording"`
+	Pull      PullConfig           `yaml:"pull"`
+	WebRTC    WebRTCConfig         `yaml:"webrtc"`
+	Apps      map[string]AppConfig `yaml:"apps"`
+}
+
+type AppConfig struct {
+	Passthrough bool         `yaml:"passthrough"`
+	Container   string       `yaml:"container"`
+	DASH        bool         `yaml:"dash"`
+	DVRWindow   int          `yaml:"dvr_window"`
+	Record      RecordConfig `yaml:"record"`
+	Push        []string     `yaml:"push"`
+}
+
+type RecordConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	Path        string `yaml:"path"`
+	MaxDuration int    `yaml:"max_duration"`
+	MaxSizeMB   int    `yaml:"max_size_mb"`
+}
+
+type RecordingConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type PullConfig struct {
+	FileDir string             `yaml:"file_dir"`
+	Streams []PullStreamConfig `yaml:"streams"`
+}
+
+type PullStreamConfig struct {
+	App       string `yaml:"app"`
+	Stream    string `yaml:"stream"`
+	URL       string `yaml:"url"`
+	AutoStart bool   `yaml:"auto_start"`
+}
+
+type WebRTCConfig struct {
+	ICEServers []string `yaml:"ice_servers"`
+	NAT1To1IPs []string `yaml:"nat_1to1_ips"`
 }
 
 type ServerConfig struct {
@@ -20,18 +62,58 @@ type ServerConfig struct {
 }
 
 type RTMPConfig struct {
-	Port int `yaml:"port"`
+	Port            int        `yaml:"port"`
+	PlayerQueueSize int        `yaml:"player_queue_size"`
+	GOPCacheSize    int        `yaml:"gop_cache_size"`
+	Auth            AuthConfig `yaml:"auth"`
+}
+
+type AuthConfig struct {
+	Mode   string   `yaml:"mode"`
+	Keys   []string `yaml:"keys"`
+	Secret string   `yaml:"secret"`
 }
 
 type HLSConfig struct {
 	OutputDir       string `yaml:"output_dir"`
 	SegmentDuration int    `yaml:"segment_duration"`
 	PlaylistWindow  int    `yaml:"playlist_window"`
+	Segmenter       string `yaml:"segmenter"`
+	LowLatency      bool   `yaml:"low_latency"`
+	PartDurationMs  int    `yaml:"part_duration_ms"`
 }
 
 type FFmpegConfig struct {
 	BinaryPath string            `yaml:"binary_path"`
 	Params     map[string]string `yaml:"params"`
+	Restart    RestartConfig     `yaml:"restart"`
+	LogLines   int               `yaml:"log_lines"`
+	Renditions []RenditionConfig `yaml:"renditions"`
+}
+
+type RenditionConfig struct {
+	Name         string `yaml:"name"`
+	Resolution   string `yaml:"resolution"`
+	VideoBitrate string `yaml:"video_bitrate"`
+	AudioBitrate string `yaml:"audio_bitrate"`
+	Profile      string `yaml:"profile"`
+}
+
+type RestartConfig struct {
+	InitialBackoff int     `yaml:"initial_backoff_ms"`
+	MaxBackoff     int     `yaml:"max_backoff_ms"`
+	Multiplier     float64 `yaml:"multiplier"`
+	MaxRestarts    int     `yaml:"max_restarts"`
+	Window         int     `yaml:"window"`
+}
+
+type HooksConfig struct {
+	OnPublish     string `yaml:"on_publish"`
+	OnPublishDone string `yaml:"on_publish_done"`
+	OnPlay        string `yaml:"on_play"`
+	OnPlayDone    string `yaml:"on_play_done"`
+	Timeout       int    `yaml:"timeout"`
+	Retries       int    `yaml:"retries"`
 }
 
 type LoggingConfig struct {
@@ -64,12 +146,19 @@ func DefaultConfig() *Config {
 			HTTPPort: 8080,
 		},
 		RTMP: RTMPConfig{
-			Port: 1935,
+			Port:            1935,
+			PlayerQueueSize: 256,
+			GOPCacheSize:    1,
+			Auth: AuthConfig{
+				Mode: "none",
+			},
 		},
 		HLS: HLSConfig{
 			OutputDir:       "./hls",
 			SegmentDuration: 4,
 			PlaylistWindow:  10,
+			Segmenter:       "ffmpeg",
+			PartDurationMs:  1000,
 		},
 		FFmpeg: FFmpegConfig{
 			BinaryPath: "ffmpeg",
@@ -81,6 +170,14 @@ func DefaultConfig() *Config {
 				"resolution":    "1280x720",
 				"fps":           "30",
 			},
+			Restart: RestartConfig{
+				InitialBackoff: 1000,
+				MaxBackoff:     30000,
+				Multiplier:     2,
+				MaxRestarts:    5,
+				Window:         60,
+			},
+			LogLines: 500,
 		},
 		Logging: LoggingConfig{
 			Level: "info",
@@ -89,5 +186,15 @@ func DefaultConfig() *Config {
 			Enabled: true,
 			Port:    9090,
 		},
+		Hooks: HooksConfig{
+			Timeout: 5,
+			Retries: 2,
+		},
+		Recording: RecordingConfig{
+			Dir: "./recordings",
+		},
+		Pull: PullConfig{
+			FileDir: "./media",
+		},
 	}
 }
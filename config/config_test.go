@@ -16,6 +16,14 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected RTMP port 1935, got %d", config.RTMP.Port)
 	}
 
+	if config.RTMP.PlayerQueueSize != 256 {
+		t.Errorf("Expected player queue size 256, got %d", config.RTMP.PlayerQueueSize)
+	}
+
+	if config.RTMP.GOPCacheSize != 1 {
+		t.Errorf("Expected GOP cache size 1, got %d", config.RTMP.GOPCacheSize)
+	}
+
 	if config.HLS.OutputDir != "./hls" {
 		t.Errorf("Expected HLS output dir './hls', got '%s'", config.HLS.OutputDir)
 	}
@@ -28,10 +36,28 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected playlist window 10, got %d", config.HLS.PlaylistWindow)
 	}
 
+	if config.HLS.Segmenter != "ffmpeg" {
+		t.Errorf("Expected segmenter 'ffmpeg', got '%s'", config.HLS.Segmenter)
+	}
+	if config.HLS.LowLatency {
+		t.Error("Expected low latency HLS to be disabled by default")
+	}
+	if config.HLS.PartDurationMs != 1000 {
+		t.Errorf("Expected part duration 1000ms, got %d", config.HLS.PartDurationMs)
+	}
+
 	if config.FFmpeg.BinaryPath != "ffmpeg" {
 		t.Errorf("Expected FFmpeg binary path 'ffmpeg', got '%s'", config.FFmpeg.BinaryPath)
 	}
 
+	if config.FFmpeg.Restart.MaxRestarts != 5 {
+		t.Errorf("Expected max restarts 5, got %d", config.FFmpeg.Restart.MaxRestarts)
+	}
+
+	if config.FFmpeg.LogLines != 500 {
+		t.Errorf("Expected FFmpeg log lines 500, got %d", config.FFmpeg.LogLines)
+	}
+
 	if config.Logging.Level != "info" {
 		t.Errorf("Expected logging level 'info', got '%s'", config.Logging.Level)
 	}
@@ -44,6 +70,14 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected metrics port 9090, got %d", config.Metrics.Port)
 	}
 
+	if config.Pull.FileDir != "./media" {
+		t.Errorf("Expected pull file dir './media', got '%s'", config.Pull.FileDir)
+	}
+
+	if config.Hooks.Timeout != 5 {
+		t.Errorf("Expected hooks timeout 5, got %d", config.Hooks.Timeout)
+	}
+
 	if config.FFmpeg.Params["video_codec"] != "libx264" {
 		t.Errorf("Expected video codec 'libx264', got '%s'", config.FFmpeg.Params["video_codec"])
 	}
@@ -60,11 +94,18 @@ server:
 
 rtmp:
   port: 1936
+  gop_cache_size: 3
+  auth:
+    mode: "static"
+    keys: ["key1", "key2"]
 
 hls:
   output_dir: "/tmp/hls"
   segment_duration: 6
   playlist_window: 15
+  segmenter: "native"
+  low_latency: true
+  part_duration_ms: 500
 
 ffmpeg:
   binary_path: "/usr/bin/ffmpeg"
@@ -75,6 +116,20 @@ ffmpeg:
     audio_bitrate: "256k"
     resolution: "1920x1080"
     fps: "60"
+  restart:
+    initial_backoff_ms: 500
+    max_restarts: 3
+  renditions:
+    - name: "720p"
+      resolution: "1280x720"
+      video_bitrate: "2800k"
+      audio_bitrate: "128k"
+      profile: "main"
+    - name: "360p"
+      resolution: "640x360"
+      video_bitrate: "800k"
+      audio_bitrate: "96k"
+      profile: "baseline"
 
 logging:
   level: "debug"
@@ -82,6 +137,40 @@ logging:
 metrics:
   enabled: false
   port: 9091
+
+hooks:
+  on_publish: "http://backend/on_publish"
+  timeout: 3
+  retries: 1
+
+apps:
+  live:
+    passthrough: true
+    container: "fmp4"
+    dash: true
+    dvr_window: 7200
+    record:
+      enabled: true
+      path: "{app}/{stream}/{start_time}.flv"
+      max_duration: 600
+    push:
+      - "rtmp://a.example.com/live/{stream}"
+      - "rtmp://b.example.com/app/{stream}?key=secret"
+
+recording:
+  dir: "/var/recordings"
+
+pull:
+  file_dir: "/srv/media"
+  streams:
+    - app: "live"
+      stream: "camera1"
+      url: "rtmp://camera.local/live/cam1"
+      auto_start: true
+
+webrtc:
+  ice_servers: ["stun:stun.l.google.com:19302"]
+  nat_1to1_ips: ["203.0.113.10"]
 `
 
 	tmpFile, err := os.CreateTemp("", "test_config_*.yaml")
@@ -108,6 +197,18 @@ metrics:
 		t.Errorf("Expected RTMP port 1936, got %d", config.RTMP.Port)
 	}
 
+	if config.RTMP.GOPCacheSize != 3 {
+		t.Errorf("Expected GOP cache size 3, got %d", config.RTMP.GOPCacheSize)
+	}
+
+	if config.RTMP.Auth.Mode != "static" {
+		t.Errorf("Expected auth mode 'static', got '%s'", config.RTMP.Auth.Mode)
+	}
+
+	if len(config.RTMP.Auth.Keys) != 2 {
+		t.Errorf("Expected 2 auth keys, got %d", len(config.RTMP.Auth.Keys))
+	}
+
 	if config.HLS.OutputDir != "/tmp/hls" {
 		t.Errorf("Expected HLS output dir '/tmp/hls', got '%s'", config.HLS.OutputDir)
 	}
@@ -120,10 +221,33 @@ metrics:
 		t.Errorf("Expected playlist window 15, got %d", config.HLS.PlaylistWindow)
 	}
 
+	if config.HLS.Segmenter != "native" {
+		t.Errorf("Expected segmenter 'native', got '%s'", config.HLS.Segmenter)
+	}
+	if !config.HLS.LowLatency || config.HLS.PartDurationMs != 500 {
+		t.Errorf("Expected low latency HLS with 500ms parts, got %v/%d", config.HLS.LowLatency, config.HLS.PartDurationMs)
+	}
+
 	if config.FFmpeg.BinaryPath != "/usr/bin/ffmpeg" {
 		t.Errorf("Expected FFmpeg binary path '/usr/bin/ffmpeg', got '%s'", config.FFmpeg.BinaryPath)
 	}
 
+	if config.FFmpeg.Restart.InitialBackoff != 500 {
+		t.Errorf("Expected initial backoff 500, got %d", config.FFmpeg.Restart.InitialBackoff)
+	}
+
+	if config.FFmpeg.Restart.MaxRestarts != 3 {
+		t.Errorf("Expected max restarts 3, got %d", config.FFmpeg.Restart.MaxRestarts)
+	}
+
+	if len(config.FFmpeg.Renditions) != 2 {
+		t.Fatalf("Expected 2 renditions, got %d", len(config.FFmpeg.Renditions))
+	}
+
+	if config.FFmpeg.Renditions[1].Name != "360p" || config.FFmpeg.Renditions[1].VideoBitrate != "800k" {
+		t.Errorf("Unexpected second rendition %+v", config.FFmpeg.Renditions[1])
+	}
+
 	if config.Logging.Level != "debug" {
 		t.Errorf("Expected logging level 'debug', got '%s'", config.Logging.Level)
 	}
@@ -136,6 +260,54 @@ metrics:
 		t.Errorf("Expected metrics port 9091, got %d", config.Metrics.Port)
 	}
 
+	if config.Hooks.OnPublish != "http://backend/on_publish" {
+		t.Errorf("Expected on_publish hook 'http://backend/on_publish', got '%s'", config.Hooks.OnPublish)
+	}
+
+	if config.Hooks.Timeout != 3 {
+		t.Errorf("Expected hooks timeout 3, got %d", config.Hooks.Timeout)
+	}
+
+	if !config.Apps["live"].Passthrough {
+		t.Error("Expected passthrough to be enabled for app 'live'")
+	}
+
+	if config.Apps["live"].Container != "fmp4" {
+		t.Errorf("Expected container 'fmp4' for app 'live', got '%s'", config.Apps["live"].Container)
+	}
+
+	if !config.Apps["live"].DASH {
+		t.Error("Expected DASH to be enabled for app 'live'")
+	}
+
+	if config.Apps["live"].DVRWindow != 7200 {
+		t.Errorf("Expected DVR window 7200 for app 'live', got %d", config.Apps["live"].DVRWindow)
+	}
+
+	record := config.Apps["live"].Record
+	if !record.Enabled || record.Path != "{app}/{stream}/{start_time}.flv" || record.MaxDuration != 600 {
+		t.Errorf("Unexpected record config for app 'live': %+v", record)
+	}
+
+	if push := config.Apps["live"].Push; len(push) != 2 || push[0] != "rtmp://a.example.com/live/{stream}" {
+		t.Errorf("Unexpected push targets for app 'live': %v", push)
+	}
+
+	if config.Recording.Dir != "/var/recordings" {
+		t.Errorf("Expected recording dir '/var/recordings', got '%s'", config.Recording.Dir)
+	}
+
+	if config.Pull.FileDir != "/srv/media" || len(config.Pull.Streams) != 1 {
+		t.Fatalf("Unexpected pull config: %+v", config.Pull)
+	}
+	if pull := config.Pull.Streams[0]; pull.App != "live" || pull.Stream != "camera1" || pull.URL != "rtmp://camera.local/live/cam1" || !pull.AutoStart {
+		t.Errorf("Unexpected pull stream: %+v", pull)
+	}
+
+	if webrtc := config.WebRTC; len(webrtc.ICEServers) != 1 || webrtc.ICEServers[0] != "stun:stun.l.google.com:19302" || len(webrtc.NAT1To1IPs) != 1 || webrtc.NAT1To1IPs[0] != "203.0.113.10" {
+		t.Errorf("Unexpected WebRTC config: %+v", webrtc)
+	}
+
 	if config.FFmpeg.Params["video_codec"] != "libx265" {
 		t.Errorf("Expected video codec 'libx265', got '%s'", config.FFmpeg.Params["video_codec"])
 	}
@@ -0,0 +1,361 @@
+package dash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotCMAF           = errors.New("playlist does not reference fMP4 segments")
+	ErrNoRepresentations = errors.New("no representation is ready")
+)
+
+const (
+	ContentTypeVideo = "video"
+	ContentTypeAudio = "audio"
+)
+
+// Manifest describes a live MPD built from one or more fMP4 HLS media
+// playlists that share their segments with DASH players.
+// AvailabilityStartTime is the wall clock time of media time zero.
+type Manifest struct {
+	AvailabilityStartTime time.Time
+	PublishTime           time.Time
+	MinimumUpdatePeriod   time.Duration
+	TimeShiftBufferDepth  time.Duration
+	Representations       []Representation
+}
+
+// Representation is a single track; video and audio representations are
+// put in separate adaptation sets. Timescale is the media timescale of the
+// track, which the segment timeline is written in.
+type Representation struct {
+	ID             string
+	ContentType    string
+	Bandwidth      int
+	Codecs         string
+	Width          int
+	Height         int
+	Timescale      uint32
+	Initialization string
+	Media          string
+	StartNumber    int
+	Segments       []Segment
+}
+
+// Segment start and duration are wall clock times from the playlist, while
+// MediaTime and MediaDuration place the segment on the media timeline of
+// its fMP4 data, in units of the representation's timescale.
+type Segment struct {
+	URI           string
+	Start         time.Time
+	Duration      time.Duration
+	MediaTime     uint64
+	MediaDuration uint64
+}
+
+type mpd struct {
+	XMLName                    xml.Name `xml:"MPD"`
+	Xmlns                      string   `xml:"xmlns,attr"`
+	Profiles                   string   `xml:"profiles,attr"`
+	Type                       string   `xml:"type,attr"`
+	AvailabilityStartTime      string   `xml:"availabilityStartTime,attr"`
+	PublishTime                string   `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string   `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string   `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string   `xml:"timeShiftBufferDepth,attr,omitempty"`
+	SuggestedPresentationDelay string   `xml:"suggestedPresentationDelay,attr"`
+	MaxSegmentDuration         string   `xml:"maxSegmentDuration,attr"`
+	Period                     period   `xml:"Period"`
+}
+
+type period struct {
+	ID             string          `xml:"id,attr"`
+	Start          string          `xml:"start,attr"`
+	AdaptationSets []adaptationSet `xml:"AdaptationSet"`
+}
+
+type adaptationSet struct {
+	ID               int              `xml:"id,attr"`
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	StartWithSAP     int              `xml:"startWithSAP,attr"`
+	Representations  []representation `xml:"Representation"`
+}
+
+type representation struct {
+	ID              string          `xml:"id,attr"`
+	Bandwidth       int             `xml:"bandwidth,attr"`
+	Codecs          string          `xml:"codecs,attr,omitempty"`
+	Width           int             `xml:"width,attr,omitempty"`
+	Height          int             `xml:"height,attr,omitempty"`
+	SegmentTemplate segmentTemplate `xml:"SegmentTemplate"`
+}
+
+type segmentTemplate struct {
+	Timescale       uint32          `xml:"timescale,attr"`
+	Initialization  string          `xml:"initialization,attr"`
+	Media           string          `xml:"media,attr"`
+	StartNumber     int             `xml:"startNumber,attr"`
+	SegmentTimeline segmentTimeline `xml:"SegmentTimeline"`
+}
+
+type segmentTimeline struct {
+	S []timelineEntry `xml:"S"`
+}
+
+type timelineEntry struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int     `xml:"r,attr,omitempty"`
+}
+
+// BuildManifest renders a dynamic MPD with one SegmentTemplate and
+// SegmentTimeline per representation. Representations without a known
+// bandwidth or without segments are left out, since players cannot pick
+// between them; ErrNoRepresentations is returned if none are left.
+func BuildManifest(m Manifest) ([]byte, error) {
+	var reps []Representation
+	for _, rep := range m.Representations {
+		if rep.Bandwidth > 0 && len(rep.Segments) > 0 {
+			reps = append(reps, rep)
+		}
+	}
+	if len(reps) == 0 {
+		return nil, ErrNoRepresentations
+	}
+
+	var maxSegment time.Duration
+	for _, rep := range reps {
+		if rep.Timescale == 0 {
+			return nil, fmt.Errorf("representation %s has no timescale", rep.ID)
+		}
+		for _, segment := range rep.Segments {
+			if segment.Duration > maxSegment {
+				maxSegment = segment.Duration
+			}
+		}
+	}
+
+	doc := mpd{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      m.AvailabilityStartTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:                m.PublishTime.UTC().Format(time.RFC3339),
+		MinimumUpdatePeriod:        formatDuration(m.MinimumUpdatePeriod),
+		MinBufferTime:              formatDuration(maxSegment),
+		SuggestedPresentationDelay: formatDuration(3 * maxSegment),
+		MaxSegmentDuration:         formatDuration(maxSegment),
+		Period: period{
+			ID:    "0",
+			Start: "PT0S",
+		},
+	}
+	if m.TimeShiftBufferDepth > 0 {
+		doc.TimeShiftBufferDepth = formatDuration(m.TimeShiftBufferDepth)
+	}
+
+	// dash.js only plays one track per adaptation set, so muxed
+	// representations would go unheard; each content type gets its own.
+	for _, contentType := range []string{ContentTypeVideo, ContentTypeAudio} {
+		set := adaptationSet{
+			ID:               len(doc.Period.AdaptationSets),
+			ContentType:      contentType,
+			MimeType:         contentType + "/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+		}
+		for _, rep := range reps {
+			if rep.ContentType != contentType {
+				continue
+			}
+			set.Representations = append(set.Representations, representation{
+				ID:        rep.ID,
+				Bandwidth: rep.Bandwidth,
+				Codecs:    rep.Codecs,
+				Width:     rep.Width,
+				Height:    rep.Height,
+				SegmentTemplate: segmentTemplate{
+					Timescale:       rep.Timescale,
+					Initialization:  rep.Initialization,
+					Media:           rep.Media,
+					StartNumber:     rep.StartNumber,
+					SegmentTimeline: buildTimeline(rep.Segments),
+				},
+			})
+		}
+		if len(set.Representations) > 0 {
+			doc.Period.AdaptationSets = append(doc.Period.AdaptationSets, set)
+		}
+	}
+
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// buildTimeline collapses consecutive segments of equal duration into one S
+// element with a repeat count, and only writes t where the timeline jumps.
+func buildTimeline(segments []Segment) segmentTimeline {
+	var timeline segmentTimeline
+	var next uint64
+	for i, segment := range segments {
+		t := segment.MediaTime
+		d := segment.MediaDuration
+
+		if i > 0 && t == next {
+			last := &timeline.S[len(timeline.S)-1]
+			if last.D == d {
+				last.R++
+				next += d
+				continue
+			}
+			timeline.S = append(timeline.S, timelineEntry{D: d})
+		} else {
+			timeline.S = append(timeline.S, timelineEntry{T: &t, D: d})
+		}
+		next = t + d
+	}
+	return timeline
+}
+
+func formatDuration(d time.Duration) string {
+	return "PT" + strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S"
+}
+
+var segmentNumber = regexp.MustCompile(`^(.*?)(\d+)(\.m4s)$`)
+
+// RepresentationFromPlaylist reads the init segment, media sequence and
+// segment timing out of an fMP4 HLS media playlist. Segments need an
+// EXT-X-PROGRAM-DATE-TIME so the media timeline can be tied to the wall
+// clock. Only segments after the last EXT-X-DISCONTINUITY are kept, as
+// earlier ones belong to a previous media timeline.
+func RepresentationFromPlaylist(data []byte) (Representation, error) {
+	var rep Representation
+	var next time.Time
+	var duration time.Duration
+	haveTime := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			rep.StartNumber, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			rep.Initialization = attribute(strings.TrimPrefix(line, "#EXT-X-MAP:"), "URI")
+		case line == "#EXT-X-DISCONTINUITY":
+			rep.StartNumber += len(rep.Segments)
+			rep.Segments = nil
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			value := strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:")
+			t, err := parseDateTime(value)
+			if err != nil {
+				return Representation{}, fmt.Errorf("invalid program date time %q", value)
+			}
+			next = t
+			haveTime = true
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Representation{}, fmt.Errorf("invalid segment duration %q", value)
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		case line != "" && !strings.HasPrefix(line, "#"):
+			if !haveTime {
+				return Representation{}, fmt.Errorf("segment %s has no program date time", line)
+			}
+			if rep.Media == "" {
+				match := segmentNumber.FindStringSubmatch(line)
+				if match == nil {
+					return Representation{}, ErrNotCMAF
+				}
+				rep.Media = fmt.Sprintf("%s$Number%%0%dd$%s", match[1], len(match[2]), match[3])
+			}
+			rep.Segments = append(rep.Segments, Segment{URI: line, Start: next, Duration: duration})
+			next = next.Add(duration)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Representation{}, err
+	}
+
+	if rep.Initialization == "" {
+		return Representation{}, ErrNotCMAF
+	}
+	return rep, nil
+}
+
+// ReadMediaTimes places the segments on the media timeline, reading the
+// timescale from the init segment and each segment's start from its tfdt
+// box, so the timeline matches what players decode. Segment durations are
+// the differences between those starts, and the EXTINF for the last one.
+func (r *Representation) ReadMediaTimes(dir string) error {
+	timescale, err := ReadTimescale(filepath.Join(dir, r.Initialization))
+	if err != nil {
+		return err
+	}
+	r.Timescale = timescale
+
+	for i := range r.Segments {
+		start, err := ReadDecodeTime(filepath.Join(dir, r.Segments[i].URI))
+		if err != nil {
+			return err
+		}
+		r.Segments[i].MediaTime = start
+	}
+	for i := range r.Segments {
+		segment := &r.Segments[i]
+		if i+1 < len(r.Segments) && r.Segments[i+1].MediaTime > segment.MediaTime {
+			segment.MediaDuration = r.Segments[i+1].MediaTime - segment.MediaTime
+		} else {
+			segment.MediaDuration = uint64(segment.Duration.Seconds()*float64(timescale) + 0.5)
+		}
+	}
+	return nil
+}
+
+// MediaStart returns the wall clock time of media time zero, going by the
+// program date time of the first segment. It is the availabilityStartTime
+// under which segment times in the manifest are the tfdt of their data.
+func (r Representation) MediaStart() time.Time {
+	if len(r.Segments) == 0 || r.Timescale == 0 {
+		return time.Time{}
+	}
+	first := r.Segments[0]
+	timescale := uint64(r.Timescale)
+	offset := time.Duration(first.MediaTime/timescale)*time.Second +
+		time.Duration(first.MediaTime%timescale)*time.Second/time.Duration(timescale)
+	return first.Start.Add(-offset).Truncate(time.Millisecond)
+}
+
+func parseDateTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	// FFmpeg writes the zone offset without a colon, e.g. +0000.
+	return time.Parse("2006-01-02T15:04:05.999999999Z0700", value)
+}
+
+func attribute(list, name string) string {
+	for _, field := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if ok && strings.TrimSpace(key) == name {
+			return strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return ""
+}
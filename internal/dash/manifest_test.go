@@ -0,0 +1,200 @@
+package dash
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPlaylist = `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:12
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:05.000+0000
+#EXTINF:4.000000,
+segment_012.m4s
+#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:09.000+0000
+#EXTINF:4.000000,
+segment_013.m4s
+#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:13.000+0000
+#EXTINF:3.500000,
+segment_014.m4s
+`
+
+func TestRepresentationFromPlaylist(t *testing.T) {
+	rep, err := RepresentationFromPlaylist([]byte(testPlaylist))
+	if err != nil {
+		t.Fatalf("RepresentationFromPlaylist failed: %v", err)
+	}
+
+	if rep.Initialization != "init.mp4" {
+		t.Errorf("expected init.mp4, got %q", rep.Initialization)
+	}
+	if rep.Media != "segment_$Number%03d$.m4s" {
+		t.Errorf("unexpected media template %q", rep.Media)
+	}
+	if rep.StartNumber != 12 {
+		t.Errorf("expected start number 12, got %d", rep.StartNumber)
+	}
+	if len(rep.Segments) != 3 || rep.Segments[2].URI != "segment_014.m4s" || rep.Segments[2].Duration != 3500*time.Millisecond {
+		t.Fatalf("unexpected segments %+v", rep.Segments)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !rep.Segments[0].Start.Equal(start) {
+		t.Errorf("expected first segment at %s, got %s", start, rep.Segments[0].Start)
+	}
+}
+
+func TestRepresentationFromPlaylist_RequiresCMAF(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:05Z\n#EXTINF:4.0,\nsegment_000.ts\n"
+	if _, err := RepresentationFromPlaylist([]byte(playlist)); err != ErrNotCMAF {
+		t.Errorf("expected ErrNotCMAF for MPEG-TS playlist, got %v", err)
+	}
+
+	playlist = "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4.0,\nsegment_000.m4s\n"
+	if _, err := RepresentationFromPlaylist([]byte(playlist)); err == nil {
+		t.Error("expected error for segments without program date time")
+	}
+}
+
+func TestRepresentationFromPlaylist_Discontinuity(t *testing.T) {
+	playlist := strings.Replace(testPlaylist, "#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:13", "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME:2026-01-02T03:04:13", 1)
+
+	rep, err := RepresentationFromPlaylist([]byte(playlist))
+	if err != nil {
+		t.Fatalf("RepresentationFromPlaylist failed: %v", err)
+	}
+	if rep.StartNumber != 14 || len(rep.Segments) != 1 || rep.Segments[0].URI != "segment_014.m4s" {
+		t.Errorf("expected only the segment after the discontinuity, got start %d and %+v", rep.StartNumber, rep.Segments)
+	}
+}
+
+// writeTestSegments writes the init and media segments of testPlaylist, with
+// media time starting at 10s.
+func writeTestSegments(t *testing.T, dir string, timescale uint32) {
+	t.Helper()
+
+	writeTestFile(t, filepath.Join(dir, "init.mp4"), testInitSegment(timescale))
+	for i, name := range []string{"segment_012.m4s", "segment_013.m4s", "segment_014.m4s"} {
+		decodeTime := uint64(10+4*i) * uint64(timescale)
+		writeTestFile(t, filepath.Join(dir, name), testMediaSegment(decodeTime))
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestRepresentation_ReadMediaTimes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 90000)
+
+	rep, err := RepresentationFromPlaylist([]byte(testPlaylist))
+	if err != nil {
+		t.Fatalf("RepresentationFromPlaylist failed: %v", err)
+	}
+	if err := rep.ReadMediaTimes(dir); err != nil {
+		t.Fatalf("ReadMediaTimes failed: %v", err)
+	}
+
+	if rep.Timescale != 90000 {
+		t.Errorf("expected timescale 90000, got %d", rep.Timescale)
+	}
+	expected := []struct{ time, duration uint64 }{{900000, 360000}, {1260000, 360000}, {1620000, 315000}}
+	for i, segment := range rep.Segments {
+		if segment.MediaTime != expected[i].time || segment.MediaDuration != expected[i].duration {
+			t.Errorf("segment %d: expected t=%d d=%d, got t=%d d=%d", i, expected[i].time, expected[i].duration, segment.MediaTime, segment.MediaDuration)
+		}
+	}
+
+	start := time.Date(2026, 1, 2, 3, 3, 55, 0, time.UTC)
+	if got := rep.MediaStart(); !got.Equal(start) {
+		t.Errorf("expected media time zero at %s, got %s", start, got)
+	}
+
+	os.Remove(filepath.Join(dir, "segment_013.m4s"))
+	if err := rep.ReadMediaTimes(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected missing segment error, got %v", err)
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeTestSegments(t, dir, 90000)
+
+	video, err := RepresentationFromPlaylist([]byte(testPlaylist))
+	if err != nil {
+		t.Fatalf("RepresentationFromPlaylist failed: %v", err)
+	}
+	if err := video.ReadMediaTimes(dir); err != nil {
+		t.Fatalf("ReadMediaTimes failed: %v", err)
+	}
+	video.ID = "video"
+	video.ContentType = ContentTypeVideo
+	video.Bandwidth = 1100000
+	video.Codecs = "avc1.640028"
+	video.Width, video.Height = 1280, 720
+
+	audio := video
+	audio.ID = "audio"
+	audio.ContentType = ContentTypeAudio
+	audio.Bandwidth = 140800
+	audio.Codecs = "mp4a.40.2"
+	audio.Width, audio.Height = 0, 0
+
+	unmeasured := video
+	unmeasured.ID = "unmeasured"
+	unmeasured.Bandwidth = 0
+
+	data, err := BuildManifest(Manifest{
+		AvailabilityStartTime: video.MediaStart(),
+		PublishTime:           time.Date(2026, 1, 2, 3, 4, 20, 0, time.UTC),
+		MinimumUpdatePeriod:   4 * time.Second,
+		TimeShiftBufferDepth:  40 * time.Second,
+		Representations:       []Representation{audio, video, unmeasured},
+	})
+	if err != nil {
+		t.Fatalf("BuildManifest failed: %v", err)
+	}
+
+	manifest := string(data)
+	for _, expected := range []string{
+		`type="dynamic"`,
+		`availabilityStartTime="2026-01-02T03:03:55Z"`,
+		`publishTime="2026-01-02T03:04:20Z"`,
+		`minimumUpdatePeriod="PT4S"`,
+		`timeShiftBufferDepth="PT40S"`,
+		`maxSegmentDuration="PT4S"`,
+		`<AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">`,
+		`<AdaptationSet id="1" contentType="audio" mimeType="audio/mp4" segmentAlignment="true" startWithSAP="1">`,
+		`<Representation id="video" bandwidth="1100000" codecs="avc1.640028" width="1280" height="720">`,
+		`<Representation id="audio" bandwidth="140800" codecs="mp4a.40.2">`,
+		`<SegmentTemplate timescale="90000" initialization="init.mp4" media="segment_$Number%03d$.m4s" startNumber="12">`,
+		`<S t="900000" d="360000" r="1"></S>`,
+		`<S d="315000"></S>`,
+	} {
+		if !strings.Contains(manifest, expected) {
+			t.Errorf("expected manifest to contain %s, got:\n%s", expected, manifest)
+		}
+	}
+	if strings.Contains(manifest, "unmeasured") {
+		t.Errorf("expected representation without bandwidth to be left out, got:\n%s", manifest)
+	}
+
+	if err := xml.Unmarshal(data, new(struct{})); err != nil {
+		t.Errorf("expected well-formed XML: %v", err)
+	}
+
+	if _, err := BuildManifest(Manifest{Representations: []Representation{unmeasured}}); !errors.Is(err, ErrNoRepresentations) {
+		t.Errorf("expected ErrNoRepresentations, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package dash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var errBoxNotFound = errors.New("box not found")
+
+// ReadTimescale returns the media timescale of the first track of an fMP4
+// init segment, from moov/trak/mdia/mdhd.
+func ReadTimescale(path string) (uint32, error) {
+	payload, err := readBox(path, "moov", "trak", "mdia", "mdhd")
+	if err != nil {
+		return 0, err
+	}
+
+	// version(1) flags(3), then 32 or 64-bit creation and modification times.
+	offset := 12
+	if len(payload) > 0 && payload[0] == 1 {
+		offset = 20
+	}
+	if len(payload) < offset+4 {
+		return 0, fmt.Errorf("%s: truncated mdhd box", path)
+	}
+	timescale := binary.BigEndian.Uint32(payload[offset:])
+	if timescale == 0 {
+		return 0, fmt.Errorf("%s: zero timescale", path)
+	}
+	return timescale, nil
+}
+
+// ReadDecodeTime returns the baseMediaDecodeTime of the first track fragment
+// of an fMP4 media segment, from moof/traf/tfdt.
+func ReadDecodeTime(path string) (uint64, error) {
+	payload, err := readBox(path, "moof", "traf", "tfdt")
+	if err != nil {
+		return 0, err
+	}
+
+	if len(payload) >= 12 && payload[0] == 1 {
+		return binary.BigEndian.Uint64(payload[4:]), nil
+	}
+	if len(payload) >= 8 {
+		return uint64(binary.BigEndian.Uint32(payload[4:])), nil
+	}
+	return 0, fmt.Errorf("%s: truncated tfdt box", path)
+}
+
+// readBox returns the payload of the box at the given path of box types. Only
+// the headers of other boxes are read, so media data is skipped.
+func readBox(path string, types ...string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := findBox(file, 0, info.Size(), types)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return payload, nil
+}
+
+func findBox(r io.ReaderAt, offset, end int64, types []string) ([]byte, error) {
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || offset+size > end {
+			return nil, fmt.Errorf("invalid %q box size %d", boxType, size)
+		}
+
+		if boxType == types[0] {
+			if len(types) > 1 {
+				return findBox(r, offset+headerSize, offset+size, types[1:])
+			}
+			payload := make([]byte, size-headerSize)
+			if _, err := r.ReadAt(payload, offset+headerSize); err != nil {
+				return nil, err
+			}
+			return payload, nil
+		}
+		offset += size
+	}
+	return nil, fmt.Errorf("%w: %s", errBoxNotFound, types[0])
+}
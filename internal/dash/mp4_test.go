@@ -0,0 +1,76 @@
+package dash
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func testBox(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
+
+// testInitSegment has a version 0 mdhd box after an unrelated mvhd box.
+func testInitSegment(timescale uint32) []byte {
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], timescale)
+	moov := append(testBox("mvhd", make([]byte, 100)), testBox("trak", testBox("mdia", testBox("mdhd", mdhd)))...)
+	return append(testBox("ftyp", []byte("iso6")), testBox("moov", moov)...)
+}
+
+// testMediaSegment has a version 1 tfdt box.
+func testMediaSegment(decodeTime uint64) []byte {
+	tfdt := make([]byte, 12)
+	tfdt[0] = 1
+	binary.BigEndian.PutUint64(tfdt[4:], decodeTime)
+	traf := append(testBox("tfhd", make([]byte, 8)), testBox("tfdt", tfdt)...)
+	moof := append(testBox("mfhd", make([]byte, 8)), testBox("traf", traf)...)
+	return append(testBox("moof", moof), testBox("mdat", make([]byte, 1000))...)
+}
+
+func TestReadTimescale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "init.mp4")
+	writeTestFile(t, path, testInitSegment(48000))
+
+	timescale, err := ReadTimescale(path)
+	if err != nil {
+		t.Fatalf("ReadTimescale failed: %v", err)
+	}
+	if timescale != 48000 {
+		t.Errorf("expected timescale 48000, got %d", timescale)
+	}
+}
+
+func TestReadDecodeTime(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "segment_001.m4s")
+	writeTestFile(t, path, testMediaSegment(1<<33))
+	if decodeTime, err := ReadDecodeTime(path); err != nil || decodeTime != 1<<33 {
+		t.Errorf("expected decode time %d, got %d, %v", uint64(1<<33), decodeTime, err)
+	}
+
+	tfdt := make([]byte, 8)
+	binary.BigEndian.PutUint32(tfdt[4:], 90000)
+	path = filepath.Join(dir, "segment_002.m4s")
+	writeTestFile(t, path, testBox("moof", testBox("traf", testBox("tfdt", tfdt))))
+	if decodeTime, err := ReadDecodeTime(path); err != nil || decodeTime != 90000 {
+		t.Errorf("expected decode time 90000 from version 0 tfdt, got %d, %v", decodeTime, err)
+	}
+
+	path = filepath.Join(dir, "segment_003.ts")
+	writeTestFile(t, path, make([]byte, 188))
+	if _, err := ReadDecodeTime(path); err == nil {
+		t.Error("expected error for a file without a moof box")
+	}
+
+	path = filepath.Join(dir, "segment_004.m4s")
+	writeTestFile(t, path, testBox("moof", testBox("mfhd", make([]byte, 8))))
+	if _, err := ReadDecodeTime(path); !errors.Is(err, errBoxNotFound) {
+		t.Errorf("expected errBoxNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package hls
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// Variant is a variant stream of a master playlist. Audio is the URI of a
+// separate audio playlist played alongside the variant, if any.
+type Variant struct {
+	URI        string
+	Bandwidth  int
+	Resolution string
+	Codecs     string
+	Audio      string
+}
+
+func BuildMasterPlaylist(variants []Variant) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+
+	groups := make(map[string]string)
+	for _, variant := range variants {
+		if variant.Audio == "" || groups[variant.Audio] != "" {
+			continue
+		}
+		groups[variant.Audio] = fmt.Sprintf("audio%d", len(groups))
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"%s\",NAME=\"audio\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s\"\n",
+			groups[variant.Audio], variant.Audio)
+	}
+
+	for _, variant := range variants {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", variant.Bandwidth)
+		if variant.Resolution != "" {
+			fmt.Fprintf(&b, ",RESOLUTION=%s", variant.Resolution)
+		}
+		if variant.Codecs != "" {
+			fmt.Fprintf(&b, ",CODECS=\"%s\"", variant.Codecs)
+		}
+		if variant.Audio != "" {
+			fmt.Fprintf(&b, ",AUDIO=\"%s\"", groups[variant.Audio])
+		}
+		fmt.Fprintf(&b, "\n%s\n", variant.URI)
+	}
+
+	return b.String()
+}
+
+// WriteMasterPlaylist replaces path atomically so players never read a
+// partially written playlist.
+func WriteMasterPlaylist(path string, variants []Variant) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(BuildMasterPlaylist(variants)), 0644); err != nil {
+		return fmt.Errorf("failed to write master playlist: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write master playlist: %w", err)
+	}
+	return nil
+}
+
+// ParseBitrate converts FFmpeg style bitrates such as "128k" or "2.5M" into
+// bits per second.
+func ParseBitrate(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	switch suffix := value[len(value)-1]; suffix {
+	case 'k', 'K':
+		multiplier = 1000
+	case 'm', 'M':
+		multiplier = 1000000
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", value)
+	}
+	return int(rate * multiplier), nil
+}
+
+// DefaultH264Level is the level_idc advertised when the real level is not
+// known, 4.0.
+const DefaultH264Level = 40
+
+// H264CodecString returns the RFC 6381 codec string for an x264 profile name
+// and a level_idc such as 31 for level 3.1.
+func H264CodecString(profile string, level int) string {
+	switch strings.ToLower(profile) {
+	case "baseline":
+		return fmt.Sprintf("avc1.42e0%02x", level)
+	case "main":
+		return fmt.Sprintf("avc1.4d40%02x", level)
+	default:
+		return fmt.Sprintf("avc1.6400%02x", level)
+	}
+}
+
+// h264Levels are the H.264 levels (Annex A) with their maximum frame size in
+// macroblocks and macroblock processing rate.
+var h264Levels = []struct {
+	level       int
+	frameSize   int
+	mbPerSecond int
+}{
+	{10, 99, 1485},
+	{11, 396, 3000},
+	{12, 396, 6000},
+	{13, 396, 11880},
+	{21, 792, 19800},
+	{22, 1620, 20250},
+	{30, 1620, 40500},
+	{31, 3600, 108000},
+	{32, 5120, 216000},
+	{40, 8192, 245760},
+	{42, 8704, 522240},
+	{50, 22080, 589824},
+	{51, 36864, 983040},
+	{52, 36864, 2073600},
+}
+
+// H264Level returns the lowest level_idc whose frame size and macroblock rate
+// limits fit video of the given size and frame rate.
+func H264Level(width, height int, fps float64) int {
+	if width <= 0 || height <= 0 || fps <= 0 {
+		return DefaultH264Level
+	}
+
+	frameSize := ((width + 15) / 16) * ((height + 15) / 16)
+	mbPerSecond := int(math.Ceil(float64(frameSize) * fps))
+	for _, limits := range h264Levels {
+		if frameSize <= limits.frameSize && mbPerSecond <= limits.mbPerSecond {
+			return limits.level
+		}
+	}
+	return h264Levels[len(h264Levels)-1].level
+}
+
+// FormatH264Level formats a level_idc the way encoders take it, e.g. "3.1".
+func FormatH264Level(level int) string {
+	return fmt.Sprintf("%d.%d", level/10, level%10)
+}
+
+const AACCodecString = "mp4a.40.2"
+
+// CodecString returns the RFC 6381 codecs list for published streams that are
+// remuxed as is, falling back to the generic strings for unknown codec data.
+func CodecString(codecs []av.CodecData) string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		switch codec := codec.(type) {
+		case h264parser.CodecData:
+			record := codec.RecordInfo
+			names = append(names, fmt.Sprintf("avc1.%02x%02x%02x", record.AVCProfileIndication, record.ProfileCompatibility, record.AVCLevelIndication))
+		case aacparser.CodecData:
+			names = append(names, fmt.Sprintf("mp4a.40.%d", codec.Config.ObjectType))
+		default:
+			switch codec.Type() {
+			case av.H264:
+				names = append(names, H264CodecString("", DefaultH264Level))
+			case av.AAC:
+				names = append(names, AACCodecString)
+			}
+		}
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,129 @@
+package hls
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+)
+
+func TestBuildMasterPlaylist(t *testing.T) {
+	playlist := BuildMasterPlaylist([]Variant{
+		{URI: "playlist_720p.m3u8", Bandwidth: 3221000, Resolution: "1280x720", Codecs: "avc1.4d401f,mp4a.40.2"},
+		{URI: "playlist_audio.m3u8", Bandwidth: 140800},
+	})
+
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3221000,RESOLUTION=1280x720,CODECS=\"avc1.4d401f,mp4a.40.2\"\n" +
+		"playlist_720p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=140800\n" +
+		"playlist_audio.m3u8\n"
+
+	if playlist != expected {
+		t.Errorf("unexpected master playlist:\n%s", playlist)
+	}
+}
+
+func TestBuildMasterPlaylist_AudioGroup(t *testing.T) {
+	playlist := BuildMasterPlaylist([]Variant{
+		{URI: "playlist_720p.m3u8", Bandwidth: 3221000, Codecs: "avc1.64001f,mp4a.40.2", Audio: "playlist_audio.m3u8"},
+		{URI: "playlist_360p.m3u8", Bandwidth: 1240000, Codecs: "avc1.64001e,mp4a.40.2", Audio: "playlist_audio.m3u8"},
+	})
+
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio0\",NAME=\"audio\",DEFAULT=YES,AUTOSELECT=YES,URI=\"playlist_audio.m3u8\"\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3221000,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"audio0\"\n" +
+		"playlist_720p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1240000,CODECS=\"avc1.64001e,mp4a.40.2\",AUDIO=\"audio0\"\n" +
+		"playlist_360p.m3u8\n"
+
+	if playlist != expected {
+		t.Errorf("unexpected master playlist:\n%s", playlist)
+	}
+}
+
+func TestWriteMasterPlaylist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live", "test", "master.m3u8")
+
+	if err := WriteMasterPlaylist(path, []Variant{{URI: "playlist_360p.m3u8", Bandwidth: 1000}}); err != nil {
+		t.Fatalf("WriteMasterPlaylist failed: %v", err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected master playlist to exist: %v", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("expected temporary file to be renamed")
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		input       string
+		expected    int
+		expectError bool
+	}{
+		{input: "128k", expected: 128000},
+		{input: "2.5M", expected: 2500000},
+		{input: "96000", expected: 96000},
+		{input: "", expected: 0},
+		{input: "fast", expectError: true},
+		{input: "-1k", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseBitrate(tt.input)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error for %q", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCodecString(t *testing.T) {
+	if got := CodecString(testutil.Codecs(t)); got != "avc1.42c01e,mp4a.40.2" {
+		t.Errorf("expected codecs from codec data, got %q", got)
+	}
+	if got := CodecString([]av.CodecData{speexCodec{}}); got != "" {
+		t.Errorf("expected no codec string for Speex, got %q", got)
+	}
+}
+
+func TestH264Level(t *testing.T) {
+	tests := []struct {
+		width, height int
+		fps           float64
+		expected      int
+	}{
+		{width: 640, height: 360, fps: 30, expected: 30},
+		{width: 1280, height: 720, fps: 30, expected: 31},
+		{width: 1280, height: 720, fps: 60, expected: 32},
+		{width: 1920, height: 1080, fps: 30, expected: 40},
+		{width: 3840, height: 2160, fps: 30, expected: 51},
+		{width: 0, height: 0, fps: 30, expected: DefaultH264Level},
+	}
+
+	for _, tt := range tests {
+		if got := H264Level(tt.width, tt.height, tt.fps); got != tt.expected {
+			t.Errorf("%dx%d@%v: expected level %d, got %d", tt.width, tt.height, tt.fps, tt.expected, got)
+		}
+	}
+	if got := H264CodecString("high", 31); got != "avc1.64001f" {
+		t.Errorf("unexpected codec string %s", got)
+	}
+}
@@ -0,0 +1,105 @@
+package hls
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playlist is a playlist read from another HLS server. A master playlist
+// only has Variants.
+type Playlist struct {
+	Variants       []string
+	MediaSequence  int
+	TargetDuration time.Duration
+	Segments       []string
+	InitSegment    string
+	Ended          bool
+}
+
+// ParsePlaylist reads the parts of a master or media playlist needed to
+// follow it as a client. URIs are returned as written.
+func ParsePlaylist(data []byte) (*Playlist, error) {
+	lines := strings.Split(string(data), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return nil, fmt.Errorf("not an HLS playlist")
+	}
+
+	p := &Playlist{}
+	variant := false
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			variant = true
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid media sequence %q", line)
+			}
+			p.MediaSequence = sequence
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid target duration %q", line)
+			}
+			p.TargetDuration = time.Duration(seconds) * time.Second
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			p.InitSegment = "#EXT-X-MAP"
+			if _, uri, ok := strings.Cut(line, `URI="`); ok {
+				p.InitSegment, _, _ = strings.Cut(uri, `"`)
+			}
+		case line == "#EXT-X-ENDLIST":
+			p.Ended = true
+		case strings.HasPrefix(line, "#"):
+		case variant:
+			p.Variants = append(p.Variants, line)
+			variant = false
+		default:
+			p.Segments = append(p.Segments, line)
+		}
+	}
+	return p, nil
+}
+
+// FinalizePlaylist turns a live media playlist into a VOD playlist by
+// declaring its type and ending it with EXT-X-ENDLIST, so a DVR window stays
+// playable after the publisher disconnects.
+func FinalizePlaylist(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE:"),
+			strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:"),
+			strings.HasPrefix(line, "#EXT-X-PRELOAD-HINT:"),
+			line == "#EXT-X-ENDLIST":
+			// Live-only tags; the VOD type and end marker are written below.
+			continue
+		}
+
+		b.WriteString(line)
+		b.WriteString("\n")
+		if strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+			b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+		}
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package hls
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFinalizePlaylist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "playlist.m3u8")
+	live := "#EXTM3U\n" +
+		"#EXT-X-VERSION:6\n" +
+		"#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000\n" +
+		"#EXT-X-MEDIA-SEQUENCE:3\n" +
+		"#EXTINF:4.000,\n" +
+		"segment_003.ts\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"segment_004.0.ts\"\n"
+	if err := os.WriteFile(path, []byte(live), 0644); err != nil {
+		t.Fatalf("failed to write playlist: %v", err)
+	}
+
+	expected := "#EXTM3U\n" +
+		"#EXT-X-VERSION:6\n" +
+		"#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-PLAYLIST-TYPE:VOD\n" +
+		"#EXT-X-MEDIA-SEQUENCE:3\n" +
+		"#EXTINF:4.000,\n" +
+		"segment_003.ts\n" +
+		"#EXT-X-ENDLIST\n"
+
+	// Finalizing twice, e.g. after FFmpeg already wrote EXT-X-ENDLIST, must not
+	// duplicate tags.
+	for i := 0; i < 2; i++ {
+		if err := FinalizePlaylist(path); err != nil {
+			t.Fatalf("FinalizePlaylist failed: %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read playlist: %v", err)
+		}
+		if string(data) != expected {
+			t.Errorf("unexpected VOD playlist:\n%s", data)
+		}
+	}
+
+	if err := FinalizePlaylist(filepath.Join(t.TempDir(), "missing.m3u8")); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestParsePlaylist(t *testing.T) {
+	media := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-MEDIA-SEQUENCE:41\n" +
+		"#EXTINF:6.000,\n" +
+		"segment_041.ts\n" +
+		"#EXTINF:6.000,\n" +
+		"https://cdn.example.com/segment_042.ts\n" +
+		"#EXT-X-ENDLIST\n"
+
+	playlist, err := ParsePlaylist([]byte(media))
+	if err != nil {
+		t.Fatalf("ParsePlaylist failed: %v", err)
+	}
+	if playlist.MediaSequence != 41 || playlist.TargetDuration != 6*time.Second || !playlist.Ended {
+		t.Errorf("unexpected playlist %+v", playlist)
+	}
+	if len(playlist.Segments) != 2 || playlist.Segments[1] != "https://cdn.example.com/segment_042.ts" {
+		t.Errorf("unexpected segments %v", playlist.Segments)
+	}
+
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=3080000,RESOLUTION=1280x720\n" +
+		"playlist_720p.m3u8\n"
+	playlist, err = ParsePlaylist([]byte(master))
+	if err != nil {
+		t.Fatalf("ParsePlaylist failed: %v", err)
+	}
+	if len(playlist.Variants) != 1 || playlist.Variants[0] != "playlist_720p.m3u8" || len(playlist.Segments) != 0 {
+		t.Errorf("unexpected master playlist %+v", playlist)
+	}
+
+	playlist, err = ParsePlaylist([]byte("#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n"))
+	if err != nil || playlist.InitSegment != "init.mp4" {
+		t.Errorf("expected init segment, got %+v, %v", playlist, err)
+	}
+
+	if _, err := ParsePlaylist([]byte("<html>")); err == nil {
+		t.Error("expected error for a non-playlist")
+	}
+}
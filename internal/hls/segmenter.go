@@ -0,0 +1,582 @@
+package hls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts"
+)
+
+var (
+	ErrSegmenterClosed = errors.New("segmenter closed")
+	ErrTooFarAhead     = errors.New("requested media sequence is too far ahead of the live edge")
+)
+
+type Segment struct {
+	Name          string
+	Sequence      int
+	Duration      time.Duration
+	Parts         []Part
+	Discontinuity bool
+}
+
+type Part struct {
+	Name        string
+	Duration    time.Duration
+	Independent bool
+}
+
+// partSegments is how many completed segments keep their EXT-X-PART lines in
+// the playlist, roughly three target durations as the LL-HLS spec suggests.
+const partSegments = 3
+
+func PartName(sequence, part int) string {
+	return fmt.Sprintf("segment_%03d.%d.ts", sequence, part)
+}
+
+func ParsePartName(name string) (sequence, part int, ok bool) {
+	if !strings.HasPrefix(name, "segment_") || !strings.HasSuffix(name, ".ts") {
+		return 0, 0, false
+	}
+
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "segment_"), ".ts"), ".")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+
+	sequence, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	part, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return sequence, part, true
+}
+
+type Segmenter struct {
+	outputDir       string
+	segmentDuration time.Duration
+	playlistWindow  int
+	partDuration    time.Duration
+	onSegment       func(Segment)
+
+	muxer    *ts.Muxer
+	videoIdx int
+	file     *os.File
+	bufw     *bufio.Writer
+
+	partFile        *os.File
+	partBufw        *bufio.Writer
+	partStart       time.Duration
+	partIndependent bool
+	frameTime       time.Duration
+	frameInterval   time.Duration
+
+	current  *Segment
+	start    time.Duration
+	lastTime time.Duration
+	segments []Segment
+	next     int
+	discSeq  int
+	discNext bool
+	closed   bool
+	updated  chan struct{}
+	mu       sync.Mutex
+}
+
+func NewSegmenter(outputDir string, segmentDuration time.Duration, playlistWindow int) *Segmenter {
+	return &Segmenter{
+		outputDir:       outputDir,
+		segmentDuration: segmentDuration,
+		playlistWindow:  playlistWindow,
+		videoIdx:        -1,
+		updated:         make(chan struct{}),
+	}
+}
+
+// SetPartDuration enables Low-Latency HLS partial segments of at most the
+// given duration. It must be called before WriteHeader.
+func (s *Segmenter) SetPartDuration(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partDuration = d
+}
+
+// Resume continues the playlist a previous segmenter left in the output
+// directory, like FFmpeg's append_list and discont_start flags: numbering
+// carries on after its last segment, so existing segments are not
+// overwritten, and the first new segment is marked EXT-X-DISCONTINUITY. It
+// must be called before WriteHeader and does nothing without a playlist.
+func (s *Segmenter) Resume() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(s.outputDir, "playlist.m3u8"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read playlist: %w", err)
+	}
+
+	sequence := 0
+	var segments []Segment
+	var parts []Part
+	var duration time.Duration
+	discontinuity := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			if sequence, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:")); err != nil {
+				return fmt.Errorf("invalid media sequence %q", line)
+			}
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			if s.discSeq, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:")); err != nil {
+				return fmt.Errorf("invalid discontinuity sequence %q", line)
+			}
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case strings.HasPrefix(line, "#EXT-X-PART:"):
+			if part, ok := parsePart(strings.TrimPrefix(line, "#EXT-X-PART:")); ok {
+				parts = append(parts, part)
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid segment duration %q", line)
+			}
+			duration = time.Duration(seconds * float64(time.Second))
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segments = append(segments, Segment{
+				Name:          line,
+				Sequence:      sequence + len(segments),
+				Duration:      duration,
+				Parts:         parts,
+				Discontinuity: discontinuity,
+			})
+			parts = nil
+			discontinuity = false
+		}
+	}
+
+	s.segments = segments
+	s.next = sequence + len(segments)
+	s.discNext = len(segments) > 0
+	return nil
+}
+
+// parsePart reads the attributes of an EXT-X-PART tag.
+func parsePart(attributes string) (Part, bool) {
+	var part Part
+	for _, attribute := range strings.Split(attributes, ",") {
+		key, value, _ := strings.Cut(attribute, "=")
+		switch key {
+		case "DURATION":
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return Part{}, false
+			}
+			part.Duration = time.Duration(seconds * float64(time.Second))
+		case "URI":
+			part.Name = strings.Trim(value, `"`)
+		case "INDEPENDENT":
+			part.Independent = value == "YES"
+		}
+	}
+	return part, part.Name != ""
+}
+
+func (s *Segmenter) SetSegmentCallback(fn func(Segment)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onSegment = fn
+}
+
+func (s *Segmenter) WriteHeader(streams []av.CodecData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("segmenter closed")
+	}
+
+	if err := os.MkdirAll(s.outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	if s.current != nil {
+		s.current.Duration = s.lastTime - s.start
+		if err := s.closeSegmentLocked(); err != nil {
+			return err
+		}
+	}
+
+	s.videoIdx = -1
+	for i, codec := range streams {
+		if codec.Type().IsVideo() {
+			s.videoIdx = i
+			break
+		}
+	}
+
+	// PAT/PMT are rewritten at the start of every segment so each one can be
+	// decoded on its own; the header written here only validates the codecs.
+	s.muxer = ts.NewMuxer(io.Discard)
+	return s.muxer.WriteHeader(streams)
+}
+
+func (s *Segmenter) WritePacket(pkt av.Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.muxer == nil {
+		return fmt.Errorf("segmenter not ready")
+	}
+
+	isVideo := s.videoIdx >= 0 && int(pkt.Idx) == s.videoIdx
+	boundary := (isVideo && pkt.IsKeyFrame) || s.videoIdx < 0
+
+	// Parts are cut on the frames that parts may start with. A part ends
+	// where the next one starts, so it is cut before the frame that would
+	// take it past PART-TARGET, going by the last frame interval.
+	cuttable := isVideo || s.videoIdx < 0
+	if cuttable {
+		if pkt.Time > s.frameTime {
+			s.frameInterval = pkt.Time - s.frameTime
+		}
+		s.frameTime = pkt.Time
+	}
+
+	if s.current == nil {
+		if !boundary {
+			return nil
+		}
+		if err := s.openSegmentLocked(pkt.Time); err != nil {
+			return err
+		}
+	} else if boundary && pkt.Time-s.start >= s.segmentDuration {
+		s.current.Duration = pkt.Time - s.start
+		if err := s.closeSegmentLocked(); err != nil {
+			return err
+		}
+		if err := s.openSegmentLocked(pkt.Time); err != nil {
+			return err
+		}
+	} else if s.partDuration > 0 && cuttable && pkt.Time > s.partStart && pkt.Time-s.partStart+s.frameInterval > s.partDuration {
+		if err := s.closePartLocked(pkt.Time); err != nil {
+			return err
+		}
+		if err := s.openPartLocked(pkt.Time, pkt.IsKeyFrame); err != nil {
+			return err
+		}
+	}
+
+	if pkt.Time > s.lastTime {
+		s.lastTime = pkt.Time
+	}
+
+	return s.muxer.WritePacket(pkt)
+}
+
+func (s *Segmenter) WriteTrailer() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.current != nil {
+		s.current.Duration = s.lastTime - s.start
+	}
+	err := s.closeSegmentLocked()
+	s.notifyLocked()
+	return err
+}
+
+func (s *Segmenter) Segments() []Segment {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Segment(nil), s.segments...)
+}
+
+// WaitForPart blocks until the playlist contains the given media sequence
+// number, or the given part of it when part is not negative. It implements
+// the _HLS_msn/_HLS_part blocking playlist reload of LL-HLS.
+func (s *Segmenter) WaitForPart(ctx context.Context, msn, part int) error {
+	for {
+		s.mu.Lock()
+		available, err := s.availableLocked(msn, part)
+		updated := s.updated
+		closed := s.closed
+		s.mu.Unlock()
+
+		if err != nil || available {
+			return err
+		}
+		if closed {
+			return ErrSegmenterClosed
+		}
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Segmenter) availableLocked(msn, part int) (bool, error) {
+	next := s.next
+	if s.current != nil {
+		next = s.current.Sequence
+	}
+
+	// The last complete segment is next-1; clients may ask for up to two
+	// segments past it.
+	if msn > next+1 {
+		return false, ErrTooFarAhead
+	}
+
+	if msn < next {
+		return true, nil
+	}
+	if part < 0 || s.current == nil || msn != s.current.Sequence {
+		return false, nil
+	}
+	return part < len(s.current.Parts), nil
+}
+
+func (s *Segmenter) notifyLocked() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *Segmenter) openSegmentLocked(start time.Duration) error {
+	name := fmt.Sprintf("segment_%03d.ts", s.next)
+
+	file, err := os.Create(filepath.Join(s.outputDir, name+".tmp"))
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+
+	s.file = file
+	s.bufw = bufio.NewWriter(file)
+	s.current = &Segment{Name: name, Sequence: s.next, Discontinuity: s.discNext}
+	s.start = start
+	s.lastTime = start
+	s.next++
+	s.discNext = false
+
+	if s.partDuration > 0 {
+		return s.openPartLocked(start, true)
+	}
+
+	s.muxer.SetWriter(s.bufw)
+	if err := s.muxer.WritePATPMT(); err != nil {
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+	return nil
+}
+
+func (s *Segmenter) openPartLocked(start time.Duration, independent bool) error {
+	name := PartName(s.current.Sequence, len(s.current.Parts))
+
+	file, err := os.Create(filepath.Join(s.outputDir, name+".tmp"))
+	if err != nil {
+		return fmt.Errorf("failed to create part: %w", err)
+	}
+
+	s.partFile = file
+	s.partBufw = bufio.NewWriter(file)
+	s.partStart = start
+	s.partIndependent = independent
+	s.muxer.SetWriter(io.MultiWriter(s.bufw, s.partBufw))
+
+	// Every part starts with PAT/PMT so players can join on any independent
+	// part; the segment file gets the same tables, which is harmless.
+	if err := s.muxer.WritePATPMT(); err != nil {
+		return fmt.Errorf("failed to write part header: %w", err)
+	}
+	return nil
+}
+
+func (s *Segmenter) closePartLocked(end time.Duration) error {
+	if s.partFile == nil {
+		return nil
+	}
+
+	name := PartName(s.current.Sequence, len(s.current.Parts))
+	err := s.partBufw.Flush()
+	if closeErr := s.partFile.Close(); err == nil {
+		err = closeErr
+	}
+	tmpPath := s.partFile.Name()
+	s.partFile = nil
+	s.partBufw = nil
+	s.muxer.SetWriter(s.bufw)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write part: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(s.outputDir, name)); err != nil {
+		return fmt.Errorf("failed to write part: %w", err)
+	}
+
+	s.current.Parts = append(s.current.Parts, Part{
+		Name:        name,
+		Duration:    end - s.partStart,
+		Independent: s.partIndependent,
+	})
+
+	if err := s.writePlaylistLocked(); err != nil {
+		return err
+	}
+	s.notifyLocked()
+	return nil
+}
+
+func (s *Segmenter) closeSegmentLocked() error {
+	if s.current == nil {
+		return nil
+	}
+
+	if err := s.closePartLocked(s.start + s.current.Duration); err != nil {
+		return err
+	}
+
+	segment := *s.current
+	s.current = nil
+
+	err := s.bufw.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	tmpPath := s.file.Name()
+	s.file = nil
+	s.bufw = nil
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write segment: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(s.outputDir, segment.Name)); err != nil {
+		return fmt.Errorf("failed to write segment: %w", err)
+	}
+
+	s.segments = append(s.segments, segment)
+	if s.playlistWindow > 0 {
+		for len(s.segments) > s.playlistWindow {
+			os.Remove(filepath.Join(s.outputDir, s.segments[0].Name))
+			for _, part := range s.segments[0].Parts {
+				os.Remove(filepath.Join(s.outputDir, part.Name))
+			}
+			if s.segments[0].Discontinuity {
+				s.discSeq++
+			}
+			s.segments = s.segments[1:]
+		}
+	}
+
+	if err := s.writePlaylistLocked(); err != nil {
+		return err
+	}
+	s.notifyLocked()
+
+	if s.onSegment != nil {
+		s.onSegment(segment)
+	}
+	return nil
+}
+
+func writeParts(b *strings.Builder, parts []Part) {
+	for _, part := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration.Seconds(), part.Name)
+		if part.Independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+func (s *Segmenter) writePlaylistLocked() error {
+	targetDuration := int(math.Ceil(s.segmentDuration.Seconds()))
+	for _, segment := range s.segments {
+		if d := int(math.Ceil(segment.Duration.Seconds())); d > targetDuration {
+			targetDuration = d
+		}
+	}
+
+	lowLatency := s.partDuration > 0
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if lowLatency {
+		b.WriteString("#EXT-X-VERSION:6\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	if lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*s.partDuration.Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", s.partDuration.Seconds())
+	}
+
+	sequence := s.next
+	if s.current != nil {
+		sequence = s.current.Sequence
+	}
+	if len(s.segments) > 0 {
+		sequence = s.segments[0].Sequence
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	if s.discSeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", s.discSeq)
+	}
+
+	for i, segment := range s.segments {
+		if segment.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if lowLatency && i >= len(s.segments)-partSegments {
+			writeParts(&b, segment.Parts)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", segment.Duration.Seconds(), segment.Name)
+	}
+
+	if lowLatency && s.current != nil {
+		if s.current.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		writeParts(&b, s.current.Parts)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", PartName(s.current.Sequence, len(s.current.Parts)))
+	}
+
+	playlistPath := filepath.Join(s.outputDir, "playlist.m3u8")
+	tmpPath := playlistPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	if err := os.Rename(tmpPath, playlistPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+)
+
+// writeMedia writes 25fps video with a keyframe every second plus one audio
+// packet per video frame.
+func writeMedia(t *testing.T, s *Segmenter, from, to time.Duration) {
+	t.Helper()
+
+	frame := 40 * time.Millisecond
+	for ts := from; ts < to; ts += frame {
+		video := av.Packet{Idx: 0, IsKeyFrame: ts%time.Second == 0, Time: ts, Data: []byte{0, 0, 0, 1, 0x65, 0x88}}
+		if err := s.WritePacket(video); err != nil {
+			t.Fatalf("failed to write video packet: %v", err)
+		}
+		audio := av.Packet{Idx: 1, Time: ts, Data: []byte{0x21, 0x10}}
+		if err := s.WritePacket(audio); err != nil {
+			t.Fatalf("failed to write audio packet: %v", err)
+		}
+	}
+}
+
+func TestSegmenter_CutsOnKeyframes(t *testing.T) {
+	outputDir := t.TempDir()
+	segmenter := NewSegmenter(outputDir, 2*time.Second, 3)
+
+	var written []Segment
+	segmenter.SetSegmentCallback(func(segment Segment) {
+		written = append(written, segment)
+	})
+
+	if err := segmenter.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	writeMedia(t, segmenter, 0, 10*time.Second)
+	if err := segmenter.WriteTrailer(); err != nil {
+		t.Fatalf("WriteTrailer failed: %v", err)
+	}
+
+	if len(written) != 5 {
+		t.Fatalf("expected 5 segments, got %d", len(written))
+	}
+	for _, segment := range written[:4] {
+		if segment.Duration != 2*time.Second {
+			t.Errorf("expected %s to last 2s, got %s", segment.Name, segment.Duration)
+		}
+	}
+
+	segments := segmenter.Segments()
+	if len(segments) != 3 || segments[0].Name != "segment_002.ts" {
+		t.Fatalf("expected sliding window of segments 2-4, got %v", segments)
+	}
+
+	for _, name := range []string{"segment_000.ts", "segment_001.ts"} {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "segment_004.ts"))
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	if len(data) == 0 || len(data)%188 != 0 || data[0] != 0x47 {
+		t.Errorf("expected MPEG-TS packets, got %d bytes", len(data))
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	for _, expected := range []string{
+		"#EXT-X-TARGETDURATION:2\n",
+		"#EXT-X-MEDIA-SEQUENCE:2\n",
+		"#EXTINF:2.000,\nsegment_002.ts\n",
+		"segment_004.ts\n",
+	} {
+		if !strings.Contains(string(playlist), expected) {
+			t.Errorf("expected playlist to contain %q, got:\n%s", expected, playlist)
+		}
+	}
+}
+
+func TestSegmenter_ResumeContinuesPlaylist(t *testing.T) {
+	outputDir := t.TempDir()
+
+	first := NewSegmenter(outputDir, 2*time.Second, 3)
+	if err := first.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	writeMedia(t, first, 0, 8*time.Second)
+	if err := first.WriteTrailer(); err != nil {
+		t.Fatalf("WriteTrailer failed: %v", err)
+	}
+
+	// A restarted transcoder starts again from timestamp zero.
+	second := NewSegmenter(outputDir, 2*time.Second, 3)
+	if err := second.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if err := second.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	writeMedia(t, second, 0, 6*time.Second)
+	if err := second.WriteTrailer(); err != nil {
+		t.Fatalf("WriteTrailer failed: %v", err)
+	}
+
+	segments := second.Segments()
+	if len(segments) != 3 || segments[0].Name != "segment_004.ts" || !segments[0].Discontinuity {
+		t.Fatalf("expected the window to start with new segment 4 after a discontinuity, got %v", segments)
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	for _, expected := range []string{
+		"#EXT-X-MEDIA-SEQUENCE:4\n",
+		"#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\nsegment_004.ts\n",
+		"segment_006.ts\n",
+	} {
+		if !strings.Contains(string(playlist), expected) {
+			t.Errorf("expected playlist to contain %q, got:\n%s", expected, playlist)
+		}
+	}
+
+	// Once the discontinuity slides out of the window it is counted instead.
+	third := NewSegmenter(outputDir, 2*time.Second, 3)
+	if err := third.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if err := third.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	writeMedia(t, third, 0, 4*time.Second)
+	third.WriteTrailer()
+
+	playlist, _ = os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	for _, expected := range []string{
+		"#EXT-X-MEDIA-SEQUENCE:6\n",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:1\n",
+		"#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\nsegment_007.ts\n",
+	} {
+		if !strings.Contains(string(playlist), expected) {
+			t.Errorf("expected playlist to contain %q, got:\n%s", expected, playlist)
+		}
+	}
+}
+
+func TestSegmenter_ResumeWithoutPlaylist(t *testing.T) {
+	segmenter := NewSegmenter(t.TempDir(), 2*time.Second, 3)
+	if err := segmenter.Resume(); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if err := segmenter.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	writeMedia(t, segmenter, 0, 2*time.Second)
+	segmenter.WriteTrailer()
+
+	segments := segmenter.Segments()
+	if len(segments) != 1 || segments[0].Name != "segment_000.ts" || segments[0].Discontinuity {
+		t.Errorf("expected a fresh playlist, got %v", segments)
+	}
+}
+
+func TestSegmenter_StartsOnKeyframe(t *testing.T) {
+	segmenter := NewSegmenter(t.TempDir(), time.Second, 0)
+	if err := segmenter.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	writeMedia(t, segmenter, 520*time.Millisecond, 3*time.Second)
+	if err := segmenter.WriteTrailer(); err != nil {
+		t.Fatalf("WriteTrailer failed: %v", err)
+	}
+
+	segments := segmenter.Segments()
+	if len(segments) != 2 {
+		t.Fatalf("expected 2 segments, got %v", segments)
+	}
+	if segments[0].Duration != time.Second {
+		t.Errorf("expected first segment to start at the first keyframe, got %s", segments[0].Duration)
+	}
+}
+
+func TestSegmenter_RejectsUnsupportedCodecs(t *testing.T) {
+	segmenter := NewSegmenter(t.TempDir(), time.Second, 0)
+
+	codecs := testutil.Codecs(t)
+	if err := segmenter.WriteHeader([]av.CodecData{codecs[0], speexCodec{}}); err == nil {
+		t.Error("expected error for codec MPEG-TS cannot carry")
+	}
+}
+
+type speexCodec struct{}
+
+func (speexCodec) Type() av.CodecType {
+	return av.SPEEX
+}
+
+func TestSegmenter_LowLatencyParts(t *testing.T) {
+	outputDir := t.TempDir()
+	segmenter := NewSegmenter(outputDir, 2*time.Second, 0)
+	segmenter.SetPartDuration(500 * time.Millisecond)
+	if err := segmenter.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	writeMedia(t, segmenter, 0, 2600*time.Millisecond)
+
+	playlist, err := os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	for _, expected := range []string{
+		"#EXT-X-VERSION:6\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500\n",
+		"#EXT-X-PART-INF:PART-TARGET=0.500\n",
+		"#EXT-X-PART:DURATION=0.480,URI=\"segment_000.0.ts\",INDEPENDENT=YES\n",
+		"#EXT-X-PART:DURATION=0.080,URI=\"segment_000.4.ts\"\n",
+		"#EXTINF:2.000,\nsegment_000.ts\n",
+		"#EXT-X-PART:DURATION=0.480,URI=\"segment_001.0.ts\",INDEPENDENT=YES\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"segment_001.1.ts\"\n",
+	} {
+		if !strings.Contains(string(playlist), expected) {
+			t.Errorf("expected playlist to contain %q, got:\n%s", expected, playlist)
+		}
+	}
+
+	// LL-HLS requires every part to fit in PART-TARGET.
+	for _, segment := range append(segmenter.Segments(), *segmenter.current) {
+		for _, part := range segment.Parts {
+			if part.Duration > 500*time.Millisecond {
+				t.Errorf("expected %s to last at most 0.5s, got %s", part.Name, part.Duration)
+			}
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "segment_000.1.ts"))
+	if err != nil {
+		t.Fatalf("failed to read part: %v", err)
+	}
+	if len(data) == 0 || len(data)%188 != 0 || data[0] != 0x47 {
+		t.Errorf("expected MPEG-TS packets in part, got %d bytes", len(data))
+	}
+}
+
+func TestSegmenter_WaitForPart(t *testing.T) {
+	segmenter := NewSegmenter(t.TempDir(), 2*time.Second, 0)
+	segmenter.SetPartDuration(500 * time.Millisecond)
+	if err := segmenter.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	writeMedia(t, segmenter, 0, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := segmenter.WaitForPart(ctx, 0, 0); err != nil {
+		t.Fatalf("expected existing part to be available, got %v", err)
+	}
+	if err := segmenter.WaitForPart(ctx, 3, 0); !errors.Is(err, ErrTooFarAhead) {
+		t.Errorf("expected ErrTooFarAhead, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- segmenter.WaitForPart(ctx, 1, 0)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected wait to block, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writeMedia(t, segmenter, time.Second, 2600*time.Millisecond)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected wait to succeed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return after the part was written")
+	}
+
+	if err := segmenter.WriteTrailer(); err != nil {
+		t.Fatalf("WriteTrailer failed: %v", err)
+	}
+	if err := segmenter.WaitForPart(ctx, 5, -1); !errors.Is(err, ErrTooFarAhead) {
+		t.Errorf("expected ErrTooFarAhead after close, got %v", err)
+	}
+	if err := segmenter.WaitForPart(ctx, 2, -1); !errors.Is(err, ErrSegmenterClosed) {
+		t.Errorf("expected ErrSegmenterClosed, got %v", err)
+	}
+}
+
+func TestParsePartName(t *testing.T) {
+	sequence, part, ok := ParsePartName(PartName(12, 3))
+	if !ok || sequence != 12 || part != 3 {
+		t.Errorf("expected 12/3, got %d/%d (%v)", sequence, part, ok)
+	}
+
+	for _, name := range []string{"segment_012.ts", "segment_a.1.ts", "playlist.m3u8", "segment_1.2.3.ts"} {
+		if _, _, ok := ParsePartName(name); ok {
+			t.Errorf("expected %q not to be a part name", name)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Event string
+
+const (
+	EventPublish     Event = "on_publish"
+	EventPublishDone Event = "on_publish_done"
+	EventPlay        Event = "on_play"
+	EventPlayDone    Event = "on_play_done"
+)
+
+const (
+	defaultTimeout    = 5 * time.Second
+	defaultRetryDelay = 500 * time.Millisecond
+)
+
+var ErrRejected = errors.New("rejected by webhook")
+
+type Payload struct {
+	Event    Event             `json:"event"`
+	App      string            `json:"app"`
+	Stream   string            `json:"stream"`
+	ClientIP string            `json:"client_ip"`
+	Args     map[string]string `json:"args"`
+}
+
+type Result struct {
+	Stream string
+}
+
+type Client struct {
+	urls       map[Event]string
+	httpClient *http.Client
+	retries    int
+	retryDelay time.Duration
+	logger     *logrus.Logger
+}
+
+func NewClient(urls map[Event]string, timeout time.Duration, retries int, logger *logrus.Logger) *Client {
+	configured := make(map[Event]string, len(urls))
+	for event, hookURL := range urls {
+		if hookURL != "" {
+			configured[event] = hookURL
+		}
+	}
+
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	if retries < 0 {
+		retries = 0
+	}
+
+	return &Client{
+		urls: configured,
+		httpClient: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		retries:    retries,
+		retryDelay: defaultRetryDelay,
+		logger:     logger,
+	}
+}
+
+func (c *Client) Enabled(event Event) bool {
+	_, ok := c.urls[event]
+	return ok
+}
+
+func (c *Client) Call(ctx context.Context, payload Payload) (*Result, error) {
+	hookURL, ok := c.urls[payload.Event]
+	if !ok {
+		return &Result{}, nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", payload.Event, err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(c.retryDelay * time.Duration(attempt)):
+			}
+		}
+
+		result, retry, err := c.post(ctx, hookURL, body)
+		if err == nil {
+			return result, nil
+		}
+
+		lastErr = err
+		if !retry {
+			break
+		}
+
+		c.logger.Warnf("Webhook %s for %s/%s failed (attempt %d/%d): %v",
+			payload.Event, payload.App, payload.Stream, attempt+1, c.retries+1, err)
+	}
+
+	return nil, lastErr
+}
+
+// Notify calls a webhook whose answer does not matter, such as
+// on_publish_done, in the background, so a slow webhook does not hold up the
+// caller's teardown. Failures are logged.
+func (c *Client) Notify(payload Payload) {
+	if !c.Enabled(payload.Event) {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.callTimeout())
+		defer cancel()
+
+		if _, err := c.Call(ctx, payload); err != nil {
+			c.logger.Warnf("Webhook %s for %s/%s failed: %v", payload.Event, payload.App, payload.Stream, err)
+		}
+	}()
+}
+
+// callTimeout bounds a call with all its attempts.
+func (c *Client) callTimeout() time.Duration {
+	timeout := time.Duration(c.retries+1) * c.httpClient.Timeout
+	for attempt := 1; attempt <= c.retries; attempt++ {
+		timeout += c.retryDelay * time.Duration(attempt)
+	}
+	return timeout
+}
+
+func (c *Client) post(ctx context.Context, hookURL string, body []byte) (*Result, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return &Result{}, false, nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		name := redirectName(resp.Header.Get("Location"))
+		if name == "" {
+			return nil, false, fmt.Errorf("%w: redirect without a stream name", ErrRejected)
+		}
+		return &Result{Stream: name}, false, nil
+	case resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("%w: status %d", ErrRejected, resp.StatusCode)
+	default:
+		return nil, false, fmt.Errorf("%w: status %d", ErrRejected, resp.StatusCode)
+	}
+}
+
+func redirectName(location string) string {
+	location = strings.TrimSpace(location)
+	if location == "" {
+		return ""
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		name = u.Opaque
+	}
+	if strings.Contains(name, "/") {
+		name = path.Base(name)
+	}
+	return name
+}
+
+func ArgsFromQuery(query url.Values) map[string]string {
+	args := make(map[string]string, len(query))
+	for key, values := range query {
+		if len(values) > 0 {
+			args[key] = values[0]
+		}
+	}
+	return args
+}
@@ -0,0 +1,210 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestClient(event Event, url string, timeout time.Duration, retries int) *Client {
+	client := NewClient(map[Event]string{event: url}, timeout, retries, logrus.New())
+	client.retryDelay = time.Millisecond
+	return client
+}
+
+func TestClient_CallSendsPayload(t *testing.T) {
+	var received Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON content type, got %s", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := newTestClient(EventPublish, server.URL, time.Second, 0)
+	result, err := client.Call(context.Background(), Payload{
+		Event:    EventPublish,
+		App:      "live",
+		Stream:   "mystream",
+		ClientIP: "10.0.0.1",
+		Args:     map[string]string{"token": "abc"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if result.Stream != "" {
+		t.Errorf("expected no rename, got %s", result.Stream)
+	}
+
+	if received.Event != EventPublish || received.App != "live" || received.Stream != "mystream" {
+		t.Errorf("unexpected payload: %+v", received)
+	}
+
+	if received.ClientIP != "10.0.0.1" || received.Args["token"] != "abc" {
+		t.Errorf("unexpected payload: %+v", received)
+	}
+}
+
+func TestClient_CallRejectsOnClientError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := newTestClient(EventPlay, server.URL, time.Second, 3)
+	_, err := client.Call(context.Background(), Payload{Event: EventPlay})
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected a single attempt for a 4xx response, got %d", calls)
+	}
+}
+
+func TestClient_CallRenamesOnRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		expected string
+	}{
+		{name: "plain name", location: "newname", expected: "newname"},
+		{name: "absolute path", location: "/live/newname", expected: "newname"},
+		{name: "rtmp url", location: "rtmp://example.com/live/newname", expected: "newname"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Location", tt.location)
+				w.WriteHeader(http.StatusFound)
+			}))
+			defer server.Close()
+
+			client := newTestClient(EventPublish, server.URL, time.Second, 0)
+			result, err := client.Call(context.Background(), Payload{Event: EventPublish})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Stream != tt.expected {
+				t.Errorf("expected rename to %s, got %s", tt.expected, result.Stream)
+			}
+		})
+	}
+}
+
+func TestClient_CallRetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := newTestClient(EventPublishDone, server.URL, time.Second, 2)
+	if _, err := client.Call(context.Background(), Payload{Event: EventPublishDone}); err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestClient_CallTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := newTestClient(EventPlay, server.URL, 50*time.Millisecond, 1)
+	start := time.Now()
+	if _, err := client.Call(context.Background(), Payload{Event: EventPlay}); err == nil {
+		t.Fatal("expected timeout error")
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected call to give up quickly, took %v", elapsed)
+	}
+}
+
+func TestClient_CallWithoutURL(t *testing.T) {
+	client := NewClient(map[Event]string{EventPublish: ""}, time.Second, 0, logrus.New())
+
+	if client.Enabled(EventPublish) {
+		t.Error("expected hook without URL to be disabled")
+	}
+
+	result, err := client.Call(context.Background(), Payload{Event: EventPublish})
+	if err != nil || result == nil || result.Stream != "" {
+		t.Errorf("expected no-op result, got %+v, %v", result, err)
+	}
+}
+
+func TestClient_NotifyDoesNotWait(t *testing.T) {
+	received := make(chan Payload, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload Payload
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := newTestClient(EventPublishDone, server.URL, time.Second, 0)
+
+	notified := make(chan struct{})
+	go func() {
+		client.Notify(Payload{Event: EventPublishDone, App: "live", Stream: "test"})
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("expected Notify not to wait for the webhook")
+	}
+
+	select {
+	case payload := <-received:
+		if payload.Event != EventPublishDone || payload.Stream != "test" {
+			t.Errorf("unexpected payload: %+v", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the webhook to be called")
+	}
+}
+
+func TestClient_CallTimeoutCoversRetries(t *testing.T) {
+	client := newTestClient(EventPublishDone, "http://127.0.0.1:1", time.Second, 2)
+	if got := client.callTimeout(); got != 3*time.Second+3*time.Millisecond {
+		t.Errorf("expected 3.003s for three attempts, got %s", got)
+	}
+}
@@ -0,0 +1,93 @@
+package http
+
+import (
+	"golang-rtmp/internal/stream"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type streamCollector struct {
+	streamManager *stream.StreamManager
+	restarts      *prometheus.Desc
+	frames        *prometheus.Desc
+	fps           *prometheus.Desc
+	bitrate       *prometheus.Desc
+	speed         *prometheus.Desc
+	outTime       *prometheus.Desc
+	dropFrames    *prometheus.Desc
+	dupFrames     *prometheus.Desc
+}
+
+func newStreamCollector(streamManager *stream.StreamManager) *streamCollector {
+	labels := []string{"stream"}
+
+	return &streamCollector{
+		streamManager: streamManager,
+		restarts: prometheus.NewDesc(
+			"rtmp_stream_transcoder_restarts_total",
+			"Number of times the transcoder was restarted for a stream",
+			labels, nil,
+		),
+		frames: prometheus.NewDesc(
+			"rtmp_stream_transcode_frames",
+			"Number of frames encoded by the current transcoder",
+			labels, nil,
+		),
+		fps: prometheus.NewDesc(
+			"rtmp_stream_transcode_fps",
+			"Frames per second reported by the transcoder",
+			labels, nil,
+		),
+		bitrate: prometheus.NewDesc(
+			"rtmp_stream_transcode_bitrate_kbps",
+			"Output bitrate reported by the transcoder in kbit/s",
+			labels, nil,
+		),
+		speed: prometheus.NewDesc(
+			"rtmp_stream_transcode_speed",
+			"Transcoding speed relative to real time",
+			labels, nil,
+		),
+		outTime: prometheus.NewDesc(
+			"rtmp_stream_transcode_out_time_seconds",
+			"Media time produced by the current transcoder",
+			labels, nil,
+		),
+		dropFrames: prometheus.NewDesc(
+			"rtmp_stream_transcode_dropped_frames",
+			"Number of frames dropped by the transcoder",
+			labels, nil,
+		),
+		dupFrames: prometheus.NewDesc(
+			"rtmp_stream_transcode_duplicated_frames",
+			"Number of frames duplicated by the transcoder",
+			labels, nil,
+		),
+	}
+}
+
+func (c *streamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.restarts
+	ch <- c.frames
+	ch <- c.fps
+	ch <- c.bitrate
+	ch <- c.speed
+	ch <- c.outTime
+	ch <- c.dropFrames
+	ch <- c.dupFrames
+}
+
+func (c *streamCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range c.streamManager.ListStreams() {
+		ch <- prometheus.MustNewConstMetric(c.restarts, prometheus.CounterValue, float64(st.Restarts()), st.ID)
+
+		stats := st.Stats()
+		ch <- prometheus.MustNewConstMetric(c.frames, prometheus.GaugeValue, float64(stats.Frame), st.ID)
+		ch <- prometheus.MustNewConstMetric(c.fps, prometheus.GaugeValue, stats.FPS, st.ID)
+		ch <- prometheus.MustNewConstMetric(c.bitrate, prometheus.GaugeValue, stats.BitrateKbps, st.ID)
+		ch <- prometheus.MustNewConstMetric(c.speed, prometheus.GaugeValue, stats.Speed, st.ID)
+		ch <- prometheus.MustNewConstMetric(c.outTime, prometheus.GaugeValue, stats.OutTime, st.ID)
+		ch <- prometheus.MustNewConstMetric(c.dropFrames, prometheus.GaugeValue, float64(stats.DropFrames), st.ID)
+		ch <- prometheus.MustNewConstMetric(c.dupFrames, prometheus.GaugeValue, float64(stats.DupFrames), st.ID)
+	}
+}
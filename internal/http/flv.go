@@ -0,0 +1,334 @@
+package http
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang-rtmp/internal/hooks"
+	"golang-rtmp/internal/rtmp"
+	"golang-rtmp/internal/stream"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+)
+
+const (
+	protocolHTTPFLV = "http-flv"
+	protocolWSFLV   = "ws-flv"
+
+	defaultViewerQueueSize = 256
+
+	// A viewer whose connection accepts nothing for this long is dropped even
+	// if its queue has not overflowed yet.
+	flvWriteTimeout = 10 * time.Second
+)
+
+// SetViewerQueueSize sets how many packets an HTTP viewer may fall behind the
+// publisher before it is disconnected.
+func (s *Server) SetViewerQueueSize(size int) {
+	s.viewerQueueSize = size
+}
+
+// serveFLV streams a live stream as chunked HTTP-FLV for players like flv.js.
+func (s *Server) serveFLV(c *gin.Context) {
+	viewer, ok := s.startFLVViewer(c, protocolHTTPFLV)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "video/x-flv")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Status(http.StatusOK)
+
+	writer := newHTTPFLVWriter(c.Writer)
+	defer writer.controller.SetWriteDeadline(time.Time{})
+
+	s.endFLVViewer(viewer, s.playFLV(viewer, writer))
+}
+
+// playRequest identifies a viewer to the on_play and on_play_done hooks.
+type playRequest struct {
+	clientIP string
+	app      string
+	name     string
+	args     map[string]string
+}
+
+// flvViewer is one HTTP-FLV or WebSocket-FLV player of a live stream.
+type flvViewer struct {
+	*playRequest
+	protocol string
+	stream   *stream.Stream
+	sub      *stream.Subscriber
+	codecs   []av.CodecData
+}
+
+// startFLVViewer authorizes a viewer through the on_play hook like RTMP
+// players, subscribes it to the stream and waits for the stream's codecs. It
+// returns false if a response was already sent; otherwise the viewer must be
+// ended with endFLVViewer.
+func (s *Server) startFLVViewer(c *gin.Context, protocol string) (*flvViewer, bool) {
+	name, ok := strings.CutSuffix(c.Param("stream"), ".flv")
+	if !ok || name == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return nil, false
+	}
+
+	req, ok := s.authorizePlay(c, protocol, c.Param("app"), name)
+	if !ok {
+		return nil, false
+	}
+	viewer := &flvViewer{playRequest: req, protocol: protocol}
+
+	liveStream, exists := s.streamManager.GetStream(viewer.app + "/" + viewer.name)
+	if !exists {
+		s.notifyPlayDone(viewer.playRequest)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return nil, false
+	}
+	viewer.stream = liveStream
+
+	queueSize := s.viewerQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultViewerQueueSize
+	}
+	viewer.sub = liveStream.Subscribe(protocol+"-"+c.Request.RemoteAddr, queueSize)
+	// Kicking the viewer ends its subscription, which ends the response.
+	viewer.sub.SetViewer(protocol, c.Request.RemoteAddr, nil)
+
+	// Viewers that go away while the stream is idle are noticed here rather
+	// than on the next write.
+	sub := viewer.sub
+	go func() {
+		select {
+		case <-c.Request.Context().Done():
+			sub.Close()
+		case <-sub.Done():
+		}
+	}()
+
+	codecs, err := sub.Streams()
+	if err != nil {
+		sub.Close()
+		s.notifyPlayDone(viewer.playRequest)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream ended"})
+		return nil, false
+	}
+	for _, codec := range codecs {
+		if !flvSupportsCodec(codec.Type()) {
+			sub.Close()
+			s.notifyPlayDone(viewer.playRequest)
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Stream codec " + codec.Type().String() + " cannot be carried in FLV"})
+			return nil, false
+		}
+	}
+	viewer.codecs = codecs
+
+	s.metrics.viewers.WithLabelValues(protocol).Inc()
+	s.metrics.viewerConnections.WithLabelValues(protocol).Inc()
+	s.logger.Infof("%s viewer %s connected to stream %s", protocol, sub.ID, liveStream.ID)
+	return viewer, true
+}
+
+func (s *Server) endFLVViewer(viewer *flvViewer, err error) {
+	viewer.sub.Close()
+	s.metrics.viewers.WithLabelValues(viewer.protocol).Dec()
+
+	if err != nil && err != io.EOF {
+		s.logger.Warnf("Disconnecting %s viewer %s of stream %s: %v", viewer.protocol, viewer.sub.ID, viewer.stream.ID, err)
+	} else {
+		s.logger.Infof("%s viewer %s of stream %s disconnected", viewer.protocol, viewer.sub.ID, viewer.stream.ID)
+	}
+
+	s.notifyPlayDone(viewer.playRequest)
+}
+
+// authorizePlay runs the on_play hook for a viewer, which may redirect it to
+// another stream of the app. It returns false if a response was already sent.
+func (s *Server) authorizePlay(c *gin.Context, protocol, app, name string) (*playRequest, bool) {
+	if rtmp.ValidateName(app) != nil || rtmp.ValidateName(name) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stream path"})
+		return nil, false
+	}
+
+	// Bans and webhooks go by the socket address, as X-Forwarded-For is
+	// chosen by the client.
+	req := &playRequest{
+		clientIP: remoteIP(c.Request.RemoteAddr),
+		app:      app,
+		name:     name,
+		args:     hooks.ArgsFromQuery(c.Request.URL.Query()),
+	}
+
+	if s.bans != nil {
+		if err := s.bans.CheckAddr(req.clientIP); err != nil {
+			s.logger.Warnf("Rejected %s play of stream %s/%s from %s: %v", protocol, app, name, req.clientIP, err)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Playback rejected"})
+			return nil, false
+		}
+	}
+
+	redirect, err := s.callPlayHook(c.Request.Context(), req)
+	if err != nil {
+		s.logger.Warnf("Rejected %s play of stream %s/%s by on_play hook: %v", protocol, app, name, err)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Playback rejected"})
+		return nil, false
+	}
+	if redirect != "" {
+		if err := rtmp.ValidateName(redirect); err != nil {
+			s.logger.Warnf("Rejected %s play of stream %s/%s: invalid stream name from webhook: %v", protocol, app, name, err)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Playback rejected"})
+			return nil, false
+		}
+		req.name = redirect
+	}
+	return req, true
+}
+
+// remoteIP returns the IP of a host:port remote address.
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// callPlayHook calls the on_play webhook for a viewer and returns the stream
+// name the webhook redirected it to, if any. ctx is the viewer's request, so
+// a viewer that goes away does not wait out the webhook.
+func (s *Server) callPlayHook(ctx context.Context, req *playRequest) (string, error) {
+	if s.hooks == nil || !s.hooks.Enabled(hooks.EventPlay) {
+		return "", nil
+	}
+
+	result, err := s.hooks.Call(ctx, req.payload(hooks.EventPlay))
+	if err != nil {
+		return "", err
+	}
+	return result.Stream, nil
+}
+
+// notifyPlayDone calls the on_play_done webhook for a viewer in the
+// background.
+func (s *Server) notifyPlayDone(req *playRequest) {
+	if s.hooks != nil {
+		s.hooks.Notify(req.payload(hooks.EventPlayDone))
+	}
+}
+
+func (req *playRequest) payload(event hooks.Event) hooks.Payload {
+	return hooks.Payload{
+		Event:    event,
+		App:      req.app,
+		Stream:   req.name,
+		ClientIP: req.clientIP,
+		Args:     req.args,
+	}
+}
+
+// flvWriter sends FLV to one viewer. Writes may be buffered until Flush.
+type flvWriter interface {
+	WriteHeader(codecs []av.CodecData) error
+	WritePacket(pkt av.Packet) error
+	Flush() error
+}
+
+// playFLV writes the stream's codec headers and then its packets, starting
+// at the first video keyframe so players can decode from the first frame.
+func (s *Server) playFLV(viewer *flvViewer, w flvWriter) error {
+	videoIdx := -1
+	for i, codec := range viewer.codecs {
+		if codec.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+
+	if err := w.WriteHeader(viewer.codecs); err != nil {
+		return err
+	}
+
+	started := videoIdx < 0
+	for {
+		pkt, err := viewer.sub.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				w.Flush()
+			}
+			return err
+		}
+
+		if !started {
+			if int(pkt.Idx) != videoIdx || !pkt.IsKeyFrame {
+				continue
+			}
+			started = true
+		}
+
+		if err := w.WritePacket(pkt); err != nil {
+			return err
+		}
+		// Flush whenever the viewer has caught up with the publisher to keep
+		// latency low.
+		if viewer.sub.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+
+		viewer.stream.UpdateLastActivity()
+	}
+}
+
+// httpFLVWriter writes FLV to a chunked HTTP response.
+type httpFLVWriter struct {
+	muxer      *flv.Muxer
+	controller *http.ResponseController
+}
+
+func newHTTPFLVWriter(w http.ResponseWriter) *httpFLVWriter {
+	return &httpFLVWriter{
+		muxer:      flv.NewMuxer(w),
+		controller: http.NewResponseController(w),
+	}
+}
+
+func (w *httpFLVWriter) WriteHeader(codecs []av.CodecData) error {
+	w.setDeadline()
+	return w.muxer.WriteHeader(codecs)
+}
+
+func (w *httpFLVWriter) WritePacket(pkt av.Packet) error {
+	w.setDeadline()
+	return w.muxer.WritePacket(pkt)
+}
+
+func (w *httpFLVWriter) Flush() error {
+	w.setDeadline()
+	if err := w.muxer.WriteTrailer(); err != nil {
+		return err
+	}
+	return w.controller.Flush()
+}
+
+// setDeadline is a no-op for response writers without deadline support,
+// such as test recorders.
+func (w *httpFLVWriter) setDeadline() {
+	w.controller.SetWriteDeadline(time.Now().Add(flvWriteTimeout))
+}
+
+func flvSupportsCodec(codecType av.CodecType) bool {
+	for _, supported := range flv.CodecTypes {
+		if codecType == supported {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+)
+
+func waitForSubscribers(t *testing.T, st *stream.Stream, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for st.SubscriberCount() != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d subscribers of stream %s, got %d", count, st.ID, st.SubscriberCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_ServesHTTPFLV(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	httpServer := httptest.NewServer(server.Router())
+	defer httpServer.Close()
+
+	if resp, err := http.Get(httpServer.URL + "/live/live/missing.flv"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing stream, got %v %v", resp, err)
+	}
+
+	st := sm.CreateStream("live", "flv", filepath.Join(outputDir, "live", "flv"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(httpServer.URL + "/live/live/flv.flv")
+		responses <- result{resp, err}
+	}()
+	waitForSubscribers(t, st, 1)
+
+	// Packets before the first keyframe cannot be decoded and are skipped.
+	st.WritePacket(av.Packet{Idx: 1, Data: []byte{0x21, 0x10}})
+	st.WritePacket(av.Packet{Idx: 0, Data: []byte{0, 0, 0, 1, 0x41}})
+	st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: time.Second, Data: []byte{0, 0, 0, 1, 0x65}})
+	st.WritePacket(av.Packet{Idx: 1, Time: time.Second, Data: []byte{0x21, 0x10}})
+
+	res := <-responses
+	if res.err != nil {
+		t.Fatalf("GET failed: %v", res.err)
+	}
+	defer res.resp.Body.Close()
+	if res.resp.StatusCode != http.StatusOK || res.resp.Header.Get("Content-Type") != "video/x-flv" {
+		t.Fatalf("expected FLV response, got %d %q", res.resp.StatusCode, res.resp.Header.Get("Content-Type"))
+	}
+
+	demuxer := flv.NewDemuxer(res.resp.Body)
+	codecs, err := demuxer.Streams()
+	if err != nil || len(codecs) != 2 || codecs[0].Type() != av.H264 || codecs[1].Type() != av.AAC {
+		t.Fatalf("expected H264 and AAC codec headers, got %v %v", codecs, err)
+	}
+	pkt, err := demuxer.ReadPacket()
+	if err != nil || pkt.Idx != 0 || !pkt.IsKeyFrame || pkt.Time != time.Second {
+		t.Fatalf("expected the stream to start at the keyframe, got %+v %v", pkt, err)
+	}
+	if pkt, err := demuxer.ReadPacket(); err != nil || pkt.Idx != 1 {
+		t.Fatalf("expected audio after the keyframe, got %+v %v", pkt, err)
+	}
+
+	st.WriteTrailer()
+	if _, err := demuxer.ReadPacket(); err == nil {
+		t.Error("expected the response to end with the stream")
+	}
+	waitForSubscribers(t, st, 0)
+
+	rec := doRequest(server.Router(), http.MethodGet, "/metrics")
+	for _, metric := range []string{
+		`http_live_viewers{protocol="http-flv"} 0`,
+		`http_live_viewer_connections_total{protocol="http-flv"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), metric) {
+			t.Errorf("expected metric %s, got:\n%s", metric, rec.Body.String())
+		}
+	}
+}
+
+// stalledWriter is a response whose client stops reading after the first
+// write.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	stalled chan struct{}
+	resume  chan struct{}
+}
+
+func (w *stalledWriter) Write(data []byte) (int, error) {
+	select {
+	case w.stalled <- struct{}{}:
+		<-w.resume
+	default:
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestServer_DisconnectsSlowFLVViewer(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	server.SetViewerQueueSize(2)
+	router := server.Router()
+
+	st := sm.CreateStream("live", "slow", filepath.Join(outputDir, "live", "slow"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	w := &stalledWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		stalled:          make(chan struct{}),
+		resume:           make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/live/live/slow.flv", nil))
+		close(done)
+	}()
+	waitForSubscribers(t, st, 1)
+
+	st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{0, 0, 0, 1, 0x65}})
+	<-w.stalled
+
+	for i := 0; i < 3; i++ {
+		st.WritePacket(av.Packet{Idx: 0, Time: time.Duration(i+1) * 40 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x41}})
+	}
+	if count := st.SubscriberCount(); count != 0 {
+		t.Fatalf("expected the slow viewer to be dropped, got %d subscribers", count)
+	}
+
+	close(w.resume)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the slow viewer's response to end")
+	}
+}
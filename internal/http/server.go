@@ -1,6 +1,10 @@
 package http
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -8,30 +12,61 @@ import (
 	"strings"
 	"time"
 
+	"golang-rtmp/internal/dash"
+	"golang-rtmp/internal/hls"
+	"golang-rtmp/internal/hooks"
+	"golang-rtmp/internal/pull"
+	"golang-rtmp/internal/record"
+	"golang-rtmp/internal/relay"
+	"golang-rtmp/internal/rtmp"
 	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/whip"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
+const defaultLogTail = 100
+
+// Modes of POST /api/v1/streams/:streamID/stop.
+const (
+	stopModePause = "pause"
+	stopModeKick  = "kick"
+)
+
 type Server struct {
 	addr          string
 	streamManager *stream.StreamManager
 	logger        *logrus.Logger
 	hlsOutputDir  string
+	recordings    *record.Manager
+	relay         *relay.Manager
+	pulls         *pull.Manager
+	rtmpServer    *rtmp.Server
+	bans          *rtmp.BanList
+	hooks         *hooks.Client
+	webrtc        *whip.Manager
 	metrics       *Metrics
+
+	viewerQueueSize int
 }
 
 type Metrics struct {
+	registry      *prometheus.Registry
 	activeStreams prometheus.Gauge
 	httpRequests  prometheus.Counter
 	httpDuration  prometheus.Histogram
+
+	viewers           *prometheus.GaugeVec
+	viewerConnections *prometheus.CounterVec
 }
 
 func NewMetrics() *Metrics {
 	return &Metrics{
+		registry: prometheus.NewRegistry(),
 		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "rtmp_active_streams",
 			Help: "Number of active RTMP streams",
@@ -45,18 +80,31 @@ func NewMetrics() *Metrics {
 			Help:    "HTTP request duration in seconds",
 			Buckets: prometheus.DefBuckets,
 		}),
+		viewers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_live_viewers",
+			Help: "Number of viewers currently playing a live stream over HTTP or WebRTC",
+		}, []string{"protocol"}),
+		viewerConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_live_viewer_connections_total",
+			Help: "Total number of viewers that started playing a live stream over HTTP or WebRTC",
+		}, []string{"protocol"}),
 	}
 }
 
 func (m *Metrics) Register() {
-	prometheus.MustRegister(m.activeStreams)
-	prometheus.MustRegister(m.httpRequests)
-	prometheus.MustRegister(m.httpDuration)
+	m.registry.MustRegister(collectors.NewGoCollector())
+	m.registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m.registry.MustRegister(m.activeStreams)
+	m.registry.MustRegister(m.httpRequests)
+	m.registry.MustRegister(m.httpDuration)
+	m.registry.MustRegister(m.viewers)
+	m.registry.MustRegister(m.viewerConnections)
 }
 
 func NewServer(addr string, streamManager *stream.StreamManager, logger *logrus.Logger, hlsOutputDir string) *Server {
 	metrics := NewMetrics()
 	metrics.Register()
+	metrics.registry.MustRegister(newStreamCollector(streamManager))
 
 	return &Server{
 		addr:          addr,
@@ -67,35 +115,110 @@ func NewServer(addr string, streamManager *stream.StreamManager, logger *logrus.
 	}
 }
 
+func (s *Server) SetRecordings(manager *record.Manager) {
+	s.recordings = manager
+}
+
+func (s *Server) SetRelay(manager *relay.Manager) {
+	s.relay = manager
+}
+
+func (s *Server) SetPulls(manager *pull.Manager) {
+	s.pulls = manager
+}
+
+// SetRTMP sets the server whose publishers the stop and kick endpoints
+// disconnect.
+func (s *Server) SetRTMP(server *rtmp.Server) {
+	s.rtmpServer = server
+}
+
+// SetBans sets the ban list managed by the bans API, which also refuses
+// banned HTTP-FLV, WebSocket-FLV and WebRTC clients.
+func (s *Server) SetBans(bans *rtmp.BanList) {
+	s.bans = bans
+}
+
+// SetHooks sets the webhooks that authorize HTTP-FLV and WebSocket-FLV
+// viewers, the same on_play and on_play_done hooks RTMP players go through.
+func (s *Server) SetHooks(client *hooks.Client) {
+	s.hooks = client
+}
+
 func (s *Server) Start() error {
 	gin.SetMode(gin.ReleaseMode)
+	router := s.Router()
+
+	s.logger.Infof("HTTP server started on %s", s.addr)
+	return router.Run(s.addr)
+}
+
+func (s *Server) Router() *gin.Engine {
 	router := gin.New()
+	// Gin trusts X-Forwarded-For from any client by default, which would let
+	// clients choose the IP that is logged for them.
+	if err := router.SetTrustedProxies(nil); err != nil {
+		s.logger.Errorf("Failed to disable trusted proxies: %v", err)
+	}
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
 	s.setupRoutes(router)
 
-	s.logger.Infof("HTTP server started on %s", s.addr)
-	return router.Run(s.addr)
+	return router
 }
 
 func (s *Server) setupRoutes(router *gin.Engine) {
 	router.Use(s.middleware())
 
+	// Stream and pull IDs are "app/stream", so they span two path segments.
+	// Clients may also send them escaped as "app%2Fstream".
 	api := router.Group("/api/v1")
 	{
 		api.GET("/streams", s.listStreams)
-		api.GET("/streams/:streamID", s.getStream)
-		api.POST("/streams/:streamID/start", s.startStream)
-		api.POST("/streams/:streamID/stop", s.stopStream)
-		api.DELETE("/streams/:streamID", s.deleteStream)
+		api.GET("/streams/:app/:stream", s.getStream)
+		api.GET("/streams/:app/:stream/logs", s.getStreamLogs)
+		api.POST("/streams/:app/:stream/start", s.startStream)
+		api.POST("/streams/:app/:stream/stop", s.stopStream)
+		api.DELETE("/streams/:app/:stream", s.deleteStream)
+		api.POST("/streams/:app/:stream/kick", s.kickStream)
+		api.GET("/streams/:app/:stream/viewers", s.listViewers)
+		api.POST("/streams/:app/:stream/viewers/:viewerID/kick", s.kickViewer)
+		api.GET("/streams/:app/:stream/pushes", s.listPushes)
+		api.POST("/streams/:app/:stream/pushes", s.addPush)
+		api.DELETE("/streams/:app/:stream/pushes/:pushID", s.removePush)
+		api.GET("/recordings", s.listRecordings)
+		api.GET("/pulls", s.listPulls)
+		api.POST("/pulls", s.createPull)
+		api.DELETE("/pulls/:app/:stream", s.deletePull)
+		api.GET("/bans", s.listBans)
+		api.POST("/bans", s.createBan)
+		api.DELETE("/bans/:type/:value", s.deleteBan)
 	}
 
-	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})))
 
 	router.GET("/hls/:app/:stream/playlist.m3u8", s.servePlaylist)
+	router.GET("/hls/:app/:stream/master.m3u8", s.serveMasterPlaylist)
 	router.GET("/hls/:app/:stream/:segment", s.serveSegment)
 
+	router.GET("/dash/:app/:stream/manifest.mpd", s.serveDASHManifest)
+	router.GET("/dash/:app/:stream/:segment", s.serveSegment)
+
+	router.GET("/recordings/*path", s.serveRecording)
+
+	router.GET("/live/:app/:stream", s.serveFLV)
+	router.GET("/ws/:app/:stream", s.serveWSFLV)
+
+	router.POST("/whip/:app/:stream", s.whipPublish)
+	router.DELETE("/whip/:app/:stream/:sessionID", s.deleteWebRTCSession)
+	router.OPTIONS("/whip/:app/:stream", s.webrtcPreflight)
+	router.OPTIONS("/whip/:app/:stream/:sessionID", s.webrtcPreflight)
+	router.POST("/whep/:app/:stream", s.whepPlay)
+	router.DELETE("/whep/:app/:stream/:sessionID", s.deleteWebRTCSession)
+	router.OPTIONS("/whep/:app/:stream", s.webrtcPreflight)
+	router.OPTIONS("/whep/:app/:stream/:sessionID", s.webrtcPreflight)
+
 	router.GET("/stream.m3u8", s.serveDirectPlaylist)
 	router.GET("/segment_:segment", s.serveDirectSegment)
 
@@ -115,6 +238,12 @@ func (s *Server) middleware() gin.HandlerFunc {
 	}
 }
 
+// streamIDParam returns the ID of the stream or pull named by the :app and
+// :stream parameters.
+func streamIDParam(c *gin.Context) string {
+	return c.Param("app") + "/" + c.Param("stream")
+}
+
 func (s *Server) listStreams(c *gin.Context) {
 	streams := s.streamManager.ListStreams()
 
@@ -132,7 +261,7 @@ func (s *Server) listStreams(c *gin.Context) {
 }
 
 func (s *Server) getStream(c *gin.Context) {
-	streamID := c.Param("streamID")
+	streamID := streamIDParam(c)
 
 	stream, exists := s.streamManager.GetStream(streamID)
 	if !exists {
@@ -140,11 +269,16 @@ func (s *Server) getStream(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, stream.GetStatus())
+	status := stream.GetStatus()
+	if s.relay != nil {
+		status["pushes"] = s.relay.List(stream.ID)
+	}
+
+	c.JSON(http.StatusOK, status)
 }
 
-func (s *Server) startStream(c *gin.Context) {
-	streamID := c.Param("streamID")
+func (s *Server) getStreamLogs(c *gin.Context) {
+	streamID := streamIDParam(c)
 
 	stream, exists := s.streamManager.GetStream(streamID)
 	if !exists {
@@ -152,76 +286,608 @@ func (s *Server) startStream(c *gin.Context) {
 		return
 	}
 
-	if stream.IsActive {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Stream is already active"})
+	tail := defaultLogTail
+	if value := c.Query("tail"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tail parameter"})
+			return
+		}
+		tail = n
+	}
+
+	follow := false
+	if value := c.Query("follow"); value != "" {
+		var err error
+		if follow, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid follow parameter"})
+			return
+		}
+	}
+
+	if !follow {
+		c.JSON(http.StatusOK, gin.H{"stream_id": stream.ID, "lines": stream.Logs(tail)})
+		return
+	}
+
+	lines, cancel := stream.FollowLogs()
+	defer cancel()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	for _, line := range stream.Logs(tail) {
+		c.SSEvent("log", line)
+	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			c.SSEvent("log", line)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// startStream restarts transcoding of a live stream with its current
+// profile, or starts a configured pull.
+func (s *Server) startStream(c *gin.Context) {
+	streamID := streamIDParam(c)
+
+	// Configured pulls have no stream until they are started.
+	if s.pulls != nil {
+		if _, exists := s.pulls.Get(streamID); exists {
+			if _, live := s.streamManager.GetStream(streamID); !live {
+				s.startPull(c, streamID)
+				return
+			}
+		}
+	}
+
+	liveStream, exists := s.streamManager.GetStream(streamID)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	err := liveStream.RestartTranscoder()
+	switch {
+	case err == nil:
+	case errors.Is(err, stream.ErrStreamActive):
+		c.JSON(http.StatusConflict, gin.H{"error": "Stream is already active"})
+		return
+	case errors.Is(err, stream.ErrStreamEnded), errors.Is(err, stream.ErrNoProfile):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		s.logger.Errorf("Failed to start stream %s: %v", streamID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transcoder: " + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Stream started", "stream": stream.GetStatus()})
+	c.JSON(http.StatusOK, gin.H{"message": "Stream started", "stream": liveStream.GetStatus()})
 }
 
+// stopStream either stops transcoding and keeps the publisher connected
+// (mode=pause, the default) or disconnects the publisher, which ends the
+// stream (mode=kick).
 func (s *Server) stopStream(c *gin.Context) {
-	streamID := c.Param("streamID")
+	streamID := streamIDParam(c)
+
+	switch mode := c.DefaultQuery("mode", stopModePause); mode {
+	case stopModePause:
+		s.pauseStream(c, streamID)
+	case stopModeKick:
+		s.kickPublisher(c, streamID)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown stop mode %q, expected %q or %q", mode, stopModePause, stopModeKick)})
+	}
+}
 
-	stream, exists := s.streamManager.GetStream(streamID)
+func (s *Server) pauseStream(c *gin.Context, streamID string) {
+	liveStream, exists := s.streamManager.GetStream(streamID)
 	if !exists {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
 		return
 	}
 
-	stream.Stop()
+	if err := liveStream.StopTranscoder(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stream is not active"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Stream stopped", "stream": liveStream.GetStatus()})
+}
+
+// stopPull stops the pull of a pulled stream, which would reconnect if only
+// its source were closed. It reports whether the stream is pulled.
+func (s *Server) stopPull(streamID string) (bool, error) {
+	if s.pulls == nil {
+		return false, nil
+	}
+	if status, exists := s.pulls.Get(streamID); !exists || status.State == pull.StateStopped {
+		return false, nil
+	}
+	return true, s.pulls.Stop(streamID)
+}
+
+// kickPublisher ends a stream by disconnecting its publisher. A pulled
+// stream's pull is stopped instead, since it would reconnect.
+func (s *Server) kickPublisher(c *gin.Context, streamID string) {
+	if pulled, err := s.stopPull(streamID); pulled {
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Pull stopped"})
+		return
+	}
+
+	if _, exists := s.streamManager.GetStream(streamID); !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	if s.rtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Disconnecting publishers is not enabled"})
+		return
+	}
+
+	err := s.rtmpServer.KickPublisher(streamID)
+	if errors.Is(err, rtmp.ErrPublisherNotFound) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stream has no publisher"})
+		return
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to disconnect publisher of stream %s: %v", streamID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect publisher"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Stream stopped", "stream": stream.GetStatus()})
+	c.JSON(http.StatusOK, gin.H{"message": "Publisher disconnected"})
 }
 
+// deleteStream ends a stream the way kickPublisher does. The publisher's
+// pipeline then removes the stream itself once it has stopped, so only a
+// stream left without a publisher is removed here.
 func (s *Server) deleteStream(c *gin.Context) {
-	streamID := c.Param("streamID")
+	streamID := streamIDParam(c)
+
+	if pulled, _ := s.stopPull(streamID); pulled {
+		c.JSON(http.StatusOK, gin.H{"message": "Stream deleted"})
+		return
+	}
 
+	if s.rtmpServer != nil {
+		err := s.rtmpServer.KickPublisher(streamID)
+		if err == nil {
+			c.JSON(http.StatusOK, gin.H{"message": "Stream deleted"})
+			return
+		}
+		if !errors.Is(err, rtmp.ErrPublisherNotFound) {
+			s.logger.Errorf("Failed to disconnect publisher of stream %s: %v", streamID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disconnect publisher"})
+			return
+		}
+	}
 	s.streamManager.RemoveStream(streamID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Stream deleted"})
 }
 
+func (s *Server) kickStream(c *gin.Context) {
+	s.kickPublisher(c, streamIDParam(c))
+}
+
+func (s *Server) listViewers(c *gin.Context) {
+	liveStream, exists := s.streamManager.GetStream(streamIDParam(c))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	viewers := liveStream.Viewers()
+	c.JSON(http.StatusOK, gin.H{"viewers": viewers, "count": len(viewers)})
+}
+
+func (s *Server) kickViewer(c *gin.Context) {
+	liveStream, exists := s.streamManager.GetStream(streamIDParam(c))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	if err := liveStream.KickViewer(c.Param("viewerID")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Viewer not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Viewer disconnected"})
+}
+
+func (s *Server) listPushes(c *gin.Context) {
+	stream, exists := s.streamManager.GetStream(streamIDParam(c))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	pushes := []relay.Status{}
+	if s.relay != nil {
+		pushes = s.relay.List(stream.ID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pushes": pushes, "count": len(pushes)})
+}
+
+func (s *Server) addPush(c *gin.Context) {
+	stream, exists := s.streamManager.GetStream(streamIDParam(c))
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	if s.relay == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Push relay is not enabled"})
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	status, err := s.relay.Add(stream, req.URL)
+	if errors.Is(err, relay.ErrPushExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Push target already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, status)
+}
+
+func (s *Server) removePush(c *gin.Context) {
+	streamID := streamIDParam(c)
+
+	if s.relay == nil || s.relay.Remove(streamID, c.Param("pushID")) != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Push not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Push removed"})
+}
+
+func (s *Server) startPull(c *gin.Context, id string) {
+	status, err := s.pulls.Start(id)
+	if errors.Is(err, pull.ErrPullRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Stream is already active"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Pull started", "pull": status})
+}
+
+func (s *Server) listPulls(c *gin.Context) {
+	pulls := []pull.Status{}
+	if s.pulls != nil {
+		pulls = s.pulls.List()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pulls": pulls, "count": len(pulls)})
+}
+
+func (s *Server) createPull(c *gin.Context) {
+	if s.pulls == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Pulling streams is not enabled"})
+		return
+	}
+
+	var req struct {
+		App    string `json:"app"`
+		Stream string `json:"stream"`
+		URL    string `json:"url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	status, err := s.pulls.Add(pull.Config{App: req.App, Stream: req.Stream, URL: req.URL})
+	if errors.Is(err, pull.ErrPullExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Pull already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, status)
+}
+
+func (s *Server) deletePull(c *gin.Context) {
+	if s.pulls == nil || s.pulls.Stop(streamIDParam(c)) != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pull not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Pull stopped"})
+}
+
+func (s *Server) listBans(c *gin.Context) {
+	bans := []rtmp.Ban{}
+	if s.bans != nil {
+		bans = s.bans.List()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"bans": bans, "count": len(bans)})
+}
+
+func (s *Server) createBan(c *gin.Context) {
+	if s.bans == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Bans are not enabled"})
+		return
+	}
+
+	var req struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+		TTL   int    `json:"ttl"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	ban, err := s.bans.Add(req.Type, req.Value, time.Duration(req.TTL)*time.Second)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.logger.Infof("Banned %s %s", ban.Type, ban.Value)
+	s.kickBanned()
+	c.JSON(http.StatusCreated, gin.H{"ban": ban})
+}
+
+// kickBanned disconnects the publishers and viewers that are already
+// connected when a ban is added, since bans are checked on connect.
+func (s *Server) kickBanned() {
+	if s.rtmpServer != nil {
+		s.rtmpServer.KickBannedPublishers()
+	}
+
+	for _, liveStream := range s.streamManager.ListStreams() {
+		for _, viewer := range liveStream.Viewers() {
+			if err := s.bans.CheckAddr(viewer.RemoteAddr); err != nil {
+				liveStream.KickViewer(viewer.ID)
+			}
+		}
+	}
+}
+
+func (s *Server) deleteBan(c *gin.Context) {
+	if s.bans == nil || s.bans.Remove(c.Param("type"), c.Param("value")) != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ban not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Ban removed"})
+}
+
+func (s *Server) listRecordings(c *gin.Context) {
+	if s.recordings == nil {
+		c.JSON(http.StatusOK, gin.H{"recordings": []interface{}{}, "count": 0})
+		return
+	}
+
+	recordings, err := s.recordings.List()
+	if err != nil {
+		s.logger.Errorf("Failed to list recordings: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list recordings"})
+		return
+	}
+
+	recordingList := make([]gin.H, 0, len(recordings))
+	for _, recording := range recordings {
+		recordingList = append(recordingList, gin.H{
+			"path":        recording.Path,
+			"size":        recording.Size,
+			"modified_at": recording.ModifiedAt,
+			"active":      recording.Active,
+			"url":         "/recordings/" + recording.Path,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recordings": recordingList,
+		"count":      len(recordingList),
+	})
+}
+
+func (s *Server) serveRecording(c *gin.Context) {
+	if s.recordings == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+
+	recordingPath, err := s.recordings.FilePath(c.Param("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recording path"})
+		return
+	}
+
+	if info, err := os.Stat(recordingPath); err != nil || info.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.FileAttachment(recordingPath, filepath.Base(recordingPath))
+}
+
 func (s *Server) servePlaylist(c *gin.Context) {
+	if !s.blockPlaylistReload(c) {
+		return
+	}
+	s.servePlaylistFile(c, "playlist.m3u8")
+}
+
+// blockPlaylistReload implements the LL-HLS _HLS_msn/_HLS_part query
+// parameters by holding the request until the playlist contains the
+// requested segment or part. It returns false if a response was already sent.
+func (s *Server) blockPlaylistReload(c *gin.Context) bool {
+	msnValue := c.Query("_HLS_msn")
+	partValue := c.Query("_HLS_part")
+	if msnValue == "" {
+		if partValue != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "_HLS_part requires _HLS_msn"})
+			return false
+		}
+		return true
+	}
+
+	msn, err := strconv.Atoi(msnValue)
+	if err != nil || msn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid _HLS_msn value"})
+		return false
+	}
+	part := -1
+	if partValue != "" {
+		part, err = strconv.Atoi(partValue)
+		if err != nil || part < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid _HLS_part value"})
+			return false
+		}
+	}
+
+	app, name, ok := mediaStreamParams(c)
+	if !ok {
+		return false
+	}
+	liveStream, exists := s.streamManager.GetStream(app + "/" + name)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return false
+	}
+
+	return s.waitForPart(c, liveStream, msn, part)
+}
+
+func (s *Server) waitForPart(c *gin.Context, liveStream *stream.Stream, msn, part int) bool {
+	err := liveStream.WaitForPart(c.Request.Context(), msn, part)
+	switch {
+	case err == nil, errors.Is(err, stream.ErrBlockingUnsupported), errors.Is(err, hls.ErrSegmenterClosed):
+		// Streams without LL-HLS, or that just ended, get the current playlist.
+		return true
+	case errors.Is(err, hls.ErrTooFarAhead):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Timed out waiting for playlist update"})
+	default:
+		c.Abort()
+	}
+	return false
+}
+
+func (s *Server) serveMasterPlaylist(c *gin.Context) {
+	s.servePlaylistFile(c, "master.m3u8")
+}
+
+// mediaStreamParams returns the :app and :stream parameters of an HLS or
+// DASH request. Both end up in file paths, so they must be plain names. It
+// returns false if a response was already sent.
+func mediaStreamParams(c *gin.Context) (string, string, bool) {
 	app := c.Param("app")
 	stream := c.Param("stream")
 
-	playlistPath := filepath.Join(s.hlsOutputDir, app, stream, "playlist.m3u8")
+	if rtmp.ValidateName(app) != nil || rtmp.ValidateName(stream) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid stream path"})
+		return "", "", false
+	}
+	return app, stream, true
+}
+
+func (s *Server) servePlaylistFile(c *gin.Context, name string) {
+	app, stream, ok := mediaStreamParams(c)
+	if !ok {
+		return
+	}
+	s.serveDirPlaylistFile(c, filepath.Join(s.hlsOutputDir, app, stream), name)
+}
+
+func (s *Server) serveDirPlaylistFile(c *gin.Context, dir, name string) {
+	if rtmp.ValidateName(name) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid playlist file"})
+		return
+	}
+
+	playlistPath := filepath.Join(dir, name)
 
 	if _, err := os.Stat(playlistPath); os.IsNotExist(err) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
 		return
 	}
 
-	c.Header("Content-Type", "application/vnd.apple.mpegurl")
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
-	c.Header("Access-Control-Allow-Headers", "Content-Type")
+	setManifestHeaders(c, "application/vnd.apple.mpegurl")
 
 	c.File(playlistPath)
 }
 
 func (s *Server) serveSegment(c *gin.Context) {
-	app := c.Param("app")
-	stream := c.Param("stream")
+	app, stream, ok := mediaStreamParams(c)
+	if !ok {
+		return
+	}
 	segment := c.Param("segment")
 
-	if !strings.HasSuffix(segment, ".ts") {
+	if strings.HasSuffix(segment, ".m3u8") {
+		s.servePlaylistFile(c, segment)
+		return
+	}
+
+	contentType, ok := segmentContentType(segment)
+	if !ok || rtmp.ValidateName(segment) != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid segment file"})
 		return
 	}
 
 	segmentPath := filepath.Join(s.hlsOutputDir, app, stream, segment)
 
+	// LL-HLS clients request the part named in EXT-X-PRELOAD-HINT before it
+	// exists; hold them until the segmenter finishes it.
+	if sequence, part, ok := hls.ParsePartName(segment); ok {
+		if _, err := os.Stat(segmentPath); os.IsNotExist(err) {
+			if liveStream, exists := s.streamManager.GetStream(app + "/" + stream); exists {
+				if !s.waitForPart(c, liveStream, sequence, part) {
+					return
+				}
+			}
+		}
+	}
+
 	if _, err := os.Stat(segmentPath); os.IsNotExist(err) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Segment not found"})
 		return
 	}
 
-	c.Header("Content-Type", "video/mp2t")
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
-	c.Header("Access-Control-Allow-Headers", "Content-Type, Range")
+	setSegmentHeaders(c, contentType)
 
 	file, err := os.Open(segmentPath)
 	if err != nil {
@@ -242,6 +908,64 @@ func (s *Server) serveSegment(c *gin.Context) {
 	http.ServeContent(c.Writer, c.Request, segment, stat.ModTime(), file)
 }
 
+func (s *Server) serveDASHManifest(c *gin.Context) {
+	app, name, ok := mediaStreamParams(c)
+	if !ok {
+		return
+	}
+	liveStream, exists := s.streamManager.GetStream(app + "/" + name)
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	manifest, err := liveStream.DASHManifest()
+	switch {
+	case errors.Is(err, stream.ErrDASHDisabled), errors.Is(err, dash.ErrNoRepresentations), errors.Is(err, os.ErrNotExist):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Manifest not found"})
+		return
+	case err != nil:
+		s.logger.Errorf("Failed to build DASH manifest for %s: %v", liveStream.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+		return
+	}
+
+	setManifestHeaders(c, "application/dash+xml")
+	c.Data(http.StatusOK, "application/dash+xml", manifest)
+}
+
+// Live playlists and manifests change with every segment, so clients must
+// revalidate them.
+func setManifestHeaders(c *gin.Context, contentType string) {
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
+	c.Header("Access-Control-Allow-Headers", "Content-Type")
+}
+
+func setSegmentHeaders(c *gin.Context, contentType string) {
+	c.Header("Content-Type", contentType)
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
+	c.Header("Access-Control-Allow-Headers", "Content-Type, Range")
+}
+
+// segmentContentType maps MPEG-TS and fMP4/CMAF segment names to their MIME
+// types.
+func segmentContentType(name string) (string, bool) {
+	switch filepath.Ext(name) {
+	case ".ts":
+		return "video/mp2t", true
+	case ".m4s":
+		return "video/iso.segment", true
+	case ".mp4":
+		return "video/mp4", true
+	default:
+		return "", false
+	}
+}
+
 func (s *Server) serveDirectPlaylist(c *gin.Context) {
 	playlistPath := filepath.Join(s.hlsOutputDir, "stream.m3u8")
 
@@ -250,10 +974,7 @@ func (s *Server) serveDirectPlaylist(c *gin.Context) {
 		return
 	}
 
-	c.Header("Content-Type", "application/vnd.apple.mpegurl")
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
-	c.Header("Access-Control-Allow-Headers", "Content-Type")
+	setManifestHeaders(c, "application/vnd.apple.mpegurl")
 
 	c.File(playlistPath)
 }
@@ -261,7 +982,13 @@ func (s *Server) serveDirectPlaylist(c *gin.Context) {
 func (s *Server) serveDirectSegment(c *gin.Context) {
 	segment := c.Param("segment")
 
-	if !strings.HasSuffix(segment, ".ts") {
+	if strings.HasSuffix(segment, ".m3u8") {
+		s.serveDirPlaylistFile(c, s.hlsOutputDir, segment)
+		return
+	}
+
+	contentType, ok := segmentContentType(segment)
+	if !ok || rtmp.ValidateName(segment) != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid segment file"})
 		return
 	}
@@ -273,10 +1000,7 @@ func (s *Server) serveDirectSegment(c *gin.Context) {
 		return
 	}
 
-	c.Header("Content-Type", "video/mp2t")
-	c.Header("Access-Control-Allow-Origin", "*")
-	c.Header("Access-Control-Allow-Methods", "GET, OPTIONS")
-	c.Header("Access-Control-Allow-Headers", "Content-Type, Range")
+	setSegmentHeaders(c, contentType)
 
 	file, err := os.Open(segmentPath)
 	if err != nil {
@@ -0,0 +1,1041 @@
+package http
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/pull"
+	"golang-rtmp/internal/record"
+	"golang-rtmp/internal/relay"
+	"golang-rtmp/internal/rtmp"
+	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/testutil"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nareix/joy4/av"
+	"github.com/sirupsen/logrus"
+)
+
+type testCodec struct {
+	codecType av.CodecType
+}
+
+func (c testCodec) Type() av.CodecType {
+	return c.codecType
+}
+
+func newTestServer(t *testing.T) (*Server, *stream.StreamManager, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	logger := logrus.New()
+	outputDir := t.TempDir()
+
+	sm := stream.NewStreamManager(logger)
+	sm.SetTranscoderFactory(stream.NewFakeTranscoderFactory())
+
+	return NewServer(":0", sm, logger, outputDir), sm, outputDir
+}
+
+func publishTestStream(t *testing.T, sm *stream.StreamManager, outputDir, app, name string, keyframes int) *stream.Stream {
+	t.Helper()
+
+	st := sm.CreateStream(app, name, filepath.Join(outputDir, app, name))
+	if err := st.StartTranscoder(stream.TranscodeProfile{SegmentDuration: 4, PlaylistWindow: 10}); err != nil {
+		t.Fatalf("failed to start transcoder: %v", err)
+	}
+
+	if err := st.WriteHeader([]av.CodecData{testCodec{av.H264}, testCodec{av.AAC}}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	for i := 0; i < keyframes; i++ {
+		if err := st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("segment data")}); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	if keyframes > 0 {
+		waitForSegment(t, st.OutputDir, "playlist.m3u8", fmt.Sprintf("segment_%03d.ts", keyframes-1))
+	}
+
+	return st
+}
+
+// waitForSegment waits for the transcoder, which is fed from its own queue,
+// to list segment in a playlist.
+func waitForSegment(t *testing.T, dir, playlist, segment string) {
+	t.Helper()
+
+	testutil.WaitFor(t, segment+" in "+playlist, func() bool {
+		data, err := os.ReadFile(filepath.Join(dir, playlist))
+		return err == nil && strings.Contains(string(data), segment)
+	})
+}
+
+func doRequest(router http.Handler, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestServer_StreamAPI(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	publishTestStream(t, sm, outputDir, "live", "test", 1)
+
+	rec := doRequest(router, http.MethodGet, "/api/v1/streams")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from list, got %d", rec.Code)
+	}
+
+	var list struct {
+		Count   int                      `json:"count"`
+		Streams []map[string]interface{} `json:"streams"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to decode list response: %v", err)
+	}
+	if list.Count != 1 || list.Streams[0]["id"] != "live/test" {
+		t.Errorf("unexpected list response: %s", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/streams/live%2Ftest")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from get, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var status map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode stream response: %v", err)
+	}
+	if status["is_active"] != true {
+		t.Errorf("expected stream to be active, got %v", status["is_active"])
+	}
+	if _, ok := status["transcode"].(map[string]interface{}); !ok {
+		t.Errorf("expected transcode stats in stream response, got %v", status["transcode"])
+	}
+
+	if rec := doRequest(router, http.MethodGet, "/api/v1/streams/live/test"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from get with an unescaped stream ID, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/streams/live%2Fmissing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown stream, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodDelete, "/api/v1/streams/live%2Ftest")
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from delete, got %d", rec.Code)
+	}
+	if _, exists := sm.GetStream("live/test"); exists {
+		t.Error("expected stream to be removed")
+	}
+}
+
+func TestServer_ServesHLSOutput(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	publishTestStream(t, sm, outputDir, "live", "test", 2)
+
+	rec := doRequest(router, http.MethodGet, "/hls/live/test/playlist.m3u8")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for playlist, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("unexpected playlist content type %s", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "segment_001.ts") {
+		t.Errorf("expected playlist to list segment_001.ts, got:\n%s", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodGet, "/hls/live/test/segment_000.ts")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for segment, got %d", rec.Code)
+	}
+	if rec.Body.String() != "segment data" {
+		t.Errorf("unexpected segment body %q", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodGet, "/hls/live/test/segment_009.ts")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing segment, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/hls/live/test/playlist.txt")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for non-segment file, got %d", rec.Code)
+	}
+}
+
+func TestServer_RejectsPathTraversal(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	publishTestStream(t, sm, outputDir, "live", "test", 1)
+
+	secretDir := filepath.Join(filepath.Dir(outputDir), "x", "y")
+	if err := os.MkdirAll(secretDir, 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(secretDir, "secret.ts"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for _, path := range []string{
+		"/hls/..%2Fx/y/secret.ts",
+		"/hls/live/..%2F..%2Fx%2Fy/secret.ts",
+		"/hls/live/test/..%2F..%2F..%2Fx%2Fy%2Fsecret.ts",
+		"/dash/..%2Fx/y/secret.ts",
+		"/dash/..%2Fx/y/manifest.mpd",
+		"/live/..%2Fx/y.flv",
+		"/hls/live/../playlist.m3u8",
+	} {
+		rec := doRequest(router, http.MethodGet, path)
+		if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "secret") {
+			t.Errorf("expected %s to be rejected, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestServer_StopStream(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	st := publishTestStream(t, sm, outputDir, "live", "test", 0)
+
+	rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/stop")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from stop, got %d", rec.Code)
+	}
+	if st.IsActive {
+		t.Error("expected stream to be inactive after stop")
+	}
+	if _, exists := sm.GetStream("live/test"); !exists {
+		t.Error("expected the stream to stay published after stop")
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/stop?mode=pause"); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a stopped stream, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/stop?mode=restart"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown stop mode, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/start")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from start, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !st.GetStatus()["is_active"].(bool) {
+		t.Error("expected stream to be active after start")
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/start"); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an active stream, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Fmissing/start"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown stream, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Fmissing/stop"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown stream, got %d", rec.Code)
+	}
+}
+
+// closableSource is a publisher that sends no packets until it is closed.
+type closableSource struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (s *closableSource) Streams() ([]av.CodecData, error) {
+	return []av.CodecData{testCodec{av.H264}}, nil
+}
+
+func (s *closableSource) ReadPacket() (av.Packet, error) {
+	<-s.closed
+	return av.Packet{}, io.EOF
+}
+
+func (s *closableSource) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func TestServer_StopStreamKicksPublisher(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/stop?mode=kick")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown stream, got %d", rec.Code)
+	}
+
+	rtmpServer := rtmp.NewServer(":0", sm, logrus.New())
+	rtmpServer.SetHLSConfig(outputDir, 4, 10)
+	server.SetRTMP(rtmpServer)
+
+	src := &closableSource{closed: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- rtmpServer.Ingest("live", "test", src)
+	}()
+	defer src.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rec = doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/stop?mode=kick")
+		if rec.Code != http.StatusNotFound && rec.Code != http.StatusConflict {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the publisher, got %d", rec.Code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from kick, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the publisher to be disconnected")
+	}
+	if _, exists := sm.GetStream("live/test"); exists {
+		t.Error("expected the stream to end when its publisher is kicked")
+	}
+}
+
+func TestServer_HealthAndMetrics(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	publishTestStream(t, sm, outputDir, "live", "test", 0)
+
+	rec := doRequest(router, http.MethodGet, "/health")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from health, got %d", rec.Code)
+	}
+
+	var health map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("failed to decode health response: %v", err)
+	}
+	if health["active_streams"] != float64(1) {
+		t.Errorf("expected 1 active stream, got %v", health["active_streams"])
+	}
+
+	rec = doRequest(router, http.MethodGet, "/metrics")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from metrics, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "http_requests_total") {
+		t.Error("expected metrics output to contain http_requests_total")
+	}
+	if !strings.Contains(rec.Body.String(), `rtmp_stream_transcoder_restarts_total{stream="live/test"} 0`) {
+		t.Error("expected metrics output to contain per-stream transcoder restarts")
+	}
+	if !strings.Contains(rec.Body.String(), `rtmp_stream_transcode_fps{stream="live/test"}`) {
+		t.Error("expected metrics output to contain per-stream transcode fps")
+	}
+}
+
+func TestServer_StreamLogs(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	st := publishTestStream(t, sm, outputDir, "live", "test", 2)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(st.Logs(0)) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for transcoder logs, got %v", st.Logs(0))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := doRequest(router, http.MethodGet, "/api/v1/streams/live%2Ftest/logs?tail=1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from logs, got %d", rec.Code)
+	}
+
+	var logs struct {
+		Lines []stream.LogLine `json:"lines"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &logs); err != nil {
+		t.Fatalf("failed to decode logs response: %v", err)
+	}
+	if len(logs.Lines) != 1 || logs.Lines[0].Line != "wrote segment_001.ts" {
+		t.Errorf("unexpected logs response: %s", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/streams/live%2Ftest/logs?tail=abc")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid tail, got %d", rec.Code)
+	}
+
+	httpServer := httptest.NewServer(router)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "/api/v1/streams/live%2Ftest/logs?tail=1&follow=true")
+	if err != nil {
+		t.Fatalf("failed to follow logs: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected follow content type %s", ct)
+	}
+
+	events := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data:") {
+				events <- scanner.Text()
+			}
+		}
+		close(events)
+	}()
+
+	expectEvent := func(want string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if !strings.Contains(event, want) {
+				t.Errorf("expected event containing %q, got %s", want, event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event containing %q", want)
+		}
+	}
+
+	expectEvent("wrote segment_001.ts")
+
+	st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("segment data")})
+	expectEvent("wrote segment_002.ts")
+
+	sm.RemoveStream("live/test")
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected no more events after stream removal")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected follow stream to end when the stream is removed")
+	}
+}
+
+func TestServer_ServesMasterPlaylist(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	st := sm.CreateStream("live", "abr", filepath.Join(outputDir, "live", "abr"))
+	err := st.StartTranscoder(stream.TranscodeProfile{
+		SegmentDuration: 4,
+		PlaylistWindow:  10,
+		Renditions: []stream.Rendition{
+			{Name: "720p", Resolution: "1280x720", VideoBitrate: "2800k", AudioBitrate: "128k", Profile: "main"},
+			{Name: "360p", Resolution: "640x360", VideoBitrate: "800k", AudioBitrate: "96k", Profile: "baseline"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to start transcoder: %v", err)
+	}
+
+	rec := doRequest(router, http.MethodGet, "/hls/live/abr/master.m3u8")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for master playlist, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("unexpected master playlist content type %s", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "playlist_360p.m3u8") {
+		t.Errorf("expected master playlist to reference 360p variant, got:\n%s", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodGet, "/hls/live/abr/playlist_360p.m3u8")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for variant playlist, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("unexpected variant playlist content type %s", ct)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/hls/live/test/master.m3u8")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing master playlist, got %d", rec.Code)
+	}
+}
+
+func TestServer_ServesFMP4Segments(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	st := sm.CreateStream("live", "cmaf", filepath.Join(outputDir, "live", "cmaf"))
+	if err := st.StartTranscoder(stream.TranscodeProfile{Container: stream.ContainerFMP4, SegmentDuration: 4, PlaylistWindow: 10}); err != nil {
+		t.Fatalf("failed to start transcoder: %v", err)
+	}
+	if err := st.WriteHeader([]av.CodecData{testCodec{av.H264}, testCodec{av.AAC}}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if err := st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("fragment")}); err != nil {
+		t.Fatalf("failed to write packet: %v", err)
+	}
+	waitForSegment(t, st.OutputDir, "playlist.m3u8", "segment_000.m4s")
+
+	rec := doRequest(router, http.MethodGet, "/hls/live/cmaf/playlist.m3u8")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "#EXT-X-MAP:URI=\"init.mp4\"") {
+		t.Fatalf("expected fMP4 playlist, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for path, contentType := range map[string]string{
+		"/hls/live/cmaf/init.mp4":        "video/mp4",
+		"/hls/live/cmaf/segment_000.m4s": "video/iso.segment",
+	} {
+		rec := doRequest(router, http.MethodGet, path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected 200 for %s, got %d", path, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("expected content type %s for %s, got %s", contentType, path, got)
+		}
+	}
+
+	if rec := doRequest(router, http.MethodGet, "/hls/live/cmaf/segment_000.webm"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown segment type, got %d", rec.Code)
+	}
+}
+
+func TestServer_ServesDASHManifest(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	st := sm.CreateStream("live", "dash", filepath.Join(outputDir, "live", "dash"))
+	err := st.StartTranscoder(stream.TranscodeProfile{
+		Container:       stream.ContainerFMP4,
+		DASH:            true,
+		Params:          map[string]string{"resolution": "1280x720"},
+		SegmentDuration: 4,
+		PlaylistWindow:  10,
+	})
+	if err != nil {
+		t.Fatalf("failed to start transcoder: %v", err)
+	}
+	if err := st.WriteHeader([]av.CodecData{testCodec{av.H264}, testCodec{av.AAC}}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if rec := doRequest(router, http.MethodGet, "/dash/live/dash/manifest.mpd"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 before the first segment, got %d", rec.Code)
+	}
+	for i := 0; i < 2; i++ {
+		if err := st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("fragment")}); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	waitForSegment(t, st.OutputDir, "playlist_video.m3u8", "segment_video_001.m4s")
+	waitForSegment(t, st.OutputDir, "playlist_audio.m3u8", "segment_audio_001.m4s")
+
+	rec := doRequest(router, http.MethodGet, "/dash/live/dash/manifest.mpd")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/dash+xml" {
+		t.Errorf("expected DASH content type, got %s", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("expected manifest to be revalidated, got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected CORS header, got %q", got)
+	}
+	for _, expected := range []string{
+		`type="dynamic"`,
+		`<AdaptationSet id="0" contentType="video" mimeType="video/mp4"`,
+		`<AdaptationSet id="1" contentType="audio" mimeType="audio/mp4"`,
+		`width="1280" height="720"`,
+		`<SegmentTemplate timescale="90000" initialization="init_video.mp4" media="segment_video_$Number%03d$.m4s" startNumber="0">`,
+		`<SegmentTemplate timescale="48000" initialization="init_audio.mp4" media="segment_audio_$Number%03d$.m4s" startNumber="0">`,
+		`<S t="0" d="360000" r="1"></S>`,
+		`<S t="0" d="192000" r="1"></S>`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("expected manifest to contain %s, got:\n%s", expected, rec.Body.String())
+		}
+	}
+
+	for path, contentType := range map[string]string{
+		"/dash/live/dash/init_video.mp4":        "video/mp4",
+		"/dash/live/dash/segment_video_001.m4s": "video/iso.segment",
+		"/dash/live/dash/segment_audio_001.m4s": "video/iso.segment",
+	} {
+		rec := doRequest(router, http.MethodGet, path)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != contentType {
+			t.Errorf("expected %s to be served as %s, got %d %s", path, contentType, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+
+	publishTestStream(t, sm, outputDir, "live", "hlsonly", 1)
+	if rec := doRequest(router, http.MethodGet, "/dash/live/hlsonly/manifest.mpd"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for stream without DASH, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodGet, "/dash/live/missing/manifest.mpd"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown stream, got %d", rec.Code)
+	}
+}
+
+func TestServer_ListsAndServesRecordings(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	router := server.Router()
+
+	rec := doRequest(router, http.MethodGet, "/api/v1/recordings")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"count":0`) {
+		t.Fatalf("expected empty list without a recorder, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	recordingDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(recordingDir, "live", "test"), 0755); err != nil {
+		t.Fatalf("failed to create recording dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(recordingDir, "live", "test", "20260101-000000.flv"), []byte("FLV"), 0644); err != nil {
+		t.Fatalf("failed to write recording: %v", err)
+	}
+	server.SetRecordings(record.NewManager(recordingDir, logrus.New()))
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/recordings")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var response struct {
+		Recordings []struct {
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+			URL  string `json:"url"`
+		} `json:"recordings"`
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.Count != 1 || response.Recordings[0].Path != "live/test/20260101-000000.flv" || response.Recordings[0].Size != 3 {
+		t.Fatalf("unexpected recordings: %s", rec.Body.String())
+	}
+
+	rec = doRequest(router, http.MethodGet, response.Recordings[0].URL)
+	if rec.Code != http.StatusOK || rec.Body.String() != "FLV" {
+		t.Errorf("expected recording download, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, "attachment") {
+		t.Errorf("expected attachment disposition, got %q", got)
+	}
+
+	if rec := doRequest(router, http.MethodGet, "/recordings/live/test/missing.mp4"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for missing recording, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodGet, "/recordings/live/test/playlist.m3u8"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for non-recording file, got %d", rec.Code)
+	}
+}
+
+func writeLowLatencyMedia(t *testing.T, st *stream.Stream, from, to time.Duration) {
+	t.Helper()
+
+	for ts := from; ts < to; ts += 40 * time.Millisecond {
+		pkt := av.Packet{Idx: 0, IsKeyFrame: ts%time.Second == 0, Time: ts, Data: []byte{0, 0, 0, 1, 0x65, 0x88}}
+		if err := st.WritePacket(pkt); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+}
+
+func TestServer_BlockingPlaylistReload(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	router := server.Router()
+
+	st := sm.CreateStream("live", "ll", filepath.Join(outputDir, "live", "ll"))
+	err := st.StartTranscoder(stream.TranscodeProfile{
+		Passthrough:     true,
+		Segmenter:       stream.SegmenterNative,
+		PartDuration:    500 * time.Millisecond,
+		SegmentDuration: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to start transcoder: %v", err)
+	}
+
+	video := testutil.Codecs(t)[0]
+	if err := st.WriteHeader([]av.CodecData{video}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	writeLowLatencyMedia(t, st, 0, 1200*time.Millisecond)
+
+	if rec := doRequest(router, http.MethodGet, "/hls/live/ll/playlist.m3u8?_HLS_part=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for _HLS_part without _HLS_msn, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodGet, "/hls/live/ll/playlist.m3u8?_HLS_msn=9"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for _HLS_msn too far ahead, got %d", rec.Code)
+	}
+
+	rec := doRequest(router, http.MethodGet, "/hls/live/ll/playlist.m3u8?_HLS_msn=0&_HLS_part=1")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "segment_000.1.ts") {
+		t.Fatalf("expected playlist with part 0.1, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- doRequest(router, http.MethodGet, "/hls/live/ll/playlist.m3u8?_HLS_msn=2&_HLS_part=0")
+	}()
+	hint := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		hint <- doRequest(router, http.MethodGet, "/hls/live/ll/segment_002.0.ts")
+	}()
+
+	select {
+	case rec := <-done:
+		t.Fatalf("expected playlist request to block, got %d", rec.Code)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	writeLowLatencyMedia(t, st, 1200*time.Millisecond, 2600*time.Millisecond)
+
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"segment_002.1.ts\"") {
+			t.Errorf("expected updated playlist, got %d: %s", rec.Code, rec.Body.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocking playlist request did not return")
+	}
+
+	select {
+	case rec := <-hint:
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "video/mp2t" {
+			t.Errorf("expected preload hinted part, got %d", rec.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("preload hint request did not return")
+	}
+
+	publishTestStream(t, sm, outputDir, "live", "regular", 1)
+	if rec := doRequest(router, http.MethodGet, "/hls/live/regular/playlist.m3u8?_HLS_msn=5"); rec.Code != http.StatusOK {
+		t.Errorf("expected streams without LL-HLS to ignore _HLS_msn, got %d", rec.Code)
+	}
+}
+
+func TestServer_PushAPI(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	relayManager := relay.NewManager(logrus.New())
+	relayManager.SetBackoff(time.Hour, time.Hour)
+	server.SetRelay(relayManager)
+	router := server.Router()
+
+	st := publishTestStream(t, sm, outputDir, "live", "test", 1)
+	defer func() {
+		st.WriteTrailer()
+		relayManager.StopStream(st.ID)
+		relayManager.Wait()
+	}()
+
+	addPush := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/streams/live%2Ftest/pushes", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := addPush(`{"url": "rtmp://127.0.0.1:1/live/{stream}"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 from add push, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var push relay.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &push); err != nil {
+		t.Fatalf("failed to decode push: %v", err)
+	}
+	if push.URL != "rtmp://127.0.0.1:1/live/test" {
+		t.Errorf("expected templated push URL, got %q", push.URL)
+	}
+
+	if rec := addPush(`{"url": "rtmp://127.0.0.1:1/live/{stream}"}`); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate push, got %d", rec.Code)
+	}
+	if rec := addPush(`{"url": "http://example.com/live"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a non-RTMP push, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/streams/live%2Ftest")
+	var status struct {
+		Pushes []relay.Status `json:"pushes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode stream: %v", err)
+	}
+	if len(status.Pushes) != 1 || status.Pushes[0].ID != push.ID {
+		t.Errorf("expected push in stream status, got %s", rec.Body.String())
+	}
+
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/streams/live%2Ftest/pushes/"+push.ID); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from remove push, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/streams/live%2Ftest/pushes/"+push.ID); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a removed push, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/streams/live%2Ftest/pushes")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"count":0`) {
+		t.Errorf("expected no pushes, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doRequest(router, http.MethodGet, "/api/v1/streams/live%2Fmissing/pushes"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown stream, got %d", rec.Code)
+	}
+}
+
+type nopIngester struct{}
+
+func (nopIngester) Ingest(app, stream string, src av.Demuxer) error {
+	return nil
+}
+
+func TestServer_PullAPI(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	pullManager := pull.NewManager(nopIngester{}, t.TempDir(), logrus.New())
+	pullManager.SetBackoff(time.Hour, time.Hour)
+	server.SetPulls(pullManager)
+	router := server.Router()
+	defer func() {
+		pullManager.StopAll()
+		pullManager.Wait()
+	}()
+
+	createPull := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/pulls", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := createPull(`{"app": "live", "stream": "camera", "url": "rtmp://127.0.0.1:1/live/cam"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 from create pull, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := createPull(`{"app": "live", "stream": "camera", "url": "rtmp://127.0.0.1:1/live/cam"}`); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a duplicate pull, got %d", rec.Code)
+	}
+	if rec := createPull(`{"app": "live", "stream": "file", "url": "../../etc/passwd"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unsupported source, got %d", rec.Code)
+	}
+
+	rec = doRequest(router, http.MethodGet, "/api/v1/pulls")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":"live/camera"`) {
+		t.Errorf("expected pull in list, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/pulls/live%2Fcamera"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from delete pull, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/pulls/live%2Fcamera"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a deleted pull, got %d", rec.Code)
+	}
+
+	// A configured pull is started through the stream start endpoint.
+	if err := pullManager.Configure(pull.Config{App: "live", Stream: "lobby", URL: "rtmp://127.0.0.1:1/live/lobby"}); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	rec = doRequest(router, http.MethodPost, "/api/v1/streams/live%2Flobby/start")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Pull started") {
+		t.Errorf("expected configured pull to start, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Flobby/start"); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a running pull, got %d", rec.Code)
+	}
+
+	// Kicking a pulled stream stops its pull, which would reconnect.
+	rec = doRequest(router, http.MethodPost, "/api/v1/streams/live%2Flobby/stop?mode=kick")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Pull stopped") {
+		t.Errorf("expected kick to stop the pull, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	pullStopped := func() bool {
+		status, _ := pullManager.Get("live/lobby")
+		return status.State == pull.StateStopped
+	}
+	testutil.WaitFor(t, "the kicked pull to stop", pullStopped)
+
+	// So does deleting it.
+	if _, err := pullManager.Start("live/lobby"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/streams/live%2Flobby"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from delete, got %d", rec.Code)
+	}
+	testutil.WaitFor(t, "the deleted stream's pull to stop", pullStopped)
+}
+
+func TestServer_KickViewersAndPublishers(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	server.SetRTMP(rtmp.NewServer(":0", sm, logrus.New()))
+	httpServer := httptest.NewServer(server.Router())
+	defer httpServer.Close()
+	router := server.Router()
+
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Fmissing/kick"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown stream, got %d", rec.Code)
+	}
+
+	st := sm.CreateStream("live", "test", filepath.Join(outputDir, "live", "test"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/kick"); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a stream without a publisher, got %d", rec.Code)
+	}
+
+	// The response starts with the first keyframe, so it only returns once
+	// the viewer is kicked.
+	ended := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(httpServer.URL + "/live/live/test.flv")
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		ended <- err
+	}()
+	waitForSubscribers(t, st, 1)
+
+	rec := doRequest(router, http.MethodGet, "/api/v1/streams/live%2Ftest/viewers")
+	var listed struct {
+		Viewers []stream.Viewer `json:"viewers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || len(listed.Viewers) != 1 || listed.Viewers[0].Protocol != protocolHTTPFLV {
+		t.Fatalf("expected one HTTP-FLV viewer, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/viewers/missing/kick"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown viewer, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodPost, "/api/v1/streams/live%2Ftest/viewers/"+listed.Viewers[0].ID+"/kick"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from kick viewer, got %d", rec.Code)
+	}
+
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the kicked viewer's response to end")
+	}
+	waitForSubscribers(t, st, 0)
+}
+
+func TestServer_BansAPI(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	router := server.Router()
+
+	createBan := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/bans", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := createBan(`{"type": "ip", "value": "192.0.2.1"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a ban list, got %d", rec.Code)
+	}
+
+	server.SetBans(rtmp.NewBanList())
+	if rec := createBan(`{"type": "ip", "value": "not-an-ip"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid IP, got %d", rec.Code)
+	}
+	if rec := createBan(`{"type": "key", "value": "rogue", "ttl": -1}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative TTL, got %d", rec.Code)
+	}
+
+	// httptest requests come from 192.0.2.1.
+	rec := createBan(`{"type": "ip", "value": "192.0.2.1", "ttl": 60}`)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"expires_at"`) {
+		t.Fatalf("expected 201 from create ban, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(router, http.MethodGet, "/api/v1/bans")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"count":1`) {
+		t.Errorf("expected the ban in the list, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(router, http.MethodGet, "/live/live/test.flv"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a banned viewer, got %d", rec.Code)
+	}
+	for _, path := range []string{"/live/live/test.flv", "/ws/live/test.flv"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("expected X-Forwarded-For not to bypass the ban on %s, got %d", path, rec.Code)
+		}
+	}
+
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/bans/ip/192.0.2.1"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from delete ban, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodDelete, "/api/v1/bans/ip/192.0.2.1"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a removed ban, got %d", rec.Code)
+	}
+	if rec := doRequest(router, http.MethodGet, "/live/live/test.flv"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the unbanned viewer to reach the stream lookup, got %d", rec.Code)
+	}
+}
+
+func TestServer_BanKicksConnectedViewers(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	server.SetBans(rtmp.NewBanList())
+	httpServer := httptest.NewServer(server.Router())
+	defer httpServer.Close()
+	router := server.Router()
+
+	st := sm.CreateStream("live", "test", filepath.Join(outputDir, "live", "test"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	// The response starts with the first keyframe, so it only returns once
+	// the viewer is kicked.
+	ended := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(httpServer.URL + "/live/live/test.flv")
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		ended <- err
+	}()
+	waitForSubscribers(t, st, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/bans", strings.NewReader(`{"type": "ip", "value": "127.0.0.1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 from create ban, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the banned viewer's response to end")
+	}
+	waitForSubscribers(t, st, 0)
+}
@@ -0,0 +1,169 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang-rtmp/internal/hooks"
+	"golang-rtmp/internal/rtmp"
+	"golang-rtmp/internal/whip"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	protocolWHEP = "whep"
+
+	maxOfferSize = 64 * 1024
+)
+
+func (s *Server) SetWebRTC(manager *whip.Manager) {
+	s.webrtc = manager
+}
+
+// whipPublish answers a WHIP offer and publishes the peer's media as a
+// stream. The stream key may be sent as a bearer token instead of ?key=.
+func (s *Server) whipPublish(c *gin.Context) {
+	setWebRTCHeaders(c)
+	offer, ok := s.readOffer(c)
+	if !ok {
+		return
+	}
+
+	path := &rtmp.StreamPath{
+		App:    c.Param("app"),
+		Stream: c.Param("stream"),
+		Query:  c.Request.URL.Query(),
+	}
+	if err := rtmp.ValidateStreamPath(path.App, path.Stream); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && path.Query.Get("key") == "" {
+		path.Query.Set("key", token)
+	}
+
+	id, answer, err := s.webrtc.Publish(c.Request.Context(), path, c.Request.RemoteAddr, offer)
+	switch {
+	case err == nil:
+	case errors.Is(err, rtmp.ErrPublishDenied):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, hooks.ErrRejected), errors.Is(err, rtmp.ErrBanned):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Publish rejected"})
+		return
+	case errors.Is(err, rtmp.ErrInvalidStreamPath), errors.Is(err, whip.ErrInvalidOffer):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, whip.ErrStreamActive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	default:
+		s.logger.Errorf("WHIP publish of stream %s failed: %v", path.ID(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start WebRTC session"})
+		return
+	}
+
+	c.Header("Location", "/whip/"+path.App+"/"+path.Stream+"/"+id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// whepPlay answers a WHEP offer with the stream's H.264 track, after the
+// same on_play hook as other viewers.
+func (s *Server) whepPlay(c *gin.Context) {
+	setWebRTCHeaders(c)
+	offer, ok := s.readOffer(c)
+	if !ok {
+		return
+	}
+
+	req, ok := s.authorizePlay(c, protocolWHEP, c.Param("app"), c.Param("stream"))
+	if !ok {
+		return
+	}
+	streamID := req.app + "/" + req.name
+
+	id, answer, err := s.webrtc.Play(streamID, c.Request.RemoteAddr, offer, func() {
+		s.metrics.viewers.WithLabelValues(protocolWHEP).Dec()
+		s.notifyPlayDone(req)
+	})
+	if err != nil {
+		s.notifyPlayDone(req)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, whip.ErrStreamNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	case errors.Is(err, whip.ErrNoH264):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, whip.ErrInvalidOffer):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	default:
+		s.logger.Errorf("WHEP play of stream %s failed: %v", streamID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start WebRTC session"})
+		return
+	}
+
+	s.metrics.viewers.WithLabelValues(protocolWHEP).Inc()
+	s.metrics.viewerConnections.WithLabelValues(protocolWHEP).Inc()
+
+	c.Header("Location", "/whep/"+c.Param("app")+"/"+c.Param("stream")+"/"+id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// deleteWebRTCSession ends a WHIP or WHEP session through its resource URL.
+func (s *Server) deleteWebRTCSession(c *gin.Context) {
+	setWebRTCHeaders(c)
+	if s.webrtc == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WebRTC is not enabled"})
+		return
+	}
+
+	if err := s.webrtc.Close(c.Param("sessionID")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (s *Server) webrtcPreflight(c *gin.Context) {
+	setWebRTCHeaders(c)
+	c.Status(http.StatusNoContent)
+}
+
+// readOffer reads the SDP offer of a WHIP or WHEP request. It returns false
+// if a response was already sent.
+func (s *Server) readOffer(c *gin.Context) (string, bool) {
+	if s.webrtc == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WebRTC is not enabled"})
+		return "", false
+	}
+
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if contentType != "application/sdp" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Offer must be application/sdp"})
+		return "", false
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(c.Request.Body, maxOfferSize))
+	if err != nil || len(offer) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing SDP offer"})
+		return "", false
+	}
+	return string(offer), true
+}
+
+// Browser WHIP and WHEP clients are usually served from another origin and
+// need the session URL from the Location header.
+func setWebRTCHeaders(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type")
+	c.Header("Access-Control-Expose-Headers", "Location")
+}
@@ -0,0 +1,126 @@
+package http
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang-rtmp/internal/rtmp"
+	"golang-rtmp/internal/testutil"
+	"golang-rtmp/internal/whip"
+
+	"github.com/nareix/joy4/av"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// denyPublisher rejects every WHIP publisher.
+type denyPublisher struct{}
+
+func (denyPublisher) AcceptPublish(ctx context.Context, path *rtmp.StreamPath, remoteAddr string) error {
+	return rtmp.ErrPublishDenied
+}
+
+func (denyPublisher) AbortPublish(path *rtmp.StreamPath, remoteAddr string) {}
+
+func (denyPublisher) Publish(path *rtmp.StreamPath, remoteAddr string, src av.Demuxer) error {
+	return nil
+}
+
+func postSDP(t *testing.T, router http.Handler, path, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestServer_WebRTCRequiresManager(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	w := postSDP(t, server.Router(), "/whip/live/test", "application/sdp", "v=0")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 without WebRTC, got %d", w.Code)
+	}
+}
+
+func TestServer_WHIPAndWHEP(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	manager := whip.NewManager(denyPublisher{}, sm, logrus.New())
+	t.Cleanup(func() {
+		manager.CloseAll()
+		manager.Wait()
+	})
+	server.SetWebRTC(manager)
+	router := server.Router()
+
+	if w := postSDP(t, router, "/whip/live/test", "text/plain", "v=0"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415 for a non-SDP offer, got %d", w.Code)
+	}
+	if w := postSDP(t, router, "/whip/live/test", "application/sdp", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an empty offer, got %d", w.Code)
+	}
+	if w := postSDP(t, router, "/whip/live/test", "application/sdp", "v=0"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for a denied publisher, got %d", w.Code)
+	}
+	if w := postSDP(t, router, "/whep/live/missing", "application/sdp", "v=0"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing stream, got %d", w.Code)
+	}
+
+	st := sm.CreateStream("live", "test", filepath.Join(outputDir, "live", "test"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection failed: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatalf("AddTransceiverFromKind failed: %v", err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer failed: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatalf("SetLocalDescription failed: %v", err)
+	}
+	<-gathered
+
+	w := postSDP(t, router, "/whep/live/test", "application/sdp", client.LocalDescription().SDP)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 for a WHEP offer, got %d: %s", w.Code, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/sdp" {
+		t.Errorf("Expected an application/sdp answer, got %q", contentType)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/whep/live/test/") {
+		t.Fatalf("Expected the session URL in Location, got %q", location)
+	}
+	if !strings.Contains(w.Body.String(), "H264") {
+		t.Errorf("Expected the answer to carry H.264, got %s", w.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, location, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 when ending the session, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, location, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an ended session, got %d", w.Code)
+	}
+}
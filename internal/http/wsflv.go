@@ -0,0 +1,90 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Players are embedded on other origins, as with the CORS headers on
+	// HLS and HTTP-FLV responses.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveWSFLV streams a live stream as FLV over a WebSocket, for clients
+// behind proxies that do not pass long chunked responses through.
+func (s *Server) serveWSFLV(c *gin.Context) {
+	viewer, ok := s.startFLVViewer(c, protocolWSFLV)
+	if !ok {
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied with an error status.
+		s.endFLVViewer(viewer, err)
+		return
+	}
+	defer conn.Close()
+
+	// Control frames are only processed while reading, and a failed read
+	// means the client has gone away.
+	sub := viewer.sub
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				sub.Close()
+				return
+			}
+		}
+	}()
+
+	err = s.playFLV(viewer, newWSFLVWriter(conn))
+	s.endFLVViewer(viewer, err)
+
+	conn.SetWriteDeadline(time.Now().Add(flvWriteTimeout))
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// wsFLVWriter sends everything written between flushes as one binary
+// WebSocket message; the first message holds the FLV header and codec tags.
+type wsFLVWriter struct {
+	conn  *websocket.Conn
+	buf   bytes.Buffer
+	muxer *flv.Muxer
+}
+
+func newWSFLVWriter(conn *websocket.Conn) *wsFLVWriter {
+	w := &wsFLVWriter{conn: conn}
+	w.muxer = flv.NewMuxerWriteFlusher(w)
+	return w
+}
+
+func (w *wsFLVWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *wsFLVWriter) WriteHeader(codecs []av.CodecData) error {
+	return w.muxer.WriteHeader(codecs)
+}
+
+func (w *wsFLVWriter) WritePacket(pkt av.Packet) error {
+	return w.muxer.WritePacket(pkt)
+}
+
+func (w *wsFLVWriter) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(flvWriteTimeout))
+	err := w.conn.WriteMessage(websocket.BinaryMessage, w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
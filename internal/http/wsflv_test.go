@@ -0,0 +1,156 @@
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/hooks"
+	"golang-rtmp/internal/testutil"
+
+	"github.com/gorilla/websocket"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/sirupsen/logrus"
+)
+
+// wsReader concatenates the binary messages of a WebSocket.
+type wsReader struct {
+	conn    *websocket.Conn
+	current io.Reader
+}
+
+func (r *wsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			messageType, reader, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			r.current = reader
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func TestServer_ServesWSFLV(t *testing.T) {
+	var events []string
+	var eventsMu sync.Mutex
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload hooks.Payload
+		json.NewDecoder(r.Body).Decode(&payload)
+
+		eventsMu.Lock()
+		events = append(events, string(payload.Event))
+		eventsMu.Unlock()
+
+		if payload.Event == hooks.EventPlay && payload.Args["token"] != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hookServer.Close()
+
+	server, sm, outputDir := newTestServer(t)
+	server.SetHooks(hooks.NewClient(map[hooks.Event]string{
+		hooks.EventPlay:     hookServer.URL,
+		hooks.EventPlayDone: hookServer.URL,
+	}, time.Second, 0, logrus.New()))
+	httpServer := httptest.NewServer(server.Router())
+	defer httpServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	st := sm.CreateStream("live", "ws", filepath.Join(outputDir, "live", "ws"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	// Both FLV play paths go through the on_play hook.
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"/ws/live/ws.flv", nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 from the WebSocket handshake without a token, got %v %v", resp, err)
+	}
+	if rec := doRequest(server.Router(), http.MethodGet, "/live/live/ws.flv"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 from HTTP-FLV without a token, got %d", rec.Code)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"/ws/live/missing.flv?token=secret", nil); err == nil || resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing stream, got %v %v", resp, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/live/ws.flv?token=secret", nil)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	defer conn.Close()
+	waitForSubscribers(t, st, 1)
+
+	st.WritePacket(av.Packet{Idx: 1, Data: []byte{0x21, 0x10}})
+	st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{0, 0, 0, 1, 0x65}})
+
+	demuxer := flv.NewDemuxer(&wsReader{conn: conn})
+	codecs, err := demuxer.Streams()
+	if err != nil || len(codecs) != 2 {
+		t.Fatalf("expected codec headers, got %v %v", codecs, err)
+	}
+	pkt, err := demuxer.ReadPacket()
+	if err != nil || pkt.Idx != 0 || !pkt.IsKeyFrame {
+		t.Fatalf("expected the stream to start at the keyframe, got %+v %v", pkt, err)
+	}
+
+	st.WriteTrailer()
+	if _, err := demuxer.ReadPacket(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected a normal close when the stream ends, got %v", err)
+	}
+	waitForSubscribers(t, st, 0)
+
+	// on_play_done is called in the background, for the viewer of the
+	// missing stream and the one that left.
+	testutil.WaitFor(t, "on_play_done after the viewer left", func() bool {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		done := 0
+		for _, event := range events {
+			if event == string(hooks.EventPlayDone) {
+				done++
+			}
+		}
+		return done == 2
+	})
+}
+
+func TestServer_WSFLVViewerLeaves(t *testing.T) {
+	server, sm, outputDir := newTestServer(t)
+	httpServer := httptest.NewServer(server.Router())
+	defer httpServer.Close()
+
+	st := sm.CreateStream("live", "leave", filepath.Join(outputDir, "live", "leave"))
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws/live/leave.flv", nil)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %v", err)
+	}
+	waitForSubscribers(t, st, 1)
+
+	// A viewer closing an idle stream is dropped without waiting for media.
+	conn.Close()
+	waitForSubscribers(t, st, 0)
+}
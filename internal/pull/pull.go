@@ -0,0 +1,388 @@
+package pull
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/rtmp"
+
+	"github.com/nareix/joy4/av"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrPullExists   = errors.New("pull already exists")
+	ErrPullNotFound = errors.New("pull not found")
+	ErrPullRunning  = errors.New("pull is already running")
+)
+
+const (
+	StateConnecting = "connecting"
+	StateRunning    = "running"
+	StateBackoff    = "backoff"
+	StateStopped    = "stopped"
+
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+
+	// A pull that ran at least this long reconnects without waiting for the
+	// backoff it built up earlier.
+	stableDuration = 10 * time.Second
+)
+
+// Ingester runs a pulled source through the publish pipeline until the
+// source fails or ends.
+type Ingester interface {
+	Ingest(app, stream string, src av.Demuxer) error
+}
+
+type Config struct {
+	App    string
+	Stream string
+	URL    string
+}
+
+func (c Config) ID() string {
+	return c.App + "/" + c.Stream
+}
+
+func (c Config) Validate() error {
+	if err := rtmp.ValidateStreamPath(c.App, c.Stream); err != nil {
+		return err
+	}
+	_, err := sourceKind(c.URL)
+	return err
+}
+
+type Status struct {
+	ID         string     `json:"id"`
+	App        string     `json:"app"`
+	Stream     string     `json:"stream"`
+	URL        string     `json:"url"`
+	State      string     `json:"state"`
+	Configured bool       `json:"configured"`
+	Reconnects int        `json:"reconnects"`
+	LastError  string     `json:"last_error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+}
+
+type Manager struct {
+	ingester       Ingester
+	fileDir        string
+	logger         *logrus.Logger
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pulls          map[string]*pull
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+}
+
+// NewManager creates a pull manager. Local file sources are resolved inside
+// fileDir.
+func NewManager(ingester Ingester, fileDir string, logger *logrus.Logger) *Manager {
+	return &Manager{
+		ingester:       ingester,
+		fileDir:        fileDir,
+		logger:         logger,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		pulls:          make(map[string]*pull),
+	}
+}
+
+// SetBackoff sets the delay before the first reconnect of a failed pull; it
+// doubles on every further failure up to max.
+func (m *Manager) SetBackoff(initial, max time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initialBackoff = initial
+	m.maxBackoff = max
+}
+
+// Configure registers a pull from the configuration file. It stays stopped
+// until Start is called and is kept when stopped.
+func (m *Manager) Configure(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.pulls[config.ID()]; exists {
+		return ErrPullExists
+	}
+	m.pulls[config.ID()] = &pull{config: config, configured: true, state: StateStopped}
+	return nil
+}
+
+// Add creates a pull and starts it. It is removed again when stopped.
+func (m *Manager) Add(config Config) (Status, error) {
+	if err := config.Validate(); err != nil {
+		return Status{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.pulls[config.ID()]; exists {
+		return Status{}, ErrPullExists
+	}
+	p := &pull{config: config}
+	m.pulls[config.ID()] = p
+	m.startLocked(p)
+	return p.status(), nil
+}
+
+// Start starts a configured pull that is stopped.
+func (m *Manager) Start(id string) (Status, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, exists := m.pulls[id]
+	if !exists {
+		return Status{}, ErrPullNotFound
+	}
+	if p.running() {
+		return Status{}, ErrPullRunning
+	}
+	m.startLocked(p)
+	return p.status(), nil
+}
+
+// Stop disconnects a pull, which ends its stream.
+func (m *Manager) Stop(id string) error {
+	m.mu.Lock()
+	p, exists := m.pulls[id]
+	if !exists {
+		m.mu.Unlock()
+		return ErrPullNotFound
+	}
+	if !p.configured {
+		delete(m.pulls, id)
+	}
+	m.mu.Unlock()
+
+	p.stop()
+	return nil
+}
+
+// StopAll disconnects every pull, for shutdown.
+func (m *Manager) StopAll() {
+	m.mu.Lock()
+	pulls := make([]*pull, 0, len(m.pulls))
+	for _, p := range m.pulls {
+		pulls = append(pulls, p)
+	}
+	m.mu.Unlock()
+
+	for _, p := range pulls {
+		p.stop()
+	}
+}
+
+func (m *Manager) Get(id string) (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, exists := m.pulls[id]
+	if !exists {
+		return Status{}, false
+	}
+	return p.status(), true
+}
+
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(m.pulls))
+	for _, p := range m.pulls {
+		statuses = append(statuses, p.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+	return statuses
+}
+
+// Wait blocks until every pull has stopped.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Manager) startLocked(p *pull) {
+	p.mu.Lock()
+	p.done = make(chan struct{})
+	p.state = StateConnecting
+	p.reconnects = 0
+	p.lastError = nil
+	p.mu.Unlock()
+
+	initialBackoff, maxBackoff := m.initialBackoff, m.maxBackoff
+	done := p.done
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.run(p, done, initialBackoff, maxBackoff)
+	}()
+}
+
+func (m *Manager) run(p *pull, done chan struct{}, initialBackoff, maxBackoff time.Duration) {
+	id := p.config.ID()
+	defer func() {
+		p.setState(StateStopped, nil)
+		m.logger.Infof("Stopped pulling stream %s", id)
+	}()
+
+	backoff := initialBackoff
+	for {
+		started := time.Now()
+		err := m.pullOnce(p, done)
+		if time.Since(started) >= stableDuration {
+			backoff = initialBackoff
+		}
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		p.setState(StateBackoff, err)
+		m.logger.Warnf("Pull of stream %s from %s failed: %v, retrying in %s", id, p.config.URL, err, backoff)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		p.mu.Lock()
+		p.reconnects++
+		p.mu.Unlock()
+	}
+}
+
+// pullOnce ingests the source until it fails or ends. A source that ends is
+// reconnected like a failed one.
+func (m *Manager) pullOnce(p *pull, done chan struct{}) error {
+	p.setState(StateConnecting, nil)
+
+	src, err := openSource(p.config.URL, m.fileDir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if !p.setSource(src, done) {
+		return nil
+	}
+	defer p.setSource(nil, done)
+
+	p.setState(StateRunning, nil)
+	m.logger.Infof("Pulling stream %s from %s", p.config.ID(), p.config.URL)
+
+	if err := m.ingester.Ingest(p.config.App, p.config.Stream, src); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+type pull struct {
+	config     Config
+	configured bool
+
+	state      string
+	reconnects int
+	lastError  error
+	startedAt  time.Time
+	src        av.DemuxCloser
+	done       chan struct{}
+	mu         sync.Mutex
+}
+
+func (p *pull) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state != StateStopped
+}
+
+// setSource records the source being ingested so stop can close it. It
+// reports false if the pull was stopped in the meantime.
+func (p *pull) setSource(src av.DemuxCloser, done chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-done:
+		return src == nil
+	default:
+	}
+	p.src = src
+	return true
+}
+
+func (p *pull) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done == nil {
+		return
+	}
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	if p.src != nil {
+		p.src.Close()
+		p.src = nil
+	}
+}
+
+func (p *pull) setState(state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = state
+	if err != nil {
+		p.lastError = err
+	}
+	if state == StateRunning {
+		p.startedAt = time.Now()
+	} else {
+		p.startedAt = time.Time{}
+	}
+}
+
+func (p *pull) status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := Status{
+		ID:         p.config.ID(),
+		App:        p.config.App,
+		Stream:     p.config.Stream,
+		URL:        p.config.URL,
+		State:      p.state,
+		Configured: p.configured,
+		Reconnects: p.reconnects,
+	}
+	if p.lastError != nil {
+		status.LastError = p.lastError.Error()
+	}
+	if !p.startedAt.IsZero() {
+		startedAt := p.startedAt
+		status.StartedAt = &startedAt
+	}
+	return status
+}
@@ -0,0 +1,276 @@
+package pull
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/ts"
+	"github.com/sirupsen/logrus"
+)
+
+// writeMedia writes count video packets 10ms apart with a keyframe every 5.
+func writeMedia(t *testing.T, muxer av.Muxer, start, count int) {
+	t.Helper()
+
+	for i := start; i < start+count; i++ {
+		pkt := av.Packet{Idx: 0, IsKeyFrame: i%5 == 0, Time: time.Duration(i) * 10 * time.Millisecond, Data: []byte{0, 0, 0, 2, 0x65, 0x88}}
+		if err := muxer.WritePacket(pkt); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+}
+
+func writeFLVFile(t *testing.T, path string, packets int) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create media file: %v", err)
+	}
+	defer file.Close()
+
+	muxer := flv.NewMuxer(file)
+	if err := muxer.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	writeMedia(t, muxer, 0, packets)
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatalf("failed to write trailer: %v", err)
+	}
+}
+
+type fakeIngester struct {
+	packets int
+	err     error
+
+	calls []string
+	mu    sync.Mutex
+}
+
+func (f *fakeIngester) Ingest(app, stream string, src av.Demuxer) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, app+"/"+stream)
+	f.mu.Unlock()
+
+	if _, err := src.Streams(); err != nil {
+		return err
+	}
+	for i := 0; f.packets == 0 || i < f.packets; i++ {
+		if _, err := src.ReadPacket(); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+func (f *fakeIngester) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		config Config
+		valid  bool
+	}{
+		{Config{App: "live", Stream: "cam", URL: "rtmp://camera.local/live/cam"}, true},
+		{Config{App: "live", Stream: "tv", URL: "https://cdn.example.com/tv/index.m3u8"}, true},
+		{Config{App: "live", Stream: "loop", URL: "promo/loop.mp4"}, true},
+		{Config{App: "live", Stream: "loop", URL: "promo/loop.mkv"}, false},
+		{Config{App: "live", Stream: "tv", URL: "https://cdn.example.com/tv/"}, false},
+		{Config{App: "live", Stream: "x", URL: "srt://camera.local:9000"}, false},
+		{Config{App: "live", Stream: "bad name", URL: "rtmp://camera.local/live/cam"}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.config.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid=%v", tt.config, err, tt.valid)
+		}
+	}
+}
+
+func TestFileSource_Loops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.flv")
+	writeFLVFile(t, path, 10)
+
+	src, err := newFileSource(path)
+	if err != nil {
+		t.Fatalf("newFileSource failed: %v", err)
+	}
+	defer src.Close()
+
+	if codecs, err := src.Streams(); err != nil || len(codecs) != 2 {
+		t.Fatalf("expected 2 codecs, got %d: %v", len(codecs), err)
+	}
+
+	last := time.Duration(-1)
+	for i := 0; i < 25; i++ {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket %d failed: %v", i, err)
+		}
+		if pkt.Time <= last {
+			t.Fatalf("packet %d at %s does not follow %s", i, pkt.Time, last)
+		}
+		if i == 10 && (!pkt.IsKeyFrame || pkt.Time != 90*time.Millisecond+loopGap) {
+			t.Errorf("expected second pass to start with a keyframe at %s, got %+v", 90*time.Millisecond+loopGap, pkt)
+		}
+		last = pkt.Time
+	}
+}
+
+func TestHLSSource_FollowsPlaylist(t *testing.T) {
+	// Only video, so the TS prober does not wait for AAC frames.
+	codecs := testutil.Codecs(t)[:1]
+	segments := map[string][]byte{}
+	for i := 0; i < 2; i++ {
+		var buf segmentBuffer
+		muxer := ts.NewMuxer(&buf)
+		if err := muxer.WriteHeader(codecs); err != nil {
+			t.Fatalf("failed to write header: %v", err)
+		}
+		writeMedia(t, muxer, i*10, 10)
+		segments[fmt.Sprintf("/tv/segment_%d.ts", i)] = buf.data
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tv/master.m3u8":
+			io.WriteString(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nindex.m3u8\n")
+		case "/tv/index.m3u8":
+			io.WriteString(w, "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n"+
+				"#EXTINF:0.1,\nsegment_0.ts\n#EXTINF:0.1,\nsegment_1.ts\n#EXT-X-ENDLIST\n")
+		default:
+			data, ok := segments[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	src := newHLSSource(server.URL + "/tv/master.m3u8")
+	defer src.Close()
+
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatalf("Streams failed: %v", err)
+	}
+	if len(streams) == 0 || streams[0].Type() != av.H264 {
+		t.Fatalf("expected H264 from the HLS source, got %v", streams)
+	}
+
+	packets := 0
+	for {
+		_, err := src.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		packets++
+	}
+	if packets < 15 {
+		t.Errorf("expected the packets of both segments, got %d", packets)
+	}
+}
+
+// segmentBuffer collects a TS segment; the TS muxer needs an io.Writer.
+type segmentBuffer struct {
+	data []byte
+}
+
+func (b *segmentBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+func TestManager_PullsAndReconnects(t *testing.T) {
+	fileDir := t.TempDir()
+	writeFLVFile(t, filepath.Join(fileDir, "loop.flv"), 10)
+
+	ingester := &fakeIngester{packets: 3, err: errors.New("publisher went away")}
+	manager := NewManager(ingester, fileDir, logrus.New())
+	manager.SetBackoff(5*time.Millisecond, 10*time.Millisecond)
+
+	status, err := manager.Add(Config{App: "live", Stream: "loop", URL: "loop.flv"})
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if status.ID != "live/loop" || status.Configured {
+		t.Errorf("unexpected pull status %+v", status)
+	}
+
+	if _, err := manager.Add(Config{App: "live", Stream: "loop", URL: "loop.flv"}); err != ErrPullExists {
+		t.Errorf("expected ErrPullExists, got %v", err)
+	}
+
+	testutil.WaitFor(t, "pull to reconnect", func() bool {
+		status, _ := manager.Get("live/loop")
+		return ingester.callCount() >= 2 && status.Reconnects >= 1 && status.LastError == "publisher went away"
+	})
+
+	if err := manager.Stop("live/loop"); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if _, exists := manager.Get("live/loop"); exists {
+		t.Error("expected an added pull to be removed when stopped")
+	}
+	if err := manager.Stop("live/loop"); err != ErrPullNotFound {
+		t.Errorf("expected ErrPullNotFound, got %v", err)
+	}
+	manager.Wait()
+}
+
+func TestManager_ConfiguredPull(t *testing.T) {
+	fileDir := t.TempDir()
+	writeFLVFile(t, filepath.Join(fileDir, "loop.flv"), 10)
+
+	// Reading without a limit blocks in the paced source until stopped.
+	ingester := &fakeIngester{}
+	manager := NewManager(ingester, fileDir, logrus.New())
+
+	if err := manager.Configure(Config{App: "live", Stream: "loop", URL: "loop.flv"}); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if status, _ := manager.Get("live/loop"); status.State != StateStopped || !status.Configured {
+		t.Errorf("expected a stopped configured pull, got %+v", status)
+	}
+
+	if _, err := manager.Start("live/loop"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	testutil.WaitFor(t, "pull to run", func() bool {
+		status, _ := manager.Get("live/loop")
+		return status.State == StateRunning
+	})
+	if _, err := manager.Start("live/loop"); err != ErrPullRunning {
+		t.Errorf("expected ErrPullRunning, got %v", err)
+	}
+
+	manager.Stop("live/loop")
+	manager.Wait()
+	if status, exists := manager.Get("live/loop"); !exists || status.State != StateStopped {
+		t.Errorf("expected the configured pull to be kept stopped, got %+v", status)
+	}
+
+	if _, err := manager.Start("live/missing"); err != ErrPullNotFound {
+		t.Errorf("expected ErrPullNotFound, got %v", err)
+	}
+}
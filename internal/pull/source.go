@@ -0,0 +1,388 @@
+package pull
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/hls"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/nareix/joy4/format/ts"
+)
+
+const (
+	dialTimeout = 5 * time.Second
+
+	// loopGap separates the last packet of a looping file from the first
+	// packet of its next pass.
+	loopGap = 40 * time.Millisecond
+
+	// hlsLiveEdge is how many segments from the end of a live playlist a new
+	// HLS pull starts at.
+	hlsLiveEdge = 3
+)
+
+const (
+	kindRTMP = "rtmp"
+	kindHLS  = "hls"
+	kindFile = "file"
+)
+
+// sourceKind classifies a pull URL: rtmp:// URLs, http(s):// URLs of an
+// .m3u8 playlist, or a path relative to the pull file directory.
+func sourceKind(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid pull URL %q: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "rtmp":
+		if u.Host == "" {
+			return "", fmt.Errorf("pull URL %q has no host", rawURL)
+		}
+		return kindRTMP, nil
+	case "http", "https":
+		if u.Host == "" || path.Ext(u.Path) != ".m3u8" {
+			return "", fmt.Errorf("pull URL %q must point at an .m3u8 playlist", rawURL)
+		}
+		return kindHLS, nil
+	case "":
+		switch strings.ToLower(path.Ext(rawURL)) {
+		case ".flv", ".mp4", ".ts":
+			return kindFile, nil
+		}
+		return "", fmt.Errorf("pull file %q must be an .flv, .mp4 or .ts file", rawURL)
+	default:
+		return "", fmt.Errorf("unsupported pull URL scheme %q", u.Scheme)
+	}
+}
+
+// openSource connects to a pull URL. HLS and file sources are read faster
+// than real time, so their packets are paced by timestamp.
+func openSource(rawURL, fileDir string) (av.DemuxCloser, error) {
+	kind, err := sourceKind(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case kindRTMP:
+		return rtmp.DialTimeout(rawURL, dialTimeout)
+	case kindHLS:
+		return newPacedSource(newHLSSource(rawURL)), nil
+	default:
+		src, err := newFileSource(filepath.Join(fileDir, filepath.FromSlash(path.Clean("/"+rawURL))))
+		if err != nil {
+			return nil, err
+		}
+		return newPacedSource(src), nil
+	}
+}
+
+// fileSource plays a local file in a loop, shifting every pass so
+// timestamps keep increasing.
+type fileSource struct {
+	path    string
+	demuxer av.Demuxer
+
+	// file is replaced on every pass while Close may run concurrently.
+	file   *os.File
+	closed bool
+	mu     sync.Mutex
+
+	offset     time.Duration
+	last       time.Duration
+	nextPass   bool
+	passLength int
+}
+
+func newFileSource(filePath string) (*fileSource, error) {
+	src := &fileSource{path: filePath}
+	if err := src.open(); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+func (s *fileSource) open() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		file.Close()
+		return io.ErrClosedPipe
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file = file
+
+	switch strings.ToLower(filepath.Ext(s.path)) {
+	case ".flv":
+		s.demuxer = flv.NewDemuxer(file)
+	case ".mp4":
+		s.demuxer = mp4.NewDemuxer(file)
+	default:
+		s.demuxer = ts.NewDemuxer(file)
+	}
+	return nil
+}
+
+func (s *fileSource) Streams() ([]av.CodecData, error) {
+	return s.demuxer.Streams()
+}
+
+func (s *fileSource) ReadPacket() (av.Packet, error) {
+	for {
+		pkt, err := s.demuxer.ReadPacket()
+		if err == io.EOF {
+			// A file without a single packet would otherwise loop forever.
+			if s.passLength == 0 {
+				return av.Packet{}, fmt.Errorf("pull file %s has no packets", s.path)
+			}
+			if err := s.open(); err != nil {
+				return av.Packet{}, err
+			}
+			if _, err := s.demuxer.Streams(); err != nil {
+				return av.Packet{}, err
+			}
+			s.nextPass = true
+			s.passLength = 0
+			continue
+		}
+		if err != nil {
+			return av.Packet{}, err
+		}
+
+		if s.nextPass {
+			s.offset = s.last + loopGap - pkt.Time
+			s.nextPass = false
+		}
+		pkt.Time += s.offset
+		s.last = pkt.Time
+		s.passLength++
+		return pkt, nil
+	}
+}
+
+func (s *fileSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.file.Close()
+}
+
+// hlsSource follows a remote MPEG-TS HLS playlist and demuxes its segments
+// as one continuous transport stream.
+type hlsSource struct {
+	playlistURL string
+	client      *http.Client
+	ctx         context.Context
+	cancel      context.CancelFunc
+	pr          *io.PipeReader
+	pw          *io.PipeWriter
+	demuxer     *ts.Demuxer
+}
+
+func newHLSSource(playlistURL string) *hlsSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	s := &hlsSource{
+		playlistURL: playlistURL,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		ctx:         ctx,
+		cancel:      cancel,
+		pr:          pr,
+		pw:          pw,
+		demuxer:     ts.NewDemuxer(pr),
+	}
+	go func() {
+		pw.CloseWithError(s.follow())
+	}()
+	return s
+}
+
+func (s *hlsSource) Streams() ([]av.CodecData, error) {
+	return s.demuxer.Streams()
+}
+
+func (s *hlsSource) ReadPacket() (av.Packet, error) {
+	return s.demuxer.ReadPacket()
+}
+
+func (s *hlsSource) Close() error {
+	s.cancel()
+	return s.pr.Close()
+}
+
+// follow copies every new segment into the pipe until the playlist ends.
+func (s *hlsSource) follow() error {
+	playlistURL, err := url.Parse(s.playlistURL)
+	if err != nil {
+		return err
+	}
+
+	next := -1
+	for {
+		playlist, err := s.fetchPlaylist(playlistURL)
+		if err != nil {
+			return err
+		}
+
+		// Master playlists are followed through their first variant.
+		if len(playlist.Variants) > 0 {
+			if playlistURL, err = playlistURL.Parse(playlist.Variants[0]); err != nil {
+				return err
+			}
+			continue
+		}
+		if playlist.InitSegment != "" {
+			return fmt.Errorf("fMP4 HLS sources are not supported")
+		}
+
+		if next < 0 {
+			next = playlist.MediaSequence
+			if !playlist.Ended && len(playlist.Segments) > hlsLiveEdge {
+				next += len(playlist.Segments) - hlsLiveEdge
+			}
+		}
+		for i, segment := range playlist.Segments {
+			sequence := playlist.MediaSequence + i
+			if sequence < next {
+				continue
+			}
+			segmentURL, err := playlistURL.Parse(segment)
+			if err != nil {
+				return err
+			}
+			if err := s.copySegment(segmentURL.String()); err != nil {
+				return err
+			}
+			next = sequence + 1
+		}
+
+		if playlist.Ended {
+			return io.EOF
+		}
+
+		reload := playlist.TargetDuration / 2
+		if reload < 500*time.Millisecond {
+			reload = 500 * time.Millisecond
+		}
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		case <-time.After(reload):
+		}
+	}
+}
+
+func (s *hlsSource) fetchPlaylist(playlistURL *url.URL) (*hls.Playlist, error) {
+	body, err := s.get(playlistURL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return hls.ParsePlaylist(data)
+}
+
+func (s *hlsSource) copySegment(segmentURL string) error {
+	body, err := s.get(segmentURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(s.pw, body)
+	return err
+}
+
+func (s *hlsSource) get(rawURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// pacedSource releases packets in real time and starts the stream at
+// timestamp zero.
+type pacedSource struct {
+	av.DemuxCloser
+
+	start  time.Time
+	first  time.Duration
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPacedSource(src av.DemuxCloser) *pacedSource {
+	return &pacedSource{
+		DemuxCloser: src,
+		first:       -1,
+		closed:      make(chan struct{}),
+	}
+}
+
+func (s *pacedSource) ReadPacket() (av.Packet, error) {
+	pkt, err := s.DemuxCloser.ReadPacket()
+	if err != nil {
+		return pkt, err
+	}
+
+	if s.first < 0 {
+		s.first = pkt.Time
+		s.start = time.Now()
+	}
+	pkt.Time -= s.first
+	if pkt.Time < 0 {
+		pkt.Time = 0
+	}
+
+	if wait := time.Until(s.start.Add(pkt.Time)); wait > 0 {
+		select {
+		case <-s.closed:
+			return av.Packet{}, io.ErrClosedPipe
+		case <-time.After(wait):
+		}
+	}
+	return pkt, nil
+}
+
+func (s *pacedSource) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return s.DemuxCloser.Close()
+}
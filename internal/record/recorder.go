@@ -0,0 +1,355 @@
+package record
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/stream"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultPathTemplate = "{app}/{stream}/{start_time}.mp4"
+
+	// Recorders read from a stream subscription like players, with a deeper
+	// queue so a slow disk does not immediately drop them.
+	queueSize       = 4096
+	startTimeLayout = "20060102-150405"
+)
+
+type Config struct {
+	PathTemplate string
+	MaxDuration  time.Duration
+	MaxSize      int64
+}
+
+// Validate checks the path template; its extension selects the container.
+func (c Config) Validate() error {
+	_, err := formatOf(c.pathTemplate())
+	return err
+}
+
+func (c Config) pathTemplate() string {
+	if c.PathTemplate == "" {
+		return DefaultPathTemplate
+	}
+	return c.PathTemplate
+}
+
+func formatOf(template string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(template)); ext {
+	case ".flv", ".mp4":
+		return ext[1:], nil
+	default:
+		return "", fmt.Errorf("recording path %q must end in .flv or .mp4", template)
+	}
+}
+
+type Recording struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Active     bool      `json:"active"`
+}
+
+type Manager struct {
+	dir    string
+	logger *logrus.Logger
+	active map[string]struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+}
+
+func NewManager(dir string, logger *logrus.Logger) *Manager {
+	return &Manager{
+		dir:    dir,
+		logger: logger,
+		active: make(map[string]struct{}),
+	}
+}
+
+func (m *Manager) Dir() string {
+	return m.dir
+}
+
+// Record subscribes to the stream and writes it to disk until the stream
+// ends. It should be called before the stream's header is written so the
+// recording starts with the first keyframe.
+func (m *Manager) Record(s *stream.Stream, config Config) error {
+	format, err := formatOf(config.pathTemplate())
+	if err != nil {
+		return err
+	}
+
+	r := &recorder{
+		manager: m,
+		stream:  s,
+		config:  config,
+		format:  format,
+		sub:     s.Subscribe("recorder", queueSize),
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		r.run()
+	}()
+	return nil
+}
+
+// Wait blocks until every recorder has finalized its file.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+// List returns every recording under the recording directory, newest first.
+func (m *Manager) List() ([]Recording, error) {
+	m.mu.Lock()
+	active := make(map[string]struct{}, len(m.active))
+	for path := range m.active {
+		active[path] = struct{}{}
+	}
+	m.mu.Unlock()
+
+	recordings := []Recording{}
+	err := filepath.Walk(m.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == m.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if _, err := formatOf(path); err != nil {
+			return nil
+		}
+
+		rel, err := filepath.Rel(m.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		_, isActive := active[rel]
+
+		recordings = append(recordings, Recording{
+			Path:       rel,
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime(),
+			Active:     isActive,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].ModifiedAt.After(recordings[j].ModifiedAt)
+	})
+	return recordings, nil
+}
+
+// FilePath resolves a path from List to a file inside the recording
+// directory, rejecting anything that is not a recording.
+func (m *Manager) FilePath(rel string) (string, error) {
+	clean := path.Clean("/" + rel)
+	if _, err := formatOf(clean); err != nil {
+		return "", err
+	}
+	return filepath.Join(m.dir, filepath.FromSlash(clean)), nil
+}
+
+func (m *Manager) setActive(path string, active bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if active {
+		m.active[path] = struct{}{}
+	} else {
+		delete(m.active, path)
+	}
+}
+
+type recorder struct {
+	manager *Manager
+	stream  *stream.Stream
+	config  Config
+	format  string
+	sub     *stream.Subscriber
+
+	codecs   []av.CodecData
+	videoIdx int
+
+	file      *os.File
+	path      string
+	muxer     av.Muxer
+	fileStart time.Duration
+}
+
+func (r *recorder) run() {
+	defer r.sub.Close()
+	logger := r.manager.logger
+
+	codecs, err := r.sub.Streams()
+	if err != nil {
+		return
+	}
+	r.codecs = codecs
+	r.videoIdx = -1
+	for i, codec := range codecs {
+		if codec.Type().IsVideo() {
+			r.videoIdx = i
+			break
+		}
+	}
+
+	for {
+		pkt, err := r.sub.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("Recording of stream %s stopped: %v", r.stream.ID, err)
+			}
+			break
+		}
+
+		if err := r.writePacket(pkt); err != nil {
+			logger.Errorf("Recording of stream %s stopped: %v", r.stream.ID, err)
+			break
+		}
+	}
+
+	if err := r.closeFile(); err != nil {
+		logger.Errorf("Failed to finalize recording %s: %v", r.path, err)
+	}
+}
+
+func (r *recorder) writePacket(pkt av.Packet) error {
+	boundary := r.videoIdx < 0 || (int(pkt.Idx) == r.videoIdx && pkt.IsKeyFrame)
+
+	if r.file == nil {
+		// Every file has to start on a keyframe to be playable on its own.
+		if !boundary {
+			return nil
+		}
+		if err := r.openFile(pkt.Time); err != nil {
+			return err
+		}
+	} else if boundary && r.shouldRotate(pkt.Time) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+		if err := r.openFile(pkt.Time); err != nil {
+			return err
+		}
+	}
+
+	pkt.Time -= r.fileStart
+	if pkt.Time < 0 {
+		pkt.Time = 0
+	}
+	return r.muxer.WritePacket(pkt)
+}
+
+func (r *recorder) shouldRotate(now time.Duration) bool {
+	if r.config.MaxDuration > 0 && now-r.fileStart >= r.config.MaxDuration {
+		return true
+	}
+	if r.config.MaxSize > 0 {
+		if size, err := r.file.Seek(0, io.SeekCurrent); err == nil && size >= r.config.MaxSize {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recorder) openFile(start time.Duration) error {
+	rel := expandTemplate(r.config.pathTemplate(), r.stream, time.Now())
+	fullPath := filepath.Join(r.manager.dir, filepath.FromSlash(rel))
+	if !strings.HasPrefix(fullPath, filepath.Clean(r.manager.dir)+string(filepath.Separator)) {
+		return fmt.Errorf("recording path %q escapes the recording directory", rel)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	file, err := createUnique(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	var muxer av.Muxer
+	if r.format == "mp4" {
+		muxer = mp4.NewMuxer(file)
+	} else {
+		muxer = flv.NewMuxer(file)
+	}
+	if err := muxer.WriteHeader(r.codecs); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	rel, _ = filepath.Rel(r.manager.dir, file.Name())
+	r.file = file
+	r.path = filepath.ToSlash(rel)
+	r.muxer = muxer
+	r.fileStart = start
+	r.manager.setActive(r.path, true)
+	r.manager.logger.Infof("Recording stream %s to %s", r.stream.ID, r.path)
+	return nil
+}
+
+func (r *recorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.muxer.WriteTrailer()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.manager.setActive(r.path, false)
+	r.file = nil
+	r.muxer = nil
+	return err
+}
+
+// createUnique opens path for writing, adding a numeric suffix when a file
+// with the same start time already exists.
+func createUnique(path string) (*os.File, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; ; i++ {
+		candidate := path
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		file, err := os.OpenFile(candidate, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return file, err
+	}
+}
+
+func expandTemplate(template string, s *stream.Stream, startTime time.Time) string {
+	return strings.NewReplacer(
+		"{app}", s.AppName,
+		"{stream}", s.StreamName,
+		"{start_time}", startTime.UTC().Format(startTimeLayout),
+	).Replace(template)
+}
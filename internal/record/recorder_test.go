@@ -0,0 +1,144 @@
+package record
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/mp4"
+	"github.com/sirupsen/logrus"
+)
+
+// recordStream publishes seconds of 25fps video with a keyframe every second
+// plus audio, then ends the stream and waits for the recorder.
+func recordStream(t *testing.T, config Config, seconds int) *Manager {
+	t.Helper()
+
+	manager := NewManager(t.TempDir(), logrus.New())
+	sm := stream.NewStreamManager(logrus.New())
+	st := sm.CreateStream("live", "test", t.TempDir())
+
+	if err := manager.Record(st, config); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := st.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	frame := 40 * time.Millisecond
+	for ts := time.Duration(0); ts < time.Duration(seconds)*time.Second; ts += frame {
+		video := av.Packet{Idx: 0, IsKeyFrame: ts%time.Second == 0, Time: ts, Data: []byte{0, 0, 0, 2, 0x65, 0x88}}
+		if err := st.WritePacket(video); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		if err := st.WritePacket(av.Packet{Idx: 1, Time: ts, Data: []byte{0x21, 0x10}}); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	st.WriteTrailer()
+	manager.Wait()
+	return manager
+}
+
+func TestRecorder_RotatesFLVByDuration(t *testing.T) {
+	manager := recordStream(t, Config{PathTemplate: "{app}/{stream}/{start_time}.flv", MaxDuration: 2 * time.Second}, 5)
+
+	recordings, err := manager.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(recordings) != 3 {
+		t.Fatalf("expected 3 recordings, got %+v", recordings)
+	}
+
+	for _, recording := range recordings {
+		if !strings.HasPrefix(recording.Path, "live/test/") || !strings.HasSuffix(recording.Path, ".flv") {
+			t.Errorf("unexpected recording path %s", recording.Path)
+		}
+		if recording.Active {
+			t.Errorf("expected %s to be finished", recording.Path)
+		}
+
+		file, err := os.Open(filepath.Join(manager.Dir(), recording.Path))
+		if err != nil {
+			t.Fatalf("failed to open recording: %v", err)
+		}
+		demuxer := flv.NewDemuxer(file)
+		pkt, err := demuxer.ReadPacket()
+		file.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", recording.Path, err)
+		}
+		if pkt.Idx != 0 || !pkt.IsKeyFrame || pkt.Time != 0 {
+			t.Errorf("expected %s to start with a keyframe at 0, got %+v", recording.Path, pkt)
+		}
+	}
+}
+
+func TestRecorder_RotatesMP4BySize(t *testing.T) {
+	manager := recordStream(t, Config{MaxSize: 1}, 3)
+
+	recordings, err := manager.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(recordings) != 3 {
+		t.Fatalf("expected one recording per keyframe, got %+v", recordings)
+	}
+
+	file, err := os.Open(filepath.Join(manager.Dir(), recordings[0].Path))
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	streams, err := mp4.NewDemuxer(file).Streams()
+	if err != nil {
+		t.Fatalf("failed to read MP4 recording: %v", err)
+	}
+	if len(streams) != 2 || streams[0].Type() != av.H264 || streams[1].Type() != av.AAC {
+		t.Errorf("expected H.264 and AAC tracks, got %v", streams)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	if err := (Config{}).Validate(); err != nil {
+		t.Errorf("expected default template to be valid: %v", err)
+	}
+	if err := (Config{PathTemplate: "{app}/{stream}.mkv"}).Validate(); err == nil {
+		t.Error("expected error for unsupported container")
+	}
+}
+
+func TestManager_FilePath(t *testing.T) {
+	manager := NewManager("/var/recordings", logrus.New())
+
+	path, err := manager.FilePath("../../live/test/a.mp4")
+	if err != nil {
+		t.Fatalf("FilePath failed: %v", err)
+	}
+	if path != filepath.Join("/var/recordings", "live", "test", "a.mp4") {
+		t.Errorf("expected path inside the recording directory, got %s", path)
+	}
+
+	if _, err := manager.FilePath("../../etc/passwd"); err == nil {
+		t.Error("expected error for non-recording file")
+	}
+}
+
+func TestManager_ListMissingDirectory(t *testing.T) {
+	manager := NewManager(filepath.Join(t.TempDir(), "missing"), logrus.New())
+
+	recordings, err := manager.List()
+	if err != nil || len(recordings) != 0 {
+		t.Errorf("expected no recordings, got %v, %v", recordings, err)
+	}
+}
@@ -0,0 +1,381 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/stream"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrPushExists   = errors.New("push target already exists")
+	ErrPushNotFound = errors.New("push target not found")
+)
+
+const (
+	StateConnecting = "connecting"
+	StatePushing    = "pushing"
+	StateBackoff    = "backoff"
+
+	// Pushes read from a stream subscription like players; a deeper queue
+	// rides out short upstream stalls before the push is dropped.
+	queueSize = 1024
+
+	dialTimeout           = 5 * time.Second
+	writeTimeout          = 10 * time.Second
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+type Status struct {
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	State       string     `json:"state"`
+	Reconnects  int        `json:"reconnects"`
+	LastError   string     `json:"last_error,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+}
+
+// ValidateURL checks a push target template, which may contain the {app}
+// and {stream} placeholders.
+func ValidateURL(template string) error {
+	u, err := url.Parse(expandURL(template, "app", "stream"))
+	if err != nil {
+		return fmt.Errorf("invalid push URL %q: %w", template, err)
+	}
+	if u.Scheme != "rtmp" || u.Host == "" {
+		return fmt.Errorf("push URL %q must be an rtmp:// URL", template)
+	}
+	return nil
+}
+
+func expandURL(template, app, streamName string) string {
+	return strings.NewReplacer("{app}", app, "{stream}", streamName).Replace(template)
+}
+
+type Manager struct {
+	logger         *logrus.Logger
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	pushes         map[string][]*push
+	nextID         int
+	wg             sync.WaitGroup
+	mu             sync.Mutex
+}
+
+func NewManager(logger *logrus.Logger) *Manager {
+	return &Manager{
+		logger:         logger,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		pushes:         make(map[string][]*push),
+	}
+}
+
+// SetBackoff sets the delay before the first reconnect of a failed push; it
+// doubles on every further failure up to max.
+func (m *Manager) SetBackoff(initial, max time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initialBackoff = initial
+	m.maxBackoff = max
+}
+
+// Start pushes the stream to every configured target.
+func (m *Manager) Start(s *stream.Stream, templates []string) {
+	for _, template := range templates {
+		if _, err := m.Add(s, template); err != nil {
+			m.logger.Errorf("Failed to push stream %s to %s: %v", s.ID, template, err)
+		}
+	}
+}
+
+// Add starts pushing the stream to a target until the stream ends or the
+// target is removed.
+func (m *Manager) Add(s *stream.Stream, template string) (Status, error) {
+	if err := ValidateURL(template); err != nil {
+		return Status{}, err
+	}
+	target := expandURL(template, s.AppName, s.StreamName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.pushes[s.ID] {
+		if existing.url == target {
+			return Status{}, ErrPushExists
+		}
+	}
+
+	m.nextID++
+	p := &push{
+		id:             strconv.Itoa(m.nextID),
+		url:            target,
+		stream:         s,
+		manager:        m,
+		initialBackoff: m.initialBackoff,
+		maxBackoff:     m.maxBackoff,
+		state:          StateConnecting,
+		stop:           make(chan struct{}),
+	}
+	m.pushes[s.ID] = append(m.pushes[s.ID], p)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		p.run()
+		m.forget(p)
+	}()
+
+	return p.status(), nil
+}
+
+// Remove stops a push and disconnects it from its target.
+func (m *Manager) Remove(streamID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.pushes[streamID] {
+		if p.id == id {
+			m.forgetLocked(p)
+			p.close()
+			return nil
+		}
+	}
+	return ErrPushNotFound
+}
+
+// StopStream stops every push of a stream, including ones waiting to
+// reconnect.
+func (m *Manager) StopStream(streamID string) {
+	m.mu.Lock()
+	pushes := m.pushes[streamID]
+	delete(m.pushes, streamID)
+	m.mu.Unlock()
+
+	for _, p := range pushes {
+		p.close()
+	}
+}
+
+func (m *Manager) List(streamID string) []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := make([]Status, 0, len(m.pushes[streamID]))
+	for _, p := range m.pushes[streamID] {
+		statuses = append(statuses, p.status())
+	}
+	return statuses
+}
+
+// Wait blocks until every push has ended.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Manager) forget(p *push) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.forgetLocked(p)
+}
+
+func (m *Manager) forgetLocked(p *push) {
+	pushes := m.pushes[p.stream.ID]
+	for i, existing := range pushes {
+		if existing == p {
+			pushes = append(pushes[:i:i], pushes[i+1:]...)
+			break
+		}
+	}
+	if len(pushes) == 0 {
+		delete(m.pushes, p.stream.ID)
+	} else {
+		m.pushes[p.stream.ID] = pushes
+	}
+}
+
+type push struct {
+	id             string
+	url            string
+	stream         *stream.Stream
+	manager        *Manager
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	state       string
+	reconnects  int
+	lastError   error
+	connectedAt time.Time
+	mu          sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (p *push) run() {
+	logger := p.manager.logger
+	backoff := p.initialBackoff
+
+	for {
+		connected, err := p.pushOnce()
+		if err == nil {
+			logger.Infof("Stopped pushing stream %s to %s", p.stream.ID, p.url)
+			return
+		}
+		if connected {
+			backoff = p.initialBackoff
+		}
+
+		p.setState(StateBackoff, err)
+		logger.Warnf("Push of stream %s to %s failed: %v, retrying in %s", p.stream.ID, p.url, err, backoff)
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+
+		p.mu.Lock()
+		p.reconnects++
+		p.mu.Unlock()
+	}
+}
+
+// pushOnce sends the stream over one upstream connection. It returns nil
+// once the stream has ended or the push was removed, and reports whether the
+// upstream accepted the stream before failing.
+func (p *push) pushOnce() (bool, error) {
+	p.setState(StateConnecting, nil)
+
+	// Every connection starts from the stream's GOP cache so the upstream
+	// receives a keyframe first.
+	sub := p.stream.Subscribe("push-"+p.id, queueSize)
+	defer sub.Close()
+
+	go func() {
+		select {
+		case <-p.stop:
+			sub.Close()
+		case <-sub.Done():
+		}
+	}()
+
+	codecs, err := sub.Streams()
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+
+	conn, err := rtmp.DialTimeout(p.url, dialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.NetConn().SetDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteHeader(codecs); err != nil {
+		return false, err
+	}
+	conn.NetConn().SetReadDeadline(time.Time{})
+
+	p.mu.Lock()
+	p.state = StatePushing
+	p.lastError = nil
+	p.connectedAt = time.Now()
+	p.mu.Unlock()
+	p.manager.logger.Infof("Pushing stream %s to %s", p.stream.ID, p.url)
+
+	start := time.Duration(-1)
+	for {
+		pkt, err := sub.ReadPacket()
+		if err == io.EOF {
+			conn.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout))
+			conn.WriteTrailer()
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+
+		pkt = rebase(pkt, &start)
+		conn.NetConn().SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := conn.WritePacket(pkt); err != nil {
+			return true, err
+		}
+		// joy4 buffers RTMP writes until WriteTrailer, so flush whenever the
+		// push has caught up with the stream.
+		if sub.Buffered() == 0 {
+			if err := conn.WriteTrailer(); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// rebase makes every upstream connection start at timestamp zero.
+func rebase(pkt av.Packet, start *time.Duration) av.Packet {
+	if *start < 0 {
+		*start = pkt.Time
+	}
+	pkt.Time -= *start
+	if pkt.Time < 0 {
+		pkt.Time = 0
+	}
+	return pkt
+}
+
+func (p *push) setState(state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = state
+	if err != nil {
+		p.lastError = err
+	}
+	if state != StatePushing {
+		p.connectedAt = time.Time{}
+	}
+}
+
+func (p *push) status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := Status{
+		ID:         p.id,
+		URL:        p.url,
+		State:      p.state,
+		Reconnects: p.reconnects,
+	}
+	if p.lastError != nil {
+		status.LastError = p.lastError.Error()
+	}
+	if !p.connectedAt.IsZero() {
+		connectedAt := p.connectedAt
+		status.ConnectedAt = &connectedAt
+	}
+	return status
+}
+
+func (p *push) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
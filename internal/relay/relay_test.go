@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/sirupsen/logrus"
+)
+
+type testCodec struct {
+	codecType av.CodecType
+}
+
+func (c testCodec) Type() av.CodecType {
+	return c.codecType
+}
+
+// closedAddr returns an address nothing listens on, so pushes to it fail.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestStream(t *testing.T) *stream.Stream {
+	t.Helper()
+
+	sm := stream.NewStreamManager(logrus.New())
+	st := sm.CreateStream("live", "test", t.TempDir())
+	st.WriteHeader([]av.CodecData{testCodec{av.H264}})
+	st.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true})
+	return st
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"rtmp://example.com/live/{stream}", true},
+		{"rtmp://example.com:1936/{app}/{stream}?key=abc", true},
+		{"http://example.com/live/{stream}", false},
+		{"rtmp:///live/{stream}", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("ValidateURL(%q) = %v, expected valid=%v", tt.url, err, tt.valid)
+		}
+	}
+}
+
+func TestManager_ReconnectsWithBackoff(t *testing.T) {
+	manager := NewManager(logrus.New())
+	manager.SetBackoff(5*time.Millisecond, 20*time.Millisecond)
+
+	st := newTestStream(t)
+	addr := closedAddr(t)
+	target := "rtmp://" + addr + "/{app}/{stream}"
+
+	status, err := manager.Add(st, target)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if status.ID == "" || status.URL != "rtmp://"+addr+"/live/test" {
+		t.Errorf("unexpected push status %+v", status)
+	}
+
+	if _, err := manager.Add(st, target); err != ErrPushExists {
+		t.Errorf("expected ErrPushExists for a duplicate target, got %v", err)
+	}
+
+	testutil.WaitFor(t, "push to reconnect", func() bool {
+		statuses := manager.List(st.ID)
+		return len(statuses) == 1 && statuses[0].Reconnects >= 2 && statuses[0].LastError != ""
+	})
+
+	if err := manager.Remove(st.ID, "missing"); err != ErrPushNotFound {
+		t.Errorf("expected ErrPushNotFound, got %v", err)
+	}
+	if err := manager.Remove(st.ID, status.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if statuses := manager.List(st.ID); len(statuses) != 0 {
+		t.Errorf("expected no pushes after Remove, got %+v", statuses)
+	}
+
+	manager.Wait()
+}
+
+func TestManager_PushEndsWithStream(t *testing.T) {
+	manager := NewManager(logrus.New())
+	manager.SetBackoff(5*time.Millisecond, 5*time.Millisecond)
+
+	st := newTestStream(t)
+	manager.Start(st, []string{"rtmp://" + closedAddr(t) + "/live/{stream}", "not a url"})
+
+	if statuses := manager.List(st.ID); len(statuses) != 1 {
+		t.Fatalf("expected only the valid target to be pushed, got %+v", statuses)
+	}
+
+	st.WriteTrailer()
+	testutil.WaitFor(t, "push to end with the stream", func() bool {
+		return len(manager.List(st.ID)) == 0
+	})
+	manager.Wait()
+}
@@ -0,0 +1,119 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrPublishDenied = errors.New("publish denied")
+
+type PublishRequest struct {
+	App        string
+	Stream     string
+	Query      url.Values
+	RemoteAddr string
+}
+
+type PublishAuthorizer interface {
+	AuthorizePublish(req *PublishRequest) error
+}
+
+func NewPublishAuthorizer(mode string, keys []string, secret string) (PublishAuthorizer, error) {
+	switch mode {
+	case "", "none":
+		return nil, nil
+	case "static":
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("static publish auth requires at least one key")
+		}
+		return NewStaticKeyAuthorizer(keys), nil
+	case "hmac":
+		if secret == "" {
+			return nil, fmt.Errorf("hmac publish auth requires a secret")
+		}
+		return NewHMACAuthorizer(secret), nil
+	default:
+		return nil, fmt.Errorf("unknown publish auth mode: %s", mode)
+	}
+}
+
+type StaticKeyAuthorizer struct {
+	keys map[string]struct{}
+}
+
+func NewStaticKeyAuthorizer(keys []string) *StaticKeyAuthorizer {
+	a := &StaticKeyAuthorizer{keys: make(map[string]struct{}, len(keys))}
+	for _, key := range keys {
+		a.keys[key] = struct{}{}
+	}
+	return a
+}
+
+func (a *StaticKeyAuthorizer) AuthorizePublish(req *PublishRequest) error {
+	key := streamKey(req.Query)
+	if key == "" {
+		return fmt.Errorf("%w: missing key parameter", ErrPublishDenied)
+	}
+	if _, ok := a.keys[key]; !ok {
+		return fmt.Errorf("%w: invalid stream key", ErrPublishDenied)
+	}
+	return nil
+}
+
+// streamKey is the key a publisher authenticates with, sent as the key
+// parameter. The stream name is never taken as the key, since it is public
+// in playback URLs.
+func streamKey(query url.Values) string {
+	return query.Get("key")
+}
+
+type HMACAuthorizer struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewHMACAuthorizer(secret string) *HMACAuthorizer {
+	return &HMACAuthorizer{
+		secret: []byte(secret),
+		now:    time.Now,
+	}
+}
+
+func (a *HMACAuthorizer) AuthorizePublish(req *PublishRequest) error {
+	expiresParam := req.Query.Get("expires")
+	sign := req.Query.Get("sign")
+	if expiresParam == "" || sign == "" {
+		return fmt.Errorf("%w: missing expires or sign parameter", ErrPublishDenied)
+	}
+
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid expires parameter", ErrPublishDenied)
+	}
+
+	if a.now().Unix() > expires {
+		return fmt.Errorf("%w: key expired", ErrPublishDenied)
+	}
+
+	expected := signPublishKey(a.secret, req.App, req.Stream, expires)
+	if !hmac.Equal([]byte(expected), []byte(sign)) {
+		return fmt.Errorf("%w: invalid signature", ErrPublishDenied)
+	}
+	return nil
+}
+
+func SignPublishKey(secret, app, stream string, expires time.Time) string {
+	return signPublishKey([]byte(secret), app, stream, expires.Unix())
+}
+
+func signPublishKey(secret []byte, app, stream string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s/%s:%d", app, stream, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
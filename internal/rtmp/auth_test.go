@@ -0,0 +1,99 @@
+package rtmp
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStaticKeyAuthorizer(t *testing.T) {
+	auth := NewStaticKeyAuthorizer([]string{"secret-key"})
+
+	tests := []struct {
+		name    string
+		stream  string
+		query   url.Values
+		allowed bool
+	}{
+		{name: "key as stream name", stream: "secret-key", query: url.Values{}, allowed: false},
+		{name: "key as query parameter", stream: "mystream", query: url.Values{"key": {"secret-key"}}, allowed: true},
+		{name: "unknown key", stream: "mystream", query: url.Values{"key": {"wrong"}}, allowed: false},
+		{name: "no key", stream: "mystream", query: url.Values{}, allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := auth.AuthorizePublish(&PublishRequest{App: "live", Stream: tt.stream, Query: tt.query})
+			if tt.allowed && err != nil {
+				t.Errorf("expected publish to be allowed, got %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrPublishDenied) {
+				t.Errorf("expected ErrPublishDenied, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHMACAuthorizer(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	auth := NewHMACAuthorizer("s3cret")
+	auth.now = func() time.Time { return now }
+
+	expires := now.Add(time.Hour)
+	validSign := SignPublishKey("s3cret", "live", "mystream", expires)
+
+	tests := []struct {
+		name    string
+		stream  string
+		expires string
+		sign    string
+		allowed bool
+	}{
+		{name: "valid signature", stream: "mystream", expires: strconv.FormatInt(expires.Unix(), 10), sign: validSign, allowed: true},
+		{name: "signature for another stream", stream: "other", expires: strconv.FormatInt(expires.Unix(), 10), sign: validSign, allowed: false},
+		{name: "tampered expiry", stream: "mystream", expires: strconv.FormatInt(expires.Unix()+1, 10), sign: validSign, allowed: false},
+		{name: "expired key", stream: "mystream", expires: strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), sign: SignPublishKey("s3cret", "live", "mystream", now.Add(-time.Minute)), allowed: false},
+		{name: "missing signature", stream: "mystream", expires: strconv.FormatInt(expires.Unix(), 10), allowed: false},
+		{name: "invalid expires", stream: "mystream", expires: "soon", sign: validSign, allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			if tt.expires != "" {
+				query.Set("expires", tt.expires)
+			}
+			if tt.sign != "" {
+				query.Set("sign", tt.sign)
+			}
+
+			err := auth.AuthorizePublish(&PublishRequest{App: "live", Stream: tt.stream, Query: query})
+			if tt.allowed && err != nil {
+				t.Errorf("expected publish to be allowed, got %v", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrPublishDenied) {
+				t.Errorf("expected ErrPublishDenied, got %v", err)
+			}
+		})
+	}
+}
+
+func TestNewPublishAuthorizer(t *testing.T) {
+	if auth, err := NewPublishAuthorizer("none", nil, ""); err != nil || auth != nil {
+		t.Errorf("expected no authorizer for mode none, got %v, %v", auth, err)
+	}
+
+	if _, err := NewPublishAuthorizer("static", nil, ""); err == nil {
+		t.Error("expected error for static mode without keys")
+	}
+
+	if _, err := NewPublishAuthorizer("hmac", nil, ""); err == nil {
+		t.Error("expected error for hmac mode without secret")
+	}
+
+	if _, err := NewPublishAuthorizer("ldap", nil, ""); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+}
@@ -0,0 +1,174 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBanned      = errors.New("banned")
+	ErrBanNotFound = errors.New("ban not found")
+)
+
+const (
+	// BanKey bans a stream key from publishing, whether it is sent as the
+	// key parameter or as the stream name.
+	BanKey = "key"
+	// BanIP bans a client IP from publishing and playing.
+	BanIP = "ip"
+)
+
+type Ban struct {
+	Type      string     `json:"type"`
+	Value     string     `json:"value"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+type banKey struct {
+	banType string
+	value   string
+}
+
+// BanList holds the stream keys and client IPs that are refused until their
+// ban expires or is removed.
+type BanList struct {
+	bans map[banKey]Ban
+	now  func() time.Time
+	mu   sync.Mutex
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		bans: make(map[banKey]Ban),
+		now:  time.Now,
+	}
+}
+
+// Add bans a stream key or IP for ttl, or until it is removed if ttl is zero.
+// Banning a value again replaces its ban.
+func (l *BanList) Add(banType, value string, ttl time.Duration) (Ban, error) {
+	value, err := normalizeBan(banType, value)
+	if err != nil {
+		return Ban{}, err
+	}
+	if ttl < 0 {
+		return Ban{}, fmt.Errorf("ban TTL must not be negative")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ban := Ban{Type: banType, Value: value, CreatedAt: l.now()}
+	if ttl > 0 {
+		expiresAt := ban.CreatedAt.Add(ttl)
+		ban.ExpiresAt = &expiresAt
+	}
+	l.bans[banKey{banType, value}] = ban
+	return ban, nil
+}
+
+func (l *BanList) Remove(banType, value string) error {
+	value, err := normalizeBan(banType, value)
+	if err != nil {
+		return ErrBanNotFound
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := banKey{banType, value}
+	ban, exists := l.bans[key]
+	if !exists || ban.expired(l.now()) {
+		delete(l.bans, key)
+		return ErrBanNotFound
+	}
+	delete(l.bans, key)
+	return nil
+}
+
+func (l *BanList) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bans := make([]Ban, 0, len(l.bans))
+	for key, ban := range l.bans {
+		if ban.expired(now) {
+			delete(l.bans, key)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Type != bans[j].Type {
+			return bans[i].Type < bans[j].Type
+		}
+		return bans[i].Value < bans[j].Value
+	})
+	return bans
+}
+
+// CheckKey returns an error wrapping ErrBanned if the stream key is banned.
+func (l *BanList) CheckKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	return l.check(BanKey, key)
+}
+
+// CheckAddr returns an error wrapping ErrBanned if the IP of a host:port
+// remote address is banned.
+func (l *BanList) CheckAddr(remoteAddr string) error {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	return l.check(BanIP, ip.String())
+}
+
+func (l *BanList) check(banType, value string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := banKey{banType, value}
+	ban, exists := l.bans[key]
+	if !exists {
+		return nil
+	}
+	if ban.expired(l.now()) {
+		delete(l.bans, key)
+		return nil
+	}
+	return fmt.Errorf("%w: %s %s", ErrBanned, banType, value)
+}
+
+func normalizeBan(banType, value string) (string, error) {
+	switch banType {
+	case BanKey:
+		if value == "" {
+			return "", fmt.Errorf("stream key must not be empty")
+		}
+		return value, nil
+	case BanIP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP address %q", value)
+		}
+		return ip.String(), nil
+	default:
+		return "", fmt.Errorf("unknown ban type %q, expected %q or %q", banType, BanKey, BanIP)
+	}
+}
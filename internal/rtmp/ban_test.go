@@ -0,0 +1,62 @@
+package rtmp
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	bans := NewBanList()
+	now := time.Unix(1700000000, 0)
+	bans.now = func() time.Time { return now }
+
+	if _, err := bans.Add("user", "x", 0); err == nil {
+		t.Error("expected an error for an unknown ban type")
+	}
+	if _, err := bans.Add(BanIP, "not-an-ip", 0); err == nil {
+		t.Error("expected an error for an invalid IP")
+	}
+
+	ban, err := bans.Add(BanIP, "::ffff:10.0.0.1", time.Minute)
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if ban.Value != "10.0.0.1" || ban.ExpiresAt == nil || !ban.ExpiresAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected ban: %+v", ban)
+	}
+	if _, err := bans.Add(BanKey, "rogue", 0); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	if err := bans.CheckAddr("10.0.0.1:4000"); !errors.Is(err, ErrBanned) {
+		t.Errorf("expected the IP to be banned, got %v", err)
+	}
+	if err := bans.CheckAddr("10.0.0.2:4000"); err != nil {
+		t.Errorf("expected another IP to be allowed, got %v", err)
+	}
+	if err := bans.CheckKey("rogue"); !errors.Is(err, ErrBanned) {
+		t.Errorf("expected the key to be banned, got %v", err)
+	}
+	if list := bans.List(); len(list) != 2 || list[0].Type != BanIP || list[1].Type != BanKey {
+		t.Errorf("unexpected ban list: %+v", list)
+	}
+
+	now = now.Add(time.Minute)
+	if err := bans.CheckAddr("10.0.0.1:4000"); err != nil {
+		t.Errorf("expected the IP ban to expire, got %v", err)
+	}
+	if list := bans.List(); len(list) != 1 || list[0].Value != "rogue" {
+		t.Errorf("expected only the key ban to remain, got %+v", list)
+	}
+
+	if err := bans.Remove(BanKey, "rogue"); err != nil {
+		t.Errorf("Remove failed: %v", err)
+	}
+	if err := bans.Remove(BanKey, "rogue"); !errors.Is(err, ErrBanNotFound) {
+		t.Errorf("expected ErrBanNotFound, got %v", err)
+	}
+	if err := bans.CheckKey("rogue"); err != nil {
+		t.Errorf("expected the key to be allowed after removal, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	defaultAppName    = "live"
+	defaultStreamName = "stream"
+	maxNameLength     = 128
+)
+
+var ErrInvalidStreamPath = errors.New("invalid stream path")
+
+type StreamPath struct {
+	App    string
+	Stream string
+	Query  url.Values
+}
+
+func (p *StreamPath) ID() string {
+	return fmt.Sprintf("%s/%s", p.App, p.Stream)
+}
+
+func ParseStreamPath(u *url.URL) (*StreamPath, error) {
+	var segments []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	rawQuery := u.RawQuery
+	p := &StreamPath{}
+
+	switch len(segments) {
+	case 0:
+		p.App = defaultAppName
+	case 1:
+		p.App = segments[0]
+		p.Stream, rawQuery = splitLegacyStreamName(rawQuery)
+	default:
+		p.App = strings.Join(segments[:len(segments)-1], "/")
+		p.Stream = segments[len(segments)-1]
+	}
+
+	if p.Stream == "" {
+		p.Stream = defaultStreamName
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed query: %v", ErrInvalidStreamPath, err)
+	}
+	p.Query = query
+
+	if err := ValidateStreamPath(p.App, p.Stream); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// ValidateStreamPath checks an app and stream name, including ones given
+// outside of an RTMP URL such as for a pulled stream.
+func ValidateStreamPath(app, stream string) error {
+	for _, segment := range strings.Split(app, "/") {
+		if err := ValidateName(segment); err != nil {
+			return fmt.Errorf("%w: app: %v", ErrInvalidStreamPath, err)
+		}
+	}
+
+	if err := ValidateName(stream); err != nil {
+		return fmt.Errorf("%w: stream: %v", ErrInvalidStreamPath, err)
+	}
+	return nil
+}
+
+// splitLegacyStreamName handles the rtmp://host/app?stream form, where the
+// stream name is the first query element and carries no "=".
+func splitLegacyStreamName(rawQuery string) (string, string) {
+	if rawQuery == "" {
+		return "", ""
+	}
+
+	first, rest, _ := strings.Cut(rawQuery, "&")
+	if strings.Contains(first, "=") {
+		return "", rawQuery
+	}
+
+	name, err := url.QueryUnescape(first)
+	if err != nil {
+		name = first
+	}
+	return name, rest
+}
+
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("name is empty")
+	}
+
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxNameLength)
+	}
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("name %q is not allowed", name)
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.':
+		default:
+			return fmt.Errorf("name %q contains invalid character %q", name, r)
+		}
+	}
+
+	return nil
+}
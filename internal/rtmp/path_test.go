@@ -0,0 +1,170 @@
+package rtmp
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseStreamPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		rawURL      string
+		app         string
+		stream      string
+		query       map[string]string
+		expectError bool
+	}{
+		{
+			name:   "app and stream",
+			rawURL: "rtmp://host/live/mykey",
+			app:    "live",
+			stream: "mykey",
+		},
+		{
+			name:   "stream with token query",
+			rawURL: "rtmp://host/live/mykey?token=abc&expires=123",
+			app:    "live",
+			stream: "mykey",
+			query:  map[string]string{"token": "abc", "expires": "123"},
+		},
+		{
+			name:   "nested app",
+			rawURL: "rtmp://host/app/inst/stream1",
+			app:    "app/inst",
+			stream: "stream1",
+		},
+		{
+			name:   "legacy stream in query",
+			rawURL: "rtmp://host/live?mystream",
+			app:    "live",
+			stream: "mystream",
+		},
+		{
+			name:   "legacy stream with extra parameters",
+			rawURL: "rtmp://host/live?mystream&token=abc",
+			app:    "live",
+			stream: "mystream",
+			query:  map[string]string{"token": "abc"},
+		},
+		{
+			name:   "app only with parameters",
+			rawURL: "rtmp://host/live?token=abc",
+			app:    "live",
+			stream: "stream",
+			query:  map[string]string{"token": "abc"},
+		},
+		{
+			name:   "empty path uses defaults",
+			rawURL: "rtmp://host/",
+			app:    "live",
+			stream: "stream",
+		},
+		{
+			name:   "duplicate slashes are ignored",
+			rawURL: "rtmp://host//live//mykey",
+			app:    "live",
+			stream: "mykey",
+		},
+		{
+			name:        "parent directory as stream",
+			rawURL:      "rtmp://host/live/..",
+			expectError: true,
+		},
+		{
+			name:        "parent directory in app",
+			rawURL:      "rtmp://host/../etc/passwd",
+			expectError: true,
+		},
+		{
+			name:        "encoded parent directory",
+			rawURL:      "rtmp://host/live/%2e%2e",
+			expectError: true,
+		},
+		{
+			name:        "legacy parent directory",
+			rawURL:      "rtmp://host/live?..",
+			expectError: true,
+		},
+		{
+			name:        "encoded path separator",
+			rawURL:      "rtmp://host/live?a%2Fb",
+			expectError: true,
+		},
+		{
+			name:        "backslash",
+			rawURL:      "rtmp://host/live/a%5Cb",
+			expectError: true,
+		},
+		{
+			name:        "invalid characters",
+			rawURL:      "rtmp://host/live/my%20stream",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatalf("failed to parse test URL: %v", err)
+			}
+
+			path, err := ParseStreamPath(u)
+			if tt.expectError {
+				if !errors.Is(err, ErrInvalidStreamPath) {
+					t.Errorf("expected ErrInvalidStreamPath, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if path.App != tt.app {
+				t.Errorf("expected app %q, got %q", tt.app, path.App)
+			}
+			if path.Stream != tt.stream {
+				t.Errorf("expected stream %q, got %q", tt.stream, path.Stream)
+			}
+			if path.ID() != tt.app+"/"+tt.stream {
+				t.Errorf("unexpected stream ID %q", path.ID())
+			}
+
+			for key, value := range tt.query {
+				if got := path.Query.Get(key); got != value {
+					t.Errorf("expected query %s=%q, got %q", key, value, got)
+				}
+			}
+			if len(path.Query) != len(tt.query) {
+				t.Errorf("expected %d query parameters, got %d", len(tt.query), len(path.Query))
+			}
+		})
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "stream_1-hd.v2", valid: true},
+		{name: "", valid: false},
+		{name: ".", valid: false},
+		{name: "..", valid: false},
+		{name: "a/b", valid: false},
+		{name: "a\\b", valid: false},
+		{name: "a\x00b", valid: false},
+		{name: "C:", valid: false},
+	}
+
+	for _, tt := range tests {
+		err := ValidateName(tt.name)
+		if tt.valid && err != nil {
+			t.Errorf("expected %q to be valid, got %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("expected %q to be rejected", tt.name)
+		}
+	}
+}
@@ -1,29 +1,75 @@
 package rtmp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"golang-rtmp/internal/hooks"
+	"golang-rtmp/internal/record"
+	"golang-rtmp/internal/relay"
 	"golang-rtmp/internal/stream"
 
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/format/rtmp"
 	"github.com/sirupsen/logrus"
 )
 
+const defaultPlayerQueueSize = 256
+
+var (
+	ErrPublisherNotFound = errors.New("publisher not found")
+	ErrPublisherExists   = errors.New("stream already has a publisher")
+)
+
+type AppConfig struct {
+	Passthrough bool
+	Container   string
+	DASH        bool
+	DVRWindow   time.Duration
+	Record      *record.Config
+	Push        []string
+}
+
 type Server struct {
 	addr          string
 	streamManager *stream.StreamManager
 	logger        *logrus.Logger
 	ffmpegPath    string
 	ffmpegParams  map[string]string
+	renditions    []stream.Rendition
+	apps          map[string]AppConfig
+	segmenter     string
+	partDuration  time.Duration
 	hlsConfig     struct {
 		outputDir       string
 		segmentDuration int
 		playlistWindow  int
 	}
-	mu sync.RWMutex
+	playerQueueSize int
+	authorizer      PublishAuthorizer
+	hooks           *hooks.Client
+	recorder        *record.Manager
+	relay           *relay.Manager
+	bans            *BanList
+	publishers      map[string]*publisher
+	mu              sync.RWMutex
+}
+
+// publisher is the source of a stream that is being ingested.
+type publisher struct {
+	src av.Demuxer
+	// remoteAddr and path are what bans are checked against. Pulled streams
+	// have no remote address and are not subject to bans.
+	remoteAddr string
+	path       StreamPath
 }
 
 func NewServer(addr string, streamManager *stream.StreamManager, logger *logrus.Logger) *Server {
@@ -31,6 +77,7 @@ func NewServer(addr string, streamManager *stream.StreamManager, logger *logrus.
 		addr:          addr,
 		streamManager: streamManager,
 		logger:        logger,
+		publishers:    make(map[string]*publisher),
 	}
 }
 
@@ -41,6 +88,65 @@ func (s *Server) SetFFmpegConfig(ffmpegPath string, params map[string]string) {
 	s.ffmpegParams = params
 }
 
+func (s *Server) SetRenditions(renditions []stream.Rendition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renditions = renditions
+}
+
+func (s *Server) SetAppConfig(app string, config AppConfig) error {
+	switch config.Container {
+	case "", stream.ContainerTS, stream.ContainerFMP4:
+	default:
+		return fmt.Errorf("unknown container %q", config.Container)
+	}
+	if config.DASH && config.Container != stream.ContainerFMP4 {
+		return fmt.Errorf("DASH output requires the fmp4 container")
+	}
+	if config.DVRWindow < 0 {
+		return fmt.Errorf("DVR window must not be negative")
+	}
+	if config.Record != nil {
+		if err := config.Record.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, target := range config.Push {
+		if err := relay.ValidateURL(target); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.apps == nil {
+		s.apps = make(map[string]AppConfig)
+	}
+	s.apps[app] = config
+	return nil
+}
+
+func (s *Server) SetSegmenter(segmenter string) error {
+	switch segmenter {
+	case "", stream.SegmenterFFmpeg, stream.SegmenterNative:
+	default:
+		return fmt.Errorf("unknown segmenter %q", segmenter)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segmenter = segmenter
+	return nil
+}
+
+// SetLowLatency enables LL-HLS partial segments for streams written by the
+// native segmenter. A zero duration disables it.
+func (s *Server) SetLowLatency(partDuration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partDuration = partDuration
+}
+
 func (s *Server) SetHLSConfig(outputDir string, segmentDuration, playlistWindow int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -49,6 +155,43 @@ func (s *Server) SetHLSConfig(outputDir string, segmentDuration, playlistWindow
 	s.hlsConfig.playlistWindow = playlistWindow
 }
 
+func (s *Server) SetPlayerQueueSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.playerQueueSize = size
+}
+
+func (s *Server) SetPublishAuthorizer(authorizer PublishAuthorizer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizer = authorizer
+}
+
+func (s *Server) SetHooks(client *hooks.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = client
+}
+
+func (s *Server) SetRecorder(manager *record.Manager) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder = manager
+}
+
+func (s *Server) SetRelay(manager *relay.Manager) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.relay = manager
+}
+
+// SetBans sets the stream keys and IPs that may not publish or play.
+func (s *Server) SetBans(bans *BanList) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans = bans
+}
+
 func (s *Server) Start() error {
 	rtmpServer := &rtmp.Server{
 		Addr:          s.addr,
@@ -61,80 +204,434 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) handlePublish(conn *rtmp.Conn) {
-	appName := strings.TrimPrefix(conn.URL.Path, "/")
-	if appName == "" {
-		appName = "live"
+	path, err := ParseStreamPath(conn.URL)
+	if err != nil {
+		s.logger.Warnf("Rejected publish from %s: %v", conn.NetConn().RemoteAddr(), err)
+		conn.Close()
+		return
 	}
 
-	streamName := conn.URL.RawQuery
-	if streamName == "" {
-		streamName = "stream"
+	streamID := path.ID()
+	s.logger.Infof("Publish request: %s", streamID)
+
+	remoteAddr := conn.NetConn().RemoteAddr().String()
+	if err := s.AcceptPublish(context.Background(), path, remoteAddr); err != nil {
+		s.logger.Warnf("Rejected publish for stream %s from %s: %v", streamID, remoteAddr, err)
+		conn.Close()
+		return
+	}
+	if path.ID() != streamID {
+		s.logger.Infof("Stream %s renamed to %s by on_publish hook", streamID, path.ID())
+		streamID = path.ID()
 	}
 
-	streamID := fmt.Sprintf("%s/%s", appName, streamName)
-	s.logger.Infof("Publish request: %s", streamID)
+	if err := s.Publish(path, remoteAddr, conn); err != nil {
+		s.logger.Errorf("Publishing stream %s failed: %v", streamID, err)
+	}
+}
 
-	s.mu.RLock()
-	outputDir := filepath.Join(s.hlsConfig.outputDir, appName, streamName)
-	segmentDuration := s.hlsConfig.segmentDuration
-	playlistWindow := s.hlsConfig.playlistWindow
-	ffmpegPath := s.ffmpegPath
-	ffmpegParams := s.ffmpegParams
-	s.mu.RUnlock()
+// AcceptPublish authorizes a publisher the way RTMP publishers are: by the
+// ban list, the publish authorizer and then the on_publish hook, which may
+// rename the stream in path. ctx bounds the hook, e.g. by the WHIP request.
+func (s *Server) AcceptPublish(ctx context.Context, path *StreamPath, remoteAddr string) error {
+	if err := s.checkBans(remoteAddr, path); err != nil {
+		return err
+	}
+	if err := s.authorizePublish(remoteAddr, path); err != nil {
+		return err
+	}
+	if err := s.callHook(ctx, hooks.EventPublish, remoteAddr, path); err != nil {
+		return fmt.Errorf("on_publish hook: %w", err)
+	}
+	return nil
+}
 
-	stream := s.streamManager.CreateStream(appName, streamName, outputDir)
+// AbortPublish calls the on_publish_done hook for a publisher accepted by
+// AcceptPublish that fails before Publish, so every on_publish is paired
+// with an on_publish_done.
+func (s *Server) AbortPublish(path *StreamPath, remoteAddr string) {
+	s.notifyHook(hooks.EventPublishDone, remoteAddr, path)
+}
 
-	if err := stream.StartFFmpeg(ffmpegPath, ffmpegParams, segmentDuration, playlistWindow); err != nil {
-		s.logger.Errorf("Failed to start FFmpeg for stream %s: %v", streamID, err)
-		return
+// Publish runs an accepted publisher's stream through the publish pipeline
+// until src fails or ends, and then calls the on_publish_done hook.
+func (s *Server) Publish(path *StreamPath, remoteAddr string, src av.Demuxer) error {
+	defer s.notifyHook(hooks.EventPublishDone, remoteAddr, path)
+	return s.ingest(path, remoteAddr, src)
+}
+
+// Ingest runs a stream the server pulls itself through the same pipeline as
+// a published one. It returns once src fails or ends.
+func (s *Server) Ingest(app, name string, src av.Demuxer) error {
+	if err := ValidateStreamPath(app, name); err != nil {
+		return err
+	}
+	return s.ingest(&StreamPath{App: app, Stream: name}, "", src)
+}
+
+func (s *Server) ingest(path *StreamPath, remoteAddr string, src av.Demuxer) error {
+	streamID := path.ID()
+
+	// A stream whose transcoding was stopped or gave up is inactive while its
+	// publisher is still connected, so the publisher itself is the lock.
+	pub := &publisher{src: src, remoteAddr: remoteAddr, path: *path}
+	s.mu.Lock()
+	if _, exists := s.publishers[streamID]; exists {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrPublisherExists, streamID)
 	}
+	s.publishers[streamID] = pub
+	s.mu.Unlock()
 
 	defer func() {
-		stream.Stop()
+		s.mu.Lock()
+		delete(s.publishers, streamID)
+		s.mu.Unlock()
+	}()
+
+	codecs, err := src.Streams()
+	if err != nil {
+		return fmt.Errorf("failed to read codec data: %w", err)
+	}
+
+	s.mu.RLock()
+	outputDir := filepath.Join(s.hlsConfig.outputDir, path.App, path.Stream)
+	recorder := s.recorder
+	recordConfig := s.apps[path.App].Record
+	relayManager := s.relay
+	pushTargets := s.apps[path.App].Push
+	s.mu.RUnlock()
+
+	liveStream := s.streamManager.CreateStream(path.App, path.Stream, outputDir)
+	profile := s.transcodeProfile(path, codecs)
+
+	// The stream is removed even if its transcoder fails to start, so it does
+	// not stay listed as a stream nobody publishes.
+	defer func() {
+		liveStream.WriteTrailer()
+		liveStream.Stop()
+		if relayManager != nil {
+			relayManager.StopStream(streamID)
+		}
 		s.streamManager.RemoveStream(streamID)
 	}()
 
+	if err := liveStream.StartTranscoder(profile); err != nil {
+		return fmt.Errorf("failed to start transcoder: %w", err)
+	}
+
+	// The recorder subscribes before the header is written so it sees the
+	// stream from the first keyframe.
+	if recorder != nil && recordConfig != nil {
+		if err := recorder.Record(liveStream, *recordConfig); err != nil {
+			s.logger.Errorf("Failed to start recording stream %s: %v", streamID, err)
+		}
+	}
+
+	if relayManager != nil && len(pushTargets) > 0 {
+		relayManager.Start(liveStream, pushTargets)
+	}
+
+	if err := liveStream.WriteHeader(codecs); err != nil {
+		s.logger.Errorf("Failed to write header for stream %s: %v", streamID, err)
+	}
+
 	s.logger.Infof("Started publishing stream: %s", streamID)
+	defer s.logger.Infof("Stopped publishing stream: %s", streamID)
 
 	for {
-		_, err := conn.ReadPacket()
+		pkt, err := src.ReadPacket()
 		if err != nil {
-			s.logger.Errorf("Error reading packet from stream %s: %v", streamID, err)
-			break
+			return fmt.Errorf("error reading packet: %w", err)
 		}
 
-		stream.UpdateLastActivity()
+		if err := liveStream.WritePacket(pkt); err != nil {
+			s.logger.Errorf("Error writing packet for stream %s: %v", streamID, err)
+		}
+
+		liveStream.UpdateLastActivity()
 	}
+}
 
-	s.logger.Infof("Stopped publishing stream: %s", streamID)
+// KickPublisher disconnects the publisher of a stream, which ends the stream.
+// Pulled streams reconnect unless their pull is stopped instead.
+func (s *Server) KickPublisher(streamID string) error {
+	s.mu.RLock()
+	pub, exists := s.publishers[streamID]
+	s.mu.RUnlock()
+	if !exists {
+		return ErrPublisherNotFound
+	}
+
+	closer, ok := pub.src.(io.Closer)
+	if !ok {
+		return fmt.Errorf("publisher of stream %s cannot be disconnected", streamID)
+	}
+	s.logger.Infof("Disconnecting publisher of stream %s", streamID)
+	return closer.Close()
 }
 
-func (s *Server) handlePlay(conn *rtmp.Conn) {
-	appName := strings.TrimPrefix(conn.URL.Path, "/")
-	if appName == "" {
-		appName = "live"
+// KickBannedPublishers disconnects the publishers the ban list refuses, for
+// bans added while they were already publishing.
+func (s *Server) KickBannedPublishers() {
+	s.mu.RLock()
+	pubs := make(map[string]*publisher, len(s.publishers))
+	for streamID, pub := range s.publishers {
+		if pub.remoteAddr != "" {
+			pubs[streamID] = pub
+		}
+	}
+	s.mu.RUnlock()
+
+	for streamID, pub := range pubs {
+		err := s.checkBans(pub.remoteAddr, &pub.path)
+		if err == nil {
+			continue
+		}
+		if closer, ok := pub.src.(io.Closer); ok {
+			s.logger.Infof("Disconnecting publisher of stream %s: %v", streamID, err)
+			closer.Close()
+		}
+	}
+}
+
+func (s *Server) transcodeProfile(path *StreamPath, codecs []av.CodecData) stream.TranscodeProfile {
+	s.mu.RLock()
+	profile := stream.TranscodeProfile{
+		BinaryPath:      s.ffmpegPath,
+		Params:          s.ffmpegParams,
+		Renditions:      s.renditions,
+		SegmentDuration: s.hlsConfig.segmentDuration,
+		PlaylistWindow:  s.hlsConfig.playlistWindow,
+	}
+	appConfig := s.apps[path.App]
+	segmenter := s.segmenter
+	partDuration := s.partDuration
+	s.mu.RUnlock()
+
+	profile.Codecs = codecs
+	profile.Container = appConfig.Container
+	profile.DASH = appConfig.DASH
+	profile.DVRWindow = appConfig.DVRWindow
+	profile.Passthrough = s.passthroughRequested(path, appConfig)
+	if profile.Passthrough && !stream.PassthroughCompatible(codecs) {
+		s.logger.Warnf("Stream %s codecs %s cannot be remuxed into HLS, falling back to transcoding", path.ID(), codecNames(codecs))
+		profile.Passthrough = false
+	}
+
+	// The native segmenter only remuxes into MPEG-TS, so transcoded and fMP4
+	// streams keep using FFmpeg.
+	if segmenter == stream.SegmenterNative && profile.Passthrough && profile.Container != stream.ContainerFMP4 {
+		profile.Segmenter = stream.SegmenterNative
+		profile.PartDuration = partDuration
+	}
+
+	return profile
+}
+
+func (s *Server) passthroughRequested(path *StreamPath, appConfig AppConfig) bool {
+	value := path.Query.Get("passthrough")
+	if value == "" {
+		return appConfig.Passthrough
+	}
+
+	passthrough, err := strconv.ParseBool(value)
+	if err != nil {
+		s.logger.Warnf("Ignoring invalid passthrough value %q for stream %s", value, path.ID())
+		return appConfig.Passthrough
+	}
+	return passthrough
+}
+
+func codecNames(codecs []av.CodecData) string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Type().String())
+	}
+	return strings.Join(names, ",")
+}
+
+// checkBans refuses banned client IPs and, for publishers, banned stream
+// keys. OBS-style publishers send their key as the stream name rather than a
+// key parameter, so a key ban matches either.
+func (s *Server) checkBans(remoteAddr string, path *StreamPath) error {
+	s.mu.RLock()
+	bans := s.bans
+	s.mu.RUnlock()
+
+	if bans == nil {
+		return nil
 	}
+	if err := bans.CheckAddr(remoteAddr); err != nil {
+		return err
+	}
+	if path == nil {
+		return nil
+	}
+	if err := bans.CheckKey(streamKey(path.Query)); err != nil {
+		return err
+	}
+	return bans.CheckKey(path.Stream)
+}
+
+func (s *Server) authorizePublish(remoteAddr string, path *StreamPath) error {
+	s.mu.RLock()
+	authorizer := s.authorizer
+	s.mu.RUnlock()
 
-	streamName := conn.URL.RawQuery
-	if streamName == "" {
-		streamName = "stream"
+	if authorizer == nil {
+		return nil
 	}
 
-	streamID := fmt.Sprintf("%s/%s", appName, streamName)
+	return authorizer.AuthorizePublish(&PublishRequest{
+		App:        path.App,
+		Stream:     path.Stream,
+		Query:      path.Query,
+		RemoteAddr: remoteAddr,
+	})
+}
+
+func (s *Server) callHook(ctx context.Context, event hooks.Event, remoteAddr string, path *StreamPath) error {
+	s.mu.RLock()
+	client := s.hooks
+	s.mu.RUnlock()
+
+	if client == nil || !client.Enabled(event) {
+		return nil
+	}
+
+	result, err := client.Call(ctx, hookPayload(event, remoteAddr, path))
+	if err != nil {
+		return err
+	}
+
+	if result.Stream != "" {
+		if err := ValidateName(result.Stream); err != nil {
+			return fmt.Errorf("%w: invalid stream name from webhook: %v", ErrInvalidStreamPath, err)
+		}
+		path.Stream = result.Stream
+	}
+	return nil
+}
+
+// notifyHook calls an on_*_done hook in the background, so a slow webhook
+// does not hold up the teardown of a publisher or player.
+func (s *Server) notifyHook(event hooks.Event, remoteAddr string, path *StreamPath) {
+	s.mu.RLock()
+	client := s.hooks
+	s.mu.RUnlock()
+
+	if client != nil {
+		client.Notify(hookPayload(event, remoteAddr, path))
+	}
+}
+
+func hookPayload(event hooks.Event, remoteAddr string, path *StreamPath) hooks.Payload {
+	clientIP, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		clientIP = remoteAddr
+	}
+
+	return hooks.Payload{
+		Event:    event,
+		App:      path.App,
+		Stream:   path.Stream,
+		ClientIP: clientIP,
+		Args:     hooks.ArgsFromQuery(path.Query),
+	}
+}
+
+func (s *Server) handlePlay(conn *rtmp.Conn) {
+	path, err := ParseStreamPath(conn.URL)
+	if err != nil {
+		s.logger.Warnf("Rejected play from %s: %v", conn.NetConn().RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	streamID := path.ID()
 	s.logger.Infof("Play request: %s", streamID)
 
+	remoteAddr := conn.NetConn().RemoteAddr().String()
+	if err := s.checkBans(remoteAddr, nil); err != nil {
+		s.logger.Warnf("Rejected play for stream %s from %s: %v", streamID, remoteAddr, err)
+		conn.Close()
+		return
+	}
+	if err := s.callHook(context.Background(), hooks.EventPlay, remoteAddr, path); err != nil {
+		s.logger.Warnf("Rejected play for stream %s by on_play hook: %v", streamID, err)
+		conn.Close()
+		return
+	}
+	if path.ID() != streamID {
+		s.logger.Infof("Play of stream %s redirected to %s by on_play hook", streamID, path.ID())
+		streamID = path.ID()
+	}
+	defer s.notifyHook(hooks.EventPlayDone, remoteAddr, path)
+
 	stream, exists := s.streamManager.GetStream(streamID)
 	if !exists {
 		s.logger.Errorf("Stream not found: %s", streamID)
 		return
 	}
 
-	if !stream.IsActive {
-		s.logger.Errorf("Stream is not active: %s", streamID)
+	s.mu.RLock()
+	queueSize := s.playerQueueSize
+	s.mu.RUnlock()
+	if queueSize <= 0 {
+		queueSize = defaultPlayerQueueSize
+	}
+
+	sub := stream.Subscribe(remoteAddr, queueSize)
+	defer sub.Close()
+	sub.SetViewer("rtmp", remoteAddr, func() {
+		conn.Close()
+	})
+
+	codecs, err := sub.Streams()
+	if err != nil {
+		s.logger.Errorf("Stream %s ended before codec data was available: %v", streamID, err)
+		return
+	}
+
+	if err := conn.WriteHeader(codecs); err != nil {
+		s.logger.Errorf("Failed to write header to player of stream %s: %v", streamID, err)
+		return
+	}
+	// joy4 buffers RTMP writes until WriteTrailer, so flush the header now
+	// in case the stream is idle, and then whenever the queue is drained to
+	// keep playback latency low.
+	if err := conn.WriteTrailer(); err != nil {
+		s.logger.Infof("Player of stream %s disconnected: %v", streamID, err)
 		return
 	}
 
 	s.logger.Infof("Started playing stream: %s", streamID)
 
-	stream.UpdateLastActivity()
+	for {
+		pkt, err := sub.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Warnf("Disconnecting player of stream %s: %v", streamID, err)
+			}
+			break
+		}
+
+		if err := conn.WritePacket(pkt); err != nil {
+			s.logger.Infof("Player of stream %s disconnected: %v", streamID, err)
+			break
+		}
+
+		if sub.Buffered() == 0 {
+			if err := conn.WriteTrailer(); err != nil {
+				s.logger.Infof("Player of stream %s disconnected: %v", streamID, err)
+				break
+			}
+		}
+
+		stream.UpdateLastActivity()
+	}
+
+	conn.WriteTrailer()
+	s.logger.Infof("Stopped playing stream: %s", streamID)
 }
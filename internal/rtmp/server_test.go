@@ -0,0 +1,700 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/record"
+	"golang-rtmp/internal/relay"
+	"golang-rtmp/internal/stream"
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/sirupsen/logrus"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func startTestServer(t *testing.T) (*Server, *stream.StreamManager, string, string) {
+	t.Helper()
+
+	logger := logrus.New()
+	sm := stream.NewStreamManager(logger)
+	sm.SetTranscoderFactory(stream.NewFakeTranscoderFactory())
+	sm.SetGOPCacheSize(1)
+
+	addr := freeAddr(t)
+	outputDir := t.TempDir()
+
+	server := NewServer(addr, sm, logger)
+	server.SetHLSConfig(outputDir, 4, 10)
+	go server.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("RTMP server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return server, sm, addr, outputDir
+}
+
+// publish sends enough packets for the server-side FLV prober, which needs
+// flv.MaxProbePacketCount tags before it reports codec data.
+func publish(t *testing.T, addr, path string, packets int) *rtmp.Conn {
+	t.Helper()
+
+	conn, err := rtmp.DialTimeout(fmt.Sprintf("rtmp://%s/%s", addr, path), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial RTMP server: %v", err)
+	}
+
+	if err := conn.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	writePackets(t, conn, 0, packets)
+
+	return conn
+}
+
+func writePackets(t *testing.T, conn *rtmp.Conn, start, count int) {
+	t.Helper()
+
+	for i := start; i < start+count; i++ {
+		pkt := av.Packet{Idx: 0, IsKeyFrame: i%8 == 0, Time: time.Duration(i) * 40 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x65}}
+		if err := conn.WritePacket(pkt); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+
+	if err := conn.WriteTrailer(); err != nil {
+		t.Fatalf("failed to flush publisher: %v", err)
+	}
+}
+
+func TestServer_PublishAndPlay(t *testing.T) {
+	_, sm, addr, outputDir := startTestServer(t)
+
+	publisher := publish(t, addr, "live/test", 24)
+
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+
+	playlistPath := filepath.Join(outputDir, "live", "test", "playlist.m3u8")
+	testutil.WaitFor(t, "segments to be written", func() bool {
+		_, err := os.Stat(filepath.Join(outputDir, "live", "test", "segment_002.ts"))
+		return err == nil
+	})
+	if _, err := os.Stat(playlistPath); err != nil {
+		t.Errorf("expected playlist to exist: %v", err)
+	}
+
+	player, err := rtmp.DialTimeout(fmt.Sprintf("rtmp://%s/live/test", addr), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial RTMP server as player: %v", err)
+	}
+	defer player.Close()
+
+	type probeResult struct {
+		codecs []av.CodecData
+		err    error
+	}
+	probed := make(chan probeResult, 1)
+	go func() {
+		codecs, err := player.Streams()
+		probed <- probeResult{codecs, err}
+	}()
+
+	liveStream, _ := sm.GetStream("live/test")
+	testutil.WaitFor(t, "player to subscribe", func() bool {
+		return liveStream.SubscriberCount() == 1
+	})
+	writePackets(t, publisher, 24, 24)
+
+	var codecs []av.CodecData
+	select {
+	case result := <-probed:
+		if result.err != nil {
+			t.Fatalf("failed to read codec data as player: %v", result.err)
+		}
+		codecs = result.codecs
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for player codec data")
+	}
+	if len(codecs) != 2 || codecs[0].Type() != av.H264 {
+		t.Errorf("unexpected codec data for player: %v", codecs)
+	}
+
+	pkt, err := player.ReadPacket()
+	if err != nil {
+		t.Fatalf("failed to read packet as player: %v", err)
+	}
+	if !pkt.IsKeyFrame {
+		t.Error("expected player to start on a cached keyframe")
+	}
+
+	// Live packets must reach the player while the publisher is still
+	// connected, not only once the stream ends and the connection is flushed.
+	writePackets(t, publisher, 48, 8)
+	player.NetConn().SetReadDeadline(time.Now().Add(2 * time.Second))
+	for pkt.Time < 48*40*time.Millisecond {
+		if pkt, err = player.ReadPacket(); err != nil {
+			t.Fatalf("failed to read live packet as player: %v", err)
+		}
+	}
+
+	publisher.Close()
+
+	testutil.WaitFor(t, "stream to be removed", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return !exists
+	})
+}
+
+func TestServer_RejectsUnauthorizedPublisher(t *testing.T) {
+	server, sm, addr, _ := startTestServer(t)
+	server.SetPublishAuthorizer(NewStaticKeyAuthorizer([]string{"secret"}))
+
+	// The stream name is public, so it is not accepted as the key.
+	for _, path := range []string{"live/wrong?key=wrong", "live/secret"} {
+		rejected, err := rtmp.DialTimeout(fmt.Sprintf("rtmp://%s/%s", addr, path), time.Second)
+		if err != nil {
+			t.Fatalf("failed to dial RTMP server: %v", err)
+		}
+		defer rejected.Close()
+		rejected.WriteHeader(testutil.Codecs(t))
+		rejected.WriteTrailer()
+	}
+
+	accepted := publish(t, addr, "live/test?key=secret", 24)
+
+	testutil.WaitFor(t, "authorized stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+
+	for _, id := range []string{"live/wrong", "live/secret"} {
+		if _, exists := sm.GetStream(id); exists {
+			t.Errorf("expected unauthorized stream %s not to be created", id)
+		}
+	}
+
+	// The transcoder writes into the output directory until the stream ends.
+	accepted.Close()
+	testutil.WaitFor(t, "authorized stream to end", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return !exists
+	})
+}
+
+type unsupportedCodec struct{}
+
+func (unsupportedCodec) Type() av.CodecType {
+	return av.SPEEX
+}
+
+func TestServer_TranscodeProfilePassthrough(t *testing.T) {
+	server := NewServer(":0", stream.NewStreamManager(logrus.New()), logrus.New())
+	server.SetAppConfig("copy", AppConfig{Passthrough: true})
+
+	tests := []struct {
+		name     string
+		rawURL   string
+		codecs   []av.CodecData
+		expected bool
+	}{
+		{name: "default transcodes", rawURL: "rtmp://host/live/test", codecs: testutil.Codecs(t), expected: false},
+		{name: "app passthrough", rawURL: "rtmp://host/copy/test", codecs: testutil.Codecs(t), expected: true},
+		{name: "stream opts in", rawURL: "rtmp://host/live/test?passthrough=true", codecs: testutil.Codecs(t), expected: true},
+		{name: "stream opts out", rawURL: "rtmp://host/copy/test?passthrough=0", codecs: testutil.Codecs(t), expected: false},
+		{name: "invalid value uses app default", rawURL: "rtmp://host/copy/test?passthrough=maybe", codecs: testutil.Codecs(t), expected: true},
+		{name: "incompatible codecs fall back", rawURL: "rtmp://host/copy/test", codecs: []av.CodecData{testutil.Codecs(t)[0], unsupportedCodec{}}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatalf("failed to parse URL: %v", err)
+			}
+			path, err := ParseStreamPath(u)
+			if err != nil {
+				t.Fatalf("failed to parse stream path: %v", err)
+			}
+
+			if got := server.transcodeProfile(path, tt.codecs).Passthrough; got != tt.expected {
+				t.Errorf("expected passthrough %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestServer_PublishPassthrough(t *testing.T) {
+	var fakes []*stream.FakeTranscoder
+	var mu sync.Mutex
+
+	server, sm, addr, _ := startTestServer(t)
+	sm.SetTranscoderFactory(func() stream.Transcoder {
+		fake := stream.NewFakeTranscoder()
+		mu.Lock()
+		fakes = append(fakes, fake)
+		mu.Unlock()
+		return fake
+	})
+	server.SetAppConfig("live", AppConfig{Passthrough: true})
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fakes) != 1 || !fakes[0].Profile().Passthrough {
+		t.Error("expected H.264/AAC publisher to be remuxed without transcoding")
+	}
+}
+
+func TestServer_PublishWithNativeSegmenter(t *testing.T) {
+	server, sm, addr, outputDir := startTestServer(t)
+	server.SetHLSConfig(outputDir, 1, 10)
+	server.SetAppConfig("live", AppConfig{Passthrough: true})
+	if err := server.SetSegmenter(stream.SegmenterNative); err != nil {
+		t.Fatalf("SetSegmenter failed: %v", err)
+	}
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+	writePackets(t, publisher, 24, 40)
+
+	segmentPath := filepath.Join(outputDir, "live", "test", "segment_000.ts")
+	testutil.WaitFor(t, "native segment to be written", func() bool {
+		_, err := os.Stat(segmentPath)
+		return err == nil
+	})
+
+	liveStream, _ := sm.GetStream("live/test")
+	if status := liveStream.GetStatus(); status["segmenter"] != stream.SegmenterNative {
+		t.Errorf("expected native segmenter, got %v", status["segmenter"])
+	}
+
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		t.Fatalf("failed to read segment: %v", err)
+	}
+	if len(data) == 0 || data[0] != 0x47 {
+		t.Error("expected native segment to contain MPEG-TS packets")
+	}
+
+	if err := server.SetSegmenter("gstreamer"); err == nil {
+		t.Error("expected error for unknown segmenter")
+	}
+}
+
+func TestServer_TranscodeProfileContainer(t *testing.T) {
+	server := NewServer(":0", stream.NewStreamManager(logrus.New()), logrus.New())
+	if err := server.SetAppConfig("cmaf", AppConfig{Passthrough: true, Container: stream.ContainerFMP4}); err != nil {
+		t.Fatalf("SetAppConfig failed: %v", err)
+	}
+	if err := server.SetSegmenter(stream.SegmenterNative); err != nil {
+		t.Fatalf("SetSegmenter failed: %v", err)
+	}
+
+	u, _ := url.Parse("rtmp://host/cmaf/test")
+	path, err := ParseStreamPath(u)
+	if err != nil {
+		t.Fatalf("failed to parse stream path: %v", err)
+	}
+
+	profile := server.transcodeProfile(path, testutil.Codecs(t))
+	if profile.Container != stream.ContainerFMP4 {
+		t.Errorf("expected fMP4 container, got %q", profile.Container)
+	}
+	if profile.Segmenter == stream.SegmenterNative {
+		t.Error("expected fMP4 streams to be segmented by FFmpeg")
+	}
+	if err := profile.Validate(); err != nil {
+		t.Errorf("expected valid profile: %v", err)
+	}
+
+	if err := server.SetAppConfig("live", AppConfig{Container: "webm"}); err == nil {
+		t.Error("expected error for unknown container")
+	}
+	if err := server.SetAppConfig("live", AppConfig{DASH: true}); err == nil {
+		t.Error("expected DASH to require the fmp4 container")
+	}
+}
+
+func TestServer_PublishWithRecording(t *testing.T) {
+	server, sm, addr, _ := startTestServer(t)
+	recorder := record.NewManager(t.TempDir(), logrus.New())
+	server.SetRecorder(recorder)
+	err := server.SetAppConfig("live", AppConfig{Record: &record.Config{PathTemplate: "{app}/{stream}/{start_time}.flv"}})
+	if err != nil {
+		t.Fatalf("SetAppConfig failed: %v", err)
+	}
+
+	publisher := publish(t, addr, "live/test", 24)
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+	writePackets(t, publisher, 24, 24)
+	publisher.Close()
+
+	testutil.WaitFor(t, "stream to be removed", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return !exists
+	})
+	recorder.Wait()
+
+	recordings, err := recorder.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(recordings) != 1 || !strings.HasPrefix(recordings[0].Path, "live/test/") || recordings[0].Size == 0 {
+		t.Fatalf("expected one FLV recording, got %+v", recordings)
+	}
+
+	if err := server.SetAppConfig("live", AppConfig{Record: &record.Config{PathTemplate: "{stream}.mkv"}}); err == nil {
+		t.Error("expected error for unsupported recording container")
+	}
+}
+
+func TestServer_TranscodeProfileLowLatency(t *testing.T) {
+	server := NewServer(":0", stream.NewStreamManager(logrus.New()), logrus.New())
+	server.SetAppConfig("copy", AppConfig{Passthrough: true})
+	server.SetLowLatency(500 * time.Millisecond)
+	if err := server.SetSegmenter(stream.SegmenterNative); err != nil {
+		t.Fatalf("SetSegmenter failed: %v", err)
+	}
+
+	for rawURL, expected := range map[string]time.Duration{
+		"rtmp://host/copy/test": 500 * time.Millisecond,
+		"rtmp://host/live/test": 0,
+	} {
+		u, _ := url.Parse(rawURL)
+		path, err := ParseStreamPath(u)
+		if err != nil {
+			t.Fatalf("failed to parse stream path: %v", err)
+		}
+
+		profile := server.transcodeProfile(path, testutil.Codecs(t))
+		if profile.PartDuration != expected {
+			t.Errorf("%s: expected part duration %s, got %s", rawURL, expected, profile.PartDuration)
+		}
+		if err := profile.Validate(); err != nil {
+			t.Errorf("%s: expected valid profile: %v", rawURL, err)
+		}
+	}
+}
+
+func TestServer_PushesToUpstreamServer(t *testing.T) {
+	_, upstreamSM, upstreamAddr, _ := startTestServer(t)
+	server, sm, addr, _ := startTestServer(t)
+
+	relayManager := relay.NewManager(logrus.New())
+	server.SetRelay(relayManager)
+	err := server.SetAppConfig("live", AppConfig{Push: []string{"rtmp://" + upstreamAddr + "/relayed/{stream}"}})
+	if err != nil {
+		t.Fatalf("SetAppConfig failed: %v", err)
+	}
+
+	publisher := publish(t, addr, "live/test", 24)
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+
+	// The upstream server probes the pushed stream before creating it, so
+	// keep publishing until it shows up.
+	sent := 24
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, exists := upstreamSM.GetStream("relayed/test"); exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the pushed stream upstream")
+		}
+		writePackets(t, publisher, sent, 8)
+		sent += 8
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	statuses := relayManager.List("live/test")
+	if len(statuses) != 1 || statuses[0].State != relay.StatePushing || statuses[0].URL != "rtmp://"+upstreamAddr+"/relayed/test" {
+		t.Errorf("unexpected push status %+v", statuses)
+	}
+
+	publisher.Close()
+	testutil.WaitFor(t, "pushed stream to end upstream", func() bool {
+		_, exists := upstreamSM.GetStream("relayed/test")
+		return !exists
+	})
+	relayManager.Wait()
+
+	if err := server.SetAppConfig("live", AppConfig{Push: []string{"http://example.com/{stream}"}}); err == nil {
+		t.Error("expected error for a non-RTMP push target")
+	}
+}
+
+func TestServer_KickPublisher(t *testing.T) {
+	server, sm, addr, _ := startTestServer(t)
+
+	if err := server.KickPublisher("live/test"); !errors.Is(err, ErrPublisherNotFound) {
+		t.Errorf("expected ErrPublisherNotFound without a publisher, got %v", err)
+	}
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+	testutil.WaitFor(t, "publisher to be registered", func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.publishers["live/test"] != nil
+	})
+
+	if err := server.KickPublisher("live/test"); err != nil {
+		t.Fatalf("KickPublisher failed: %v", err)
+	}
+	testutil.WaitFor(t, "stream to be removed", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return !exists
+	})
+	if err := server.KickPublisher("live/test"); !errors.Is(err, ErrPublisherNotFound) {
+		t.Errorf("expected ErrPublisherNotFound after the kick, got %v", err)
+	}
+}
+
+func TestServer_RejectsSecondPublisherOfPausedStream(t *testing.T) {
+	server, sm, addr, _ := startTestServer(t)
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+
+	testutil.WaitFor(t, "publisher to be registered", func() bool {
+		server.mu.RLock()
+		defer server.mu.RUnlock()
+		return server.publishers["live/test"] != nil
+	})
+	liveStream, _ := sm.GetStream("live/test")
+	if err := liveStream.StopTranscoder(); err != nil {
+		t.Fatalf("StopTranscoder failed: %v", err)
+	}
+
+	// The claim is checked before the source is read from.
+	if err := server.Ingest("live", "test", nil); !errors.Is(err, ErrPublisherExists) {
+		t.Fatalf("expected ErrPublisherExists for a second publisher, got %v", err)
+	}
+	if liveStream.IsActive {
+		t.Error("expected the paused stream to stay paused")
+	}
+
+	if err := server.KickPublisher("live/test"); err != nil {
+		t.Fatalf("expected the first publisher to stay registered: %v", err)
+	}
+}
+
+func TestServer_RejectsBannedClients(t *testing.T) {
+	server, sm, addr, _ := startTestServer(t)
+	bans := NewBanList()
+	server.SetBans(bans)
+
+	if _, err := bans.Add(BanKey, "rogue", time.Minute); err != nil {
+		t.Fatalf("failed to ban key: %v", err)
+	}
+	// OBS-style publishers send the key as the stream name.
+	for _, path := range []string{"live/other?key=rogue", "live/rogue"} {
+		rejected, err := rtmp.DialTimeout(fmt.Sprintf("rtmp://%s/%s", addr, path), time.Second)
+		if err != nil {
+			t.Fatalf("failed to dial RTMP server: %v", err)
+		}
+		defer rejected.Close()
+		rejected.WriteHeader(testutil.Codecs(t))
+		rejected.WriteTrailer()
+	}
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+	for _, streamID := range []string{"live/other", "live/rogue"} {
+		if _, exists := sm.GetStream(streamID); exists {
+			t.Errorf("expected banned stream key of %s not to publish", streamID)
+		}
+	}
+
+	if _, err := bans.Add(BanIP, "127.0.0.1", time.Minute); err != nil {
+		t.Fatalf("failed to ban IP: %v", err)
+	}
+	player, err := rtmp.DialTimeout(fmt.Sprintf("rtmp://%s/live/test", addr), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial RTMP server as player: %v", err)
+	}
+	defer player.Close()
+	if _, err := player.Streams(); err == nil {
+		t.Error("expected a banned IP not to play")
+	}
+}
+
+func TestServer_KickBannedPublishers(t *testing.T) {
+	server, sm, addr, _ := startTestServer(t)
+	bans := NewBanList()
+	server.SetBans(bans)
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+
+	server.KickBannedPublishers()
+	if _, exists := sm.GetStream("live/test"); !exists {
+		t.Fatal("expected a publisher that is not banned to keep publishing")
+	}
+
+	if _, err := bans.Add(BanKey, "test", time.Minute); err != nil {
+		t.Fatalf("failed to ban key: %v", err)
+	}
+	server.KickBannedPublishers()
+	testutil.WaitFor(t, "the banned publisher's stream to end", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return !exists
+	})
+}
+
+func TestServer_KickViewer(t *testing.T) {
+	_, sm, addr, _ := startTestServer(t)
+
+	publisher := publish(t, addr, "live/test", 24)
+	defer publisher.Close()
+	testutil.WaitFor(t, "stream to be created", func() bool {
+		_, exists := sm.GetStream("live/test")
+		return exists
+	})
+	liveStream, _ := sm.GetStream("live/test")
+
+	player, err := rtmp.DialTimeout(fmt.Sprintf("rtmp://%s/live/test", addr), time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial RTMP server as player: %v", err)
+	}
+	defer player.Close()
+
+	// Reads fail rather than block once the player's connection is closed.
+	read := make(chan error, 1)
+	go func() {
+		if _, err := player.Streams(); err != nil {
+			read <- err
+			return
+		}
+		for {
+			if _, err := player.ReadPacket(); err != nil {
+				read <- err
+				return
+			}
+		}
+	}()
+
+	testutil.WaitFor(t, "player to be listed", func() bool {
+		return len(liveStream.Viewers()) == 1
+	})
+	viewer := liveStream.Viewers()[0]
+	if viewer.Protocol != "rtmp" || !strings.HasPrefix(viewer.RemoteAddr, "127.0.0.1:") {
+		t.Errorf("unexpected viewer: %+v", viewer)
+	}
+
+	if err := liveStream.KickViewer(viewer.ID); err != nil {
+		t.Fatalf("KickViewer failed: %v", err)
+	}
+
+	select {
+	case <-read:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the kicked player to be disconnected")
+	}
+}
+
+// failingTranscoder stands in for an FFmpeg binary that cannot be started.
+type failingTranscoder struct {
+	*stream.FakeTranscoder
+}
+
+func (failingTranscoder) Start(outputDir string, profile stream.TranscodeProfile) error {
+	return errors.New("executable file not found")
+}
+
+type codecsDemuxer struct {
+	codecs []av.CodecData
+}
+
+func (d codecsDemuxer) Streams() ([]av.CodecData, error) {
+	return d.codecs, nil
+}
+
+func (d codecsDemuxer) ReadPacket() (av.Packet, error) {
+	return av.Packet{}, io.EOF
+}
+
+func TestServer_RemovesStreamWhenTranscoderFailsToStart(t *testing.T) {
+	logger := logrus.New()
+	sm := stream.NewStreamManager(logger)
+	sm.SetTranscoderFactory(func() stream.Transcoder {
+		return failingTranscoder{stream.NewFakeTranscoder()}
+	})
+
+	server := NewServer(freeAddr(t), sm, logger)
+	server.SetHLSConfig(t.TempDir(), 4, 10)
+
+	err := server.Ingest("live", "test", codecsDemuxer{testutil.Codecs(t)})
+	if err == nil || !strings.Contains(err.Error(), "failed to start transcoder") {
+		t.Fatalf("expected the transcoder start error, got %v", err)
+	}
+	if _, exists := sm.GetStream("live/test"); exists {
+		t.Error("expected the stream to be removed when its transcoder failed to start")
+	}
+}
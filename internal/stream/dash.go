@@ -0,0 +1,173 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang-rtmp/internal/dash"
+	"golang-rtmp/internal/hls"
+
+	"github.com/nareix/joy4/av"
+)
+
+var ErrDASHDisabled = errors.New("DASH output is not enabled for this stream")
+
+// DASHManifest builds a live MPD from the stream's fMP4 HLS playlists, so
+// DASH players are served the same CMAF segments as HLS players.
+func (s *Stream) DASHManifest() ([]byte, error) {
+	s.mu.RLock()
+	profile := s.profile
+	outputDir := s.OutputDir
+	s.mu.RUnlock()
+
+	if !profile.DASH {
+		return nil, ErrDASHDisabled
+	}
+
+	segmentDuration := time.Duration(profile.SegmentDuration) * time.Second
+	manifest := dash.Manifest{
+		PublishTime:          time.Now(),
+		MinimumUpdatePeriod:  segmentDuration,
+		TimeShiftBufferDepth: segmentDuration * time.Duration(profile.windowSegments()),
+	}
+
+	for _, track := range s.dashTracks(profile) {
+		rep, err := readRepresentation(outputDir, VariantPlaylistName(track.ID))
+		if err != nil {
+			return nil, err
+		}
+		rep.ID = track.ID
+		rep.ContentType = track.ContentType
+		rep.Codecs = track.Codecs
+		rep.Width, rep.Height = track.Width, track.Height
+		rep.Bandwidth = track.Bandwidth
+		if rep.Bandwidth == 0 {
+			rep.Bandwidth = measureBandwidth(outputDir, rep)
+		}
+		manifest.Representations = append(manifest.Representations, rep)
+	}
+
+	// All tracks share the media timeline of the transcoder's input, so the
+	// first track decides where it starts on the wall clock.
+	if len(manifest.Representations) > 0 {
+		manifest.AvailabilityStartTime = manifest.Representations[0].MediaStart()
+	}
+	return dash.BuildManifest(manifest)
+}
+
+// dashTracks describes the representations of the profile's media
+// playlists, which are named after the representation IDs. A Bandwidth of
+// zero means it is measured from the segments.
+func (s *Stream) dashTracks(profile TranscodeProfile) []dash.Representation {
+	s.subMu.Lock()
+	codecs := s.codecs
+	s.subMu.Unlock()
+
+	var tracks []dash.Representation
+	if profile.hasVideo() {
+		switch {
+		case len(profile.Renditions) > 0 && !profile.Passthrough:
+			for _, rendition := range profile.Renditions {
+				bandwidth, _ := hls.ParseBitrate(rendition.VideoBitrate)
+				width, height := parseResolution(rendition.Resolution)
+				tracks = append(tracks, dash.Representation{
+					ID:          rendition.Name,
+					ContentType: dash.ContentTypeVideo,
+					Bandwidth:   bandwidth + bandwidth/10,
+					Codecs:      hls.H264CodecString(rendition.Profile, profile.h264Level(rendition)),
+					Width:       width,
+					Height:      height,
+				})
+			}
+
+		case profile.Passthrough:
+			video := dash.Representation{ID: dashVideoTrack, ContentType: dash.ContentTypeVideo}
+			for _, codec := range codecs {
+				if codec.Type().IsVideo() {
+					video.Codecs = hls.CodecString([]av.CodecData{codec})
+					if videoCodec, ok := codec.(av.VideoCodecData); ok {
+						video.Width, video.Height = videoCodec.Width(), videoCodec.Height()
+					}
+				}
+			}
+			tracks = append(tracks, video)
+
+		default:
+			width, height := parseResolution(profile.Params["resolution"])
+			tracks = append(tracks, dash.Representation{
+				ID:          dashVideoTrack,
+				ContentType: dash.ContentTypeVideo,
+				Codecs:      hls.H264CodecString("", hls.DefaultH264Level),
+				Width:       width,
+				Height:      height,
+			})
+		}
+	}
+
+	if profile.hasAudio() {
+		audio := dash.Representation{
+			ID:          dashAudioTrack,
+			ContentType: dash.ContentTypeAudio,
+			Codecs:      hls.AACCodecString,
+		}
+		if profile.Passthrough {
+			for _, codec := range codecs {
+				if codec.Type().IsAudio() {
+					audio.Codecs = hls.CodecString([]av.CodecData{codec})
+				}
+			}
+		} else if len(profile.Renditions) > 0 {
+			bandwidth, _ := hls.ParseBitrate(profile.Renditions[0].AudioBitrate)
+			audio.Bandwidth = bandwidth + bandwidth/10
+		}
+		tracks = append(tracks, audio)
+	}
+	return tracks
+}
+
+func readRepresentation(outputDir, playlist string) (dash.Representation, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, playlist))
+	if err != nil {
+		return dash.Representation{}, err
+	}
+
+	rep, err := dash.RepresentationFromPlaylist(data)
+	if err != nil {
+		return dash.Representation{}, fmt.Errorf("%s: %w", playlist, err)
+	}
+	if err := rep.ReadMediaTimes(outputDir); err != nil {
+		return dash.Representation{}, err
+	}
+	return rep, nil
+}
+
+// measureBandwidth returns the peak bitrate of the segments in the playlist,
+// for streams that are remuxed without a configured bitrate.
+func measureBandwidth(outputDir string, rep dash.Representation) int {
+	peak := 0
+	for _, segment := range rep.Segments {
+		info, err := os.Stat(filepath.Join(outputDir, segment.URI))
+		if err != nil || segment.Duration <= 0 {
+			continue
+		}
+		if bandwidth := int(float64(info.Size()*8) / segment.Duration.Seconds()); bandwidth > peak {
+			peak = bandwidth
+		}
+	}
+	return peak
+}
+
+func parseResolution(resolution string) (int, int) {
+	width, height, ok := strings.Cut(resolution, "x")
+	if !ok {
+		return 0, 0
+	}
+	w, _ := strconv.Atoi(width)
+	h, _ := strconv.Atoi(height)
+	return w, h
+}
@@ -0,0 +1,428 @@
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/hls"
+
+	"github.com/nareix/joy4/av"
+)
+
+type FakeTranscoder struct {
+	outputDir string
+	profile   TranscodeProfile
+	codecs    []av.CodecData
+	videoIdx  int
+	playlists []*fakePlaylist
+	packets   int
+	started   bool
+	finished  bool
+
+	frames    int64
+	lines     chan string
+	progress  chan string
+	progressR *io.PipeReader
+	progressW *io.PipeWriter
+	stderrR   *io.PipeReader
+	stderrW   *io.PipeWriter
+
+	done chan struct{}
+	err  error
+	mu   sync.Mutex
+}
+
+type fakeSegment struct {
+	name          string
+	discontinuity bool
+	dateTime      time.Time
+}
+
+func NewFakeTranscoder() *FakeTranscoder {
+	t := &FakeTranscoder{
+		videoIdx: -1,
+		lines:    make(chan string, 64),
+		progress: make(chan string, 64),
+		done:     make(chan struct{}),
+	}
+	t.progressR, t.progressW = io.Pipe()
+	t.stderrR, t.stderrW = io.Pipe()
+	return t
+}
+
+func NewFakeTranscoderFactory() TranscoderFactory {
+	return func() Transcoder {
+		return NewFakeTranscoder()
+	}
+}
+
+func (t *FakeTranscoder) Start(outputDir string, profile TranscodeProfile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started {
+		return fmt.Errorf("transcoder already started")
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	t.outputDir = outputDir
+	t.profile = profile
+	t.started = true
+
+	renditions := profile.Renditions
+	if profile.Passthrough {
+		renditions = nil
+	}
+
+	fmp4 := profile.Container == ContainerFMP4
+	if len(renditions) == 0 && !profile.DASH {
+		playlist := &fakePlaylist{name: "playlist.m3u8", segmentFormat: "segment_%03d" + profile.SegmentExtension()}
+		if fmp4 {
+			playlist.initName = "init.mp4"
+			playlist.timescale = fakeVideoTimescale
+		}
+		t.playlists = []*fakePlaylist{playlist}
+	} else {
+		for _, name := range profile.playlistNames() {
+			track := strings.TrimSuffix(strings.TrimPrefix(name, "playlist_"), ".m3u8")
+			playlist := &fakePlaylist{
+				name:          name,
+				segmentFormat: "segment_" + track + "_%03d" + profile.SegmentExtension(),
+			}
+			if fmp4 {
+				playlist.initName = "init_" + track + ".mp4"
+				playlist.timescale = fakeVideoTimescale
+				if profile.DASH && track == dashAudioTrack {
+					playlist.timescale = fakeAudioTimescale
+				}
+			}
+			t.playlists = append(t.playlists, playlist)
+		}
+	}
+
+	// Like FFmpeg's master_pl_name, the tracks of a single DASH stream are
+	// tied together by playlist.m3u8.
+	if profile.DASH && len(renditions) == 0 && profile.hasVideo() {
+		variant := hls.Variant{URI: VariantPlaylistName(dashVideoTrack), Bandwidth: 1000000}
+		if profile.hasAudio() {
+			variant.Audio = VariantPlaylistName(dashAudioTrack)
+		}
+		if err := hls.WriteMasterPlaylist(filepath.Join(outputDir, "playlist.m3u8"), []hls.Variant{variant}); err != nil {
+			return err
+		}
+	}
+
+	for _, playlist := range t.playlists {
+		playlist.dateTime = profile.DASH
+		if profile.Discontinuity {
+			playlist.load(outputDir)
+		}
+		if err := playlist.write(outputDir, profile.SegmentDuration); err != nil {
+			return err
+		}
+	}
+
+	go pump(t.lines, t.stderrW)
+	go pump(t.progress, t.progressW)
+	t.logLocked("fake transcoder started for %s", outputDir)
+
+	return nil
+}
+
+func (t *FakeTranscoder) WriteHeader(streams []av.CodecData) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started || t.finished {
+		return fmt.Errorf("transcoder not running")
+	}
+
+	t.codecs = streams
+	t.videoIdx = -1
+	for i, codec := range streams {
+		if codec.Type().IsVideo() {
+			t.videoIdx = i
+			break
+		}
+	}
+
+	for _, playlist := range t.playlists {
+		if playlist.initName == "" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(t.outputDir, playlist.initName), fakeInitSegment(playlist.timescale), 0644); err != nil {
+			return fmt.Errorf("failed to write init segment: %w", err)
+		}
+		t.logLocked("wrote %s", playlist.initName)
+	}
+	return nil
+}
+
+func (t *FakeTranscoder) WritePacket(pkt av.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started || t.finished {
+		return fmt.Errorf("transcoder not running")
+	}
+
+	t.packets++
+
+	if t.videoIdx < 0 || int(pkt.Idx) != t.videoIdx {
+		return nil
+	}
+
+	t.frames++
+	if !pkt.IsKeyFrame {
+		return nil
+	}
+
+	t.reportProgressLocked(pkt.Time)
+	return t.writeSegmentLocked(pkt.Data)
+}
+
+func (t *FakeTranscoder) WriteTrailer() error {
+	return nil
+}
+
+func (t *FakeTranscoder) Stop() error {
+	t.finish(nil)
+	return nil
+}
+
+func (t *FakeTranscoder) Fail(err error) {
+	t.finish(err)
+}
+
+func (t *FakeTranscoder) Wait() error {
+	<-t.done
+	return t.err
+}
+
+func (t *FakeTranscoder) Progress() io.Reader {
+	return t.progressR
+}
+
+func (t *FakeTranscoder) Stderr() io.Reader {
+	return t.stderrR
+}
+
+func (t *FakeTranscoder) Profile() TranscodeProfile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.profile
+}
+
+func (t *FakeTranscoder) Packets() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.packets
+}
+
+func (t *FakeTranscoder) Segments() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for _, playlist := range t.playlists {
+		for _, segment := range playlist.segments {
+			names = append(names, segment.name)
+		}
+	}
+	return names
+}
+
+func (t *FakeTranscoder) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.finished {
+		return
+	}
+
+	t.finished = true
+	t.err = err
+	close(t.lines)
+	close(t.progress)
+	close(t.done)
+}
+
+func (t *FakeTranscoder) logLocked(format string, args ...interface{}) {
+	select {
+	case t.lines <- fmt.Sprintf(format, args...):
+	default:
+	}
+}
+
+func (t *FakeTranscoder) reportProgressLocked(outTime time.Duration) {
+	block := fmt.Sprintf("frame=%d\nfps=25.00\nbitrate=1000.0kbits/s\nout_time_us=%d\ndup_frames=0\ndrop_frames=0\nspeed=1.00x\nprogress=continue",
+		t.frames, outTime.Microseconds())
+
+	select {
+	case t.progress <- block:
+	default:
+	}
+}
+
+func pump(lines chan string, w *io.PipeWriter) {
+	for line := range lines {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			break
+		}
+	}
+	w.Close()
+}
+
+func (t *FakeTranscoder) writeSegmentLocked(data []byte) error {
+	for _, playlist := range t.playlists {
+		name, err := playlist.addSegment(t.outputDir, data, t.profile.SegmentDuration, t.profile.windowSegments())
+		if err != nil {
+			return err
+		}
+		t.logLocked("wrote %s", name)
+
+		if err := playlist.write(t.outputDir, t.profile.SegmentDuration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fakePlaylist struct {
+	name          string
+	segmentFormat string
+	initName      string
+	timescale     uint32
+	dateTime      bool
+	segments      []fakeSegment
+	sequence      int
+	discSeq       int
+	discNext      bool
+}
+
+func (p *fakePlaylist) addSegment(outputDir string, data []byte, duration, window int) (string, error) {
+	number := p.sequence + len(p.segments)
+	name := fmt.Sprintf(p.segmentFormat, number)
+	if p.initName != "" {
+		data = fakeMediaSegment(uint64(number*duration)*uint64(p.timescale), data)
+	}
+	if err := os.WriteFile(filepath.Join(outputDir, name), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write segment: %w", err)
+	}
+	p.segments = append(p.segments, fakeSegment{name: name, discontinuity: p.discNext, dateTime: time.Now()})
+	p.discNext = false
+
+	if window > 0 {
+		for len(p.segments) > window {
+			os.Remove(filepath.Join(outputDir, p.segments[0].name))
+			if p.segments[0].discontinuity {
+				p.discSeq++
+			}
+			p.segments = p.segments[1:]
+			p.sequence++
+		}
+	}
+
+	return name, nil
+}
+
+func (p *fakePlaylist) write(outputDir string, targetDuration int) error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if p.initName != "" {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.sequence)
+	if p.discSeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discSeq)
+	}
+	if p.initName != "" {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", p.initName)
+	}
+	for _, segment := range p.segments {
+		if segment.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if p.dateTime {
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.dateTime.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		}
+		fmt.Fprintf(&b, "#EXTINF:%d.000000,\n%s\n", targetDuration, segment.name)
+	}
+
+	if err := os.WriteFile(filepath.Join(outputDir, p.name), []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write playlist: %w", err)
+	}
+	return nil
+}
+
+// load resumes numbering from a playlist left behind by a previous
+// transcoder, like FFmpeg's append_list flag.
+func (p *fakePlaylist) load(outputDir string) {
+	data, err := os.ReadFile(filepath.Join(outputDir, p.name))
+	if err != nil {
+		return
+	}
+
+	discontinuity := false
+	var dateTime time.Time
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			p.sequence, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+		case strings.HasPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"):
+			p.discSeq, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-DISCONTINUITY-SEQUENCE:"))
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+			dateTime, _ = time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"))
+		case line != "" && !strings.HasPrefix(line, "#"):
+			p.segments = append(p.segments, fakeSegment{name: line, discontinuity: discontinuity, dateTime: dateTime})
+			discontinuity = false
+		}
+	}
+	p.discNext = len(p.segments) > 0
+}
+
+// Timescales of the fMP4 tracks the fake transcoder writes, as FFmpeg uses
+// for H.264 and 48 kHz AAC.
+const (
+	fakeVideoTimescale = 90000
+	fakeAudioTimescale = 48000
+)
+
+// fakeInitSegment is a minimal fMP4 init segment, with only the boxes that
+// carry the track timescale.
+func fakeInitSegment(timescale uint32) []byte {
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], timescale)
+	return mp4Box("moov", mp4Box("trak", mp4Box("mdia", mp4Box("mdhd", mdhd))))
+}
+
+// fakeMediaSegment is a minimal fMP4 media segment starting at the given
+// decode time, with data as its media data.
+func fakeMediaSegment(decodeTime uint64, data []byte) []byte {
+	tfdt := make([]byte, 12)
+	tfdt[0] = 1
+	binary.BigEndian.PutUint64(tfdt[4:], decodeTime)
+	return append(mp4Box("moof", mp4Box("traf", mp4Box("tfdt", tfdt))), mp4Box("mdat", data)...)
+}
+
+func mp4Box(boxType string, payload []byte) []byte {
+	box := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(box, uint32(8+len(payload)))
+	copy(box[4:], boxType)
+	return append(box, payload...)
+}
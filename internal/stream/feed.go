@@ -0,0 +1,109 @@
+package stream
+
+import (
+	"errors"
+	"io"
+)
+
+// transcoderQueueSize is how many packets a transcoder may fall behind the
+// publisher before it is restarted.
+const transcoderQueueSize = 1024
+
+var errTranscoderStopped = errors.New("transcoder was stopped")
+
+// subscribeTranscoder returns the queue a new transcoder is fed from. Unlike
+// other subscribers it is not listed with the stream's subscribers.
+func (s *Stream) subscribeTranscoder() *Subscriber {
+	sub := s.newSubscriber("transcoder", transcoderQueueSize)
+
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	if s.subscribersClosed {
+		sub.closeWithError(io.EOF)
+		return sub
+	}
+	if s.transcoderSub != nil {
+		s.transcoderSub.closeWithError(errTranscoderStopped)
+	}
+	s.transcoderSub = sub
+
+	// A restarted transcoder starts from the latest keyframe, so its first
+	// segment is decodable.
+	if s.codecs != nil {
+		sub.sendHeader(s.codecs)
+		sub.pending = s.gopCache.lastGOP()
+	}
+	return sub
+}
+
+func (s *Stream) unsubscribeTranscoder(sub *Subscriber, err error) {
+	if sub == nil {
+		return
+	}
+
+	s.subMu.Lock()
+	if s.transcoderSub == sub {
+		s.transcoderSub = nil
+	}
+	s.subMu.Unlock()
+
+	sub.closeWithError(err)
+}
+
+// feedTranscoder writes the stream from sub to the transcoder, from the first
+// video keyframe on, until the stream ends or the transcoder is stopped or
+// fails, and closes fed then. A transcoder that falls too far behind is
+// stopped, so it is restarted rather than holding up the publisher.
+func (s *Stream) feedTranscoder(transcoder Transcoder, sub *Subscriber, fed chan struct{}) {
+	defer close(fed)
+
+	codecs, err := sub.Streams()
+	if err != nil {
+		return
+	}
+	if err := transcoder.WriteHeader(codecs); err != nil {
+		s.logger.Errorf("failed to write header to transcoder for stream %s: %v", s.ID, err)
+		s.unsubscribeTranscoder(sub, err)
+		return
+	}
+
+	videoIdx := -1
+	for i, codec := range codecs {
+		if codec.Type().IsVideo() {
+			videoIdx = i
+			break
+		}
+	}
+	keyFrame := videoIdx < 0
+
+	for {
+		pkt, err := sub.ReadPacket()
+		switch {
+		case err == io.EOF:
+			if err := transcoder.WriteTrailer(); err != nil {
+				s.logger.Errorf("failed to write trailer to transcoder for stream %s: %v", s.ID, err)
+			}
+			return
+		case errors.Is(err, ErrSubscriberTooSlow):
+			s.logger.Errorf("Transcoder for stream %s fell too far behind the publisher, stopping it", s.ID)
+			transcoder.Stop()
+			return
+		case err != nil:
+			return
+		}
+
+		if !keyFrame {
+			if int(pkt.Idx) != videoIdx || !pkt.IsKeyFrame {
+				continue
+			}
+			keyFrame = true
+		}
+
+		if err := transcoder.WritePacket(pkt); err != nil {
+			s.logger.Errorf("failed to write packet to transcoder for stream %s: %v", s.ID, err)
+			s.unsubscribeTranscoder(sub, err)
+			return
+		}
+	}
+}
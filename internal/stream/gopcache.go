@@ -0,0 +1,66 @@
+package stream
+
+import (
+	"github.com/nareix/joy4/av"
+)
+
+type gopCache struct {
+	maxGOPs  int
+	videoIdx int
+	gops     [][]av.Packet
+}
+
+func (c *gopCache) reset(codecs []av.CodecData) {
+	c.videoIdx = -1
+	c.gops = nil
+
+	for i, codec := range codecs {
+		if codec.Type().IsVideo() {
+			c.videoIdx = i
+			break
+		}
+	}
+}
+
+func (c *gopCache) add(pkt av.Packet) {
+	if c.maxGOPs <= 0 || c.videoIdx < 0 {
+		return
+	}
+
+	if int(pkt.Idx) == c.videoIdx && pkt.IsKeyFrame {
+		c.gops = append(c.gops, []av.Packet{pkt})
+		if len(c.gops) > c.maxGOPs {
+			c.gops[0] = nil
+			c.gops = c.gops[1:]
+		}
+		return
+	}
+
+	if len(c.gops) == 0 {
+		return
+	}
+
+	last := len(c.gops) - 1
+	c.gops[last] = append(c.gops[last], pkt)
+}
+
+// lastGOP returns the packets from the latest keyframe on.
+func (c *gopCache) lastGOP() []av.Packet {
+	if len(c.gops) == 0 {
+		return nil
+	}
+	return append([]av.Packet(nil), c.gops[len(c.gops)-1]...)
+}
+
+func (c *gopCache) packets() []av.Packet {
+	count := 0
+	for _, gop := range c.gops {
+		count += len(gop)
+	}
+
+	pkts := make([]av.Packet, 0, count)
+	for _, gop := range c.gops {
+		pkts = append(pkts, gop...)
+	}
+	return pkts
+}
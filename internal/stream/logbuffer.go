@@ -0,0 +1,110 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultLogBufferSize = 500
+
+type LogLine struct {
+	Time time.Time `json:"time"`
+	Line string    `json:"line"`
+}
+
+type logBuffer struct {
+	lines     []LogLine
+	next      int
+	full      bool
+	followers map[chan LogLine]struct{}
+	closed    bool
+	mu        sync.Mutex
+}
+
+func newLogBuffer(size int) *logBuffer {
+	if size <= 0 {
+		size = defaultLogBufferSize
+	}
+	return &logBuffer{
+		lines:     make([]LogLine, size),
+		followers: make(map[chan LogLine]struct{}),
+	}
+}
+
+func (b *logBuffer) add(line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := LogLine{Time: time.Now(), Line: line}
+	b.lines[b.next] = entry
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for ch := range b.followers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+func (b *logBuffer) tail(n int) []LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	result := make([]LogLine, 0, n)
+	for i := count - n; i < count; i++ {
+		idx := i
+		if b.full {
+			idx = (b.next + i) % len(b.lines)
+		}
+		result = append(result, b.lines[idx])
+	}
+	return result
+}
+
+func (b *logBuffer) follow() (<-chan LogLine, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan LogLine, 64)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.followers[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if _, ok := b.followers[ch]; ok {
+				delete(b.followers, ch)
+				close(ch)
+			}
+		})
+	}
+}
+
+func (b *logBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.followers {
+		delete(b.followers, ch)
+		close(ch)
+	}
+}
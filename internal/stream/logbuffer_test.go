@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+)
+
+func TestLogBuffer_KeepsLastLines(t *testing.T) {
+	buffer := newLogBuffer(3)
+
+	if lines := buffer.tail(10); len(lines) != 0 {
+		t.Errorf("expected empty buffer, got %v", lines)
+	}
+
+	for i := 0; i < 5; i++ {
+		buffer.add(fmt.Sprintf("line %d", i))
+	}
+
+	lines := buffer.tail(0)
+	if len(lines) != 3 || lines[0].Line != "line 2" || lines[2].Line != "line 4" {
+		t.Errorf("expected last 3 lines, got %v", lines)
+	}
+
+	lines = buffer.tail(2)
+	if len(lines) != 2 || lines[0].Line != "line 3" || lines[1].Line != "line 4" {
+		t.Errorf("expected last 2 lines, got %v", lines)
+	}
+}
+
+func TestLogBuffer_Follow(t *testing.T) {
+	buffer := newLogBuffer(10)
+
+	lines, cancel := buffer.follow()
+	buffer.add("hello")
+
+	select {
+	case line := <-lines:
+		if line.Line != "hello" {
+			t.Errorf("unexpected line %q", line.Line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for followed line")
+	}
+
+	cancel()
+	if _, ok := <-lines; ok {
+		t.Error("expected follower channel to be closed after cancel")
+	}
+
+	lines, _ = buffer.follow()
+	buffer.close()
+	if _, ok := <-lines; ok {
+		t.Error("expected follower channel to be closed with the buffer")
+	}
+}
+
+func TestStream_CapturesTranscoderStderr(t *testing.T) {
+	sm, _ := newFakeStreamManager()
+
+	stream := sm.CreateStream("live", "test", t.TempDir())
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	defer stream.Stop()
+
+	stream.WriteHeader(testCodecs())
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("frame")})
+
+	testutil.WaitFor(t, "stderr to be captured", func() bool {
+		lines := stream.Logs(1)
+		return len(lines) == 1 && lines[0].Line == "wrote segment_000.ts"
+	})
+}
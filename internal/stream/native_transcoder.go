@@ -0,0 +1,172 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/hls"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	SegmenterFFmpeg = "ffmpeg"
+	SegmenterNative = "native"
+)
+
+// NativeTranscoder remuxes H.264/AAC into HLS in-process with hls.Segmenter,
+// so passthrough streams do not need FFmpeg.
+type NativeTranscoder struct {
+	segmenter *hls.Segmenter
+	videoIdx  int
+	frames    int64
+	started   bool
+	finished  bool
+
+	lines     chan string
+	progress  chan string
+	progressR *io.PipeReader
+	progressW *io.PipeWriter
+	stderrR   *io.PipeReader
+	stderrW   *io.PipeWriter
+
+	done chan struct{}
+	mu   sync.Mutex
+}
+
+func NewNativeTranscoder() *NativeTranscoder {
+	t := &NativeTranscoder{
+		videoIdx: -1,
+		lines:    make(chan string, 64),
+		progress: make(chan string, 64),
+		done:     make(chan struct{}),
+	}
+	t.progressR, t.progressW = io.Pipe()
+	t.stderrR, t.stderrW = io.Pipe()
+	return t
+}
+
+func (t *NativeTranscoder) Start(outputDir string, profile TranscodeProfile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started {
+		return fmt.Errorf("transcoder already started")
+	}
+
+	t.segmenter = hls.NewSegmenter(outputDir, time.Duration(profile.SegmentDuration)*time.Second, profile.windowSegments())
+	t.segmenter.SetSegmentCallback(t.segmentWritten)
+	if profile.PartDuration > 0 {
+		t.segmenter.SetPartDuration(profile.PartDuration)
+	}
+	// A restarted stream continues its playlist so players keep going.
+	if profile.Discontinuity {
+		if err := t.segmenter.Resume(); err != nil {
+			return err
+		}
+	}
+	t.started = true
+
+	go pump(t.lines, t.stderrW)
+	go pump(t.progress, t.progressW)
+
+	return nil
+}
+
+func (t *NativeTranscoder) WriteHeader(streams []av.CodecData) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started || t.finished {
+		return fmt.Errorf("transcoder not running")
+	}
+
+	t.videoIdx = -1
+	for i, codec := range streams {
+		if codec.Type().IsVideo() {
+			t.videoIdx = i
+			break
+		}
+	}
+	return t.segmenter.WriteHeader(streams)
+}
+
+func (t *NativeTranscoder) WritePacket(pkt av.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started || t.finished {
+		return fmt.Errorf("transcoder not running")
+	}
+
+	if int(pkt.Idx) == t.videoIdx {
+		t.frames++
+	}
+	return t.segmenter.WritePacket(pkt)
+}
+
+func (t *NativeTranscoder) WriteTrailer() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started || t.finished {
+		return nil
+	}
+	return t.segmenter.WriteTrailer()
+}
+
+func (t *NativeTranscoder) Stop() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.started || t.finished {
+		return nil
+	}
+
+	err := t.segmenter.WriteTrailer()
+	t.finished = true
+	close(t.lines)
+	close(t.progress)
+	close(t.done)
+	return err
+}
+
+func (t *NativeTranscoder) Wait() error {
+	<-t.done
+	return nil
+}
+
+func (t *NativeTranscoder) WaitForPart(ctx context.Context, msn, part int) error {
+	t.mu.Lock()
+	segmenter := t.segmenter
+	t.mu.Unlock()
+
+	if segmenter == nil {
+		return ErrBlockingUnsupported
+	}
+	return segmenter.WaitForPart(ctx, msn, part)
+}
+
+func (t *NativeTranscoder) Progress() io.Reader {
+	return t.progressR
+}
+
+func (t *NativeTranscoder) Stderr() io.Reader {
+	return t.stderrR
+}
+
+// segmentWritten runs with t.mu held, from inside the segmenter.
+func (t *NativeTranscoder) segmentWritten(segment hls.Segment) {
+	select {
+	case t.lines <- fmt.Sprintf("wrote %s (%.3fs)", segment.Name, segment.Duration.Seconds()):
+	default:
+	}
+
+	select {
+	case t.progress <- fmt.Sprintf("frame=%d\nprogress=continue", t.frames):
+	default:
+	}
+}
@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TranscodeStats struct {
+	Frame       int64     `json:"frame"`
+	FPS         float64   `json:"fps"`
+	BitrateKbps float64   `json:"bitrate_kbps"`
+	Speed       float64   `json:"speed"`
+	OutTime     float64   `json:"out_time_seconds"`
+	DropFrames  int64     `json:"drop_frames"`
+	DupFrames   int64     `json:"dup_frames"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// parseProgress reads the key=value blocks FFmpeg writes with -progress and
+// calls fn once per block, i.e. on every "progress=" line.
+func parseProgress(r io.Reader, fn func(TranscodeStats)) {
+	var stats TranscodeStats
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "frame":
+			stats.Frame, _ = strconv.ParseInt(value, 10, 64)
+		case "fps":
+			stats.FPS, _ = strconv.ParseFloat(value, 64)
+		case "bitrate":
+			stats.BitrateKbps, _ = strconv.ParseFloat(strings.TrimSuffix(value, "kbits/s"), 64)
+		case "speed":
+			stats.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				stats.OutTime = time.Duration(us * int64(time.Microsecond)).Seconds()
+			}
+		case "out_time":
+			if d, ok := parseOutTime(value); ok {
+				stats.OutTime = d.Seconds()
+			}
+		case "drop_frames":
+			stats.DropFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "dup_frames":
+			stats.DupFrames, _ = strconv.ParseInt(value, 10, 64)
+		case "progress":
+			stats.UpdatedAt = time.Now()
+			fn(stats)
+		}
+	}
+}
+
+func parseOutTime(value string) (time.Duration, bool) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
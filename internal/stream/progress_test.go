@@ -0,0 +1,129 @@
+package stream
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseProgress(t *testing.T) {
+	input := `frame=120
+fps=29.97
+stream_0_0_q=23.0
+bitrate=1024.5kbits/s
+total_size=524288
+out_time_us=4000000
+out_time_ms=4000000
+out_time=00:00:04.000000
+dup_frames=2
+drop_frames=1
+speed=0.98x
+progress=continue
+frame=150
+fps=30.00
+bitrate=N/A
+out_time=00:01:05.500000
+speed=N/A
+progress=end
+`
+
+	var blocks []TranscodeStats
+	parseProgress(strings.NewReader(input), func(stats TranscodeStats) {
+		blocks = append(blocks, stats)
+	})
+
+	if len(blocks) != 2 {
+		t.Fatalf("expected 2 progress blocks, got %d", len(blocks))
+	}
+
+	first := blocks[0]
+	if first.Frame != 120 || first.FPS != 29.97 || first.BitrateKbps != 1024.5 || first.Speed != 0.98 {
+		t.Errorf("unexpected first block: %+v", first)
+	}
+	if first.OutTime != 4 || first.DupFrames != 2 || first.DropFrames != 1 {
+		t.Errorf("unexpected first block counters: %+v", first)
+	}
+	if first.UpdatedAt.IsZero() {
+		t.Error("expected UpdatedAt to be set")
+	}
+
+	second := blocks[1]
+	if second.Frame != 150 || second.BitrateKbps != 0 || second.Speed != 0 {
+		t.Errorf("unexpected second block: %+v", second)
+	}
+	if second.OutTime != (65500 * time.Millisecond).Seconds() {
+		t.Errorf("expected out_time 65.5s, got %f", second.OutTime)
+	}
+}
+
+func TestStream_CollectsTranscoderProgress(t *testing.T) {
+	sm, _ := newFakeStreamManager()
+
+	stream := sm.CreateStream("live", "test", t.TempDir())
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	defer stream.Stop()
+
+	stream.WriteHeader(testCodecs())
+	for i := 0; i < 3; i++ {
+		stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Time: time.Duration(i) * time.Second, Data: []byte("frame")})
+	}
+
+	testutil.WaitFor(t, "progress stats", func() bool {
+		return stream.Stats().Frame == 3
+	})
+
+	stats := stream.Stats()
+	if stats.OutTime != 2 || stats.Speed != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if status := stream.GetStatus(); status["transcode"].(TranscodeStats).Frame != 3 {
+		t.Errorf("expected transcode stats in status, got %v", status["transcode"])
+	}
+}
+
+// progressTranscoder reports progress from a pipe the test writes to.
+type progressTranscoder struct {
+	*FakeTranscoder
+	progress io.Reader
+}
+
+func (t progressTranscoder) Progress() io.Reader {
+	return t.progress
+}
+
+func TestStream_DrainsProgressAfterOverlongLine(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+
+	stream := &Stream{ID: "live/test", logger: logrus.New()}
+	go stream.readProgress(progressTranscoder{NewFakeTranscoder(), r})
+
+	written := make(chan error, 1)
+	go func() {
+		if _, err := io.WriteString(w, strings.Repeat("x", bufio.MaxScanTokenSize+1)); err != nil {
+			written <- err
+			return
+		}
+		_, err := io.WriteString(w, "frame=1\nprogress=continue\n")
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected progress to be drained after an over-long line")
+	}
+}
@@ -1,45 +1,115 @@
 package stream
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
+	"io/fs"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"golang-rtmp/internal/hls"
+
+	"github.com/nareix/joy4/av"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	ErrBlockingUnsupported = errors.New("blocking playlist reload is not supported for this stream")
+	ErrStreamActive        = errors.New("stream is already active")
+	ErrStreamInactive      = errors.New("stream is not active")
+	ErrStreamEnded         = errors.New("stream has ended")
+	ErrNoProfile           = errors.New("stream has never been transcoded")
+)
+
+type PartWaiter interface {
+	WaitForPart(ctx context.Context, msn, part int) error
+}
+
 type Stream struct {
-	ID           string
-	AppName      string
-	StreamName   string
-	OutputDir    string
-	FFmpegCmd    *exec.Cmd
-	FFmpegCtx    context.Context
-	FFmpegCancel context.CancelFunc
-	IsActive     bool
-	StartTime    time.Time
-	LastUpdate   time.Time
-	mu           sync.RWMutex
-	logger       *logrus.Logger
+	ID         string
+	AppName    string
+	StreamName string
+	OutputDir  string
+	IsActive   bool
+	StartTime  time.Time
+	LastUpdate time.Time
+	mu         sync.RWMutex
+	logger     *logrus.Logger
+
+	transcoderFactory TranscoderFactory
+	transcoder        Transcoder
+	profile           TranscodeProfile
+	hasProfile        bool
+	codecs            []av.CodecData
+	feedSub           *Subscriber
+	fed               chan struct{}
+	ended             bool
+	writeMu           sync.Mutex
+
+	restartPolicy RestartPolicy
+	restarts      int
+	restartTimes  []time.Time
+	restartTimer  *time.Timer
+
+	stats   TranscodeStats
+	statsMu sync.RWMutex
+	logs    *logBuffer
+
+	subscribers       map[*Subscriber]struct{}
+	subscribersClosed bool
+	nextViewerID      uint64
+	transcoderSub     *Subscriber
+	gopCache          gopCache
+	subMu             sync.Mutex
 }
 
 type StreamManager struct {
-	streams map[string]*Stream
-	mu      sync.RWMutex
-	logger  *logrus.Logger
+	streams           map[string]*Stream
+	gopCacheSize      int
+	logBufferSize     int
+	transcoderFactory TranscoderFactory
+	restartPolicy     RestartPolicy
+	mu                sync.RWMutex
+	logger            *logrus.Logger
 }
 
 func NewStreamManager(logger *logrus.Logger) *StreamManager {
 	return &StreamManager{
-		streams: make(map[string]*Stream),
-		logger:  logger,
+		streams:           make(map[string]*Stream),
+		transcoderFactory: NewFFmpegTranscoderFactory(),
+		restartPolicy:     DefaultRestartPolicy(),
+		logger:            logger,
 	}
 }
 
+func (sm *StreamManager) SetTranscoderFactory(factory TranscoderFactory) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.transcoderFactory = factory
+}
+
+func (sm *StreamManager) SetGOPCacheSize(size int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.gopCacheSize = size
+}
+
+func (sm *StreamManager) SetLogBufferSize(size int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.logBufferSize = size
+}
+
+func (sm *StreamManager) SetRestartPolicy(policy RestartPolicy) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.restartPolicy = policy
+}
+
 func (sm *StreamManager) CreateStream(appName, streamName, outputDir string) *Stream {
 	streamID := fmt.Sprintf("%s/%s", appName, streamName)
 
@@ -59,7 +129,12 @@ func (sm *StreamManager) CreateStream(appName, streamName, outputDir string) *St
 		StartTime:  time.Now(),
 		LastUpdate: time.Now(),
 		logger:     sm.logger,
+
+		transcoderFactory: sm.transcoderFactory,
+		restartPolicy:     sm.restartPolicy,
+		logs:              newLogBuffer(sm.logBufferSize),
 	}
+	stream.SetGOPCacheSize(sm.gopCacheSize)
 
 	sm.streams[streamID] = stream
 	sm.logger.Infof("Created stream: %s", streamID)
@@ -88,62 +163,135 @@ func (sm *StreamManager) ListStreams() []*Stream {
 
 func (sm *StreamManager) RemoveStream(streamID string) {
 	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	stream, exists := sm.streams[streamID]
+	delete(sm.streams, streamID)
+	sm.mu.Unlock()
 
-	if stream, exists := sm.streams[streamID]; exists {
-		stream.Stop()
-		delete(sm.streams, streamID)
-		sm.logger.Infof("Removed stream: %s", streamID)
+	if !exists {
+		return
 	}
+
+	// Stopping may wait for FFmpeg to finish its last segment, so it runs
+	// without holding up lookups of other streams.
+	stream.WriteTrailer()
+	stream.Stop()
+	stream.logs.close()
+	sm.logger.Infof("Removed stream: %s", streamID)
 }
 
-func (s *Stream) StartFFmpeg(ffmpegPath string, params map[string]string, segmentDuration, playlistWindow int) error {
+func (s *Stream) StartTranscoder(profile TranscodeProfile) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.IsActive {
-		return fmt.Errorf("stream %s is already active", s.ID)
+		return fmt.Errorf("%w: %s", ErrStreamActive, s.ID)
+	}
+
+	if err := profile.Validate(); err != nil {
+		return fmt.Errorf("invalid transcode profile: %w", err)
 	}
 
-	if err := os.MkdirAll(s.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+	if err := s.startTranscoderLocked(profile); err != nil {
+		return err
 	}
 
-	playlistPath := filepath.Join(s.OutputDir, "playlist.m3u8")
-	segmentPattern := filepath.Join(s.OutputDir, "segment_%03d.ts")
+	s.restartTimes = nil
+	s.IsActive = true
+	s.logger.Infof("Started transcoder for stream: %s", s.ID)
+
+	return nil
+}
 
-	args := []string{
-		"-i", "rtmp://localhost/live/" + s.StreamName,
-		"-c:v", params["video_codec"],
-		"-c:a", params["audio_codec"],
-		"-b:v", params["video_bitrate"],
-		"-b:a", params["audio_bitrate"],
-		"-s", params["resolution"],
-		"-r", params["fps"],
-		"-f", "hls",
-		"-hls_time", fmt.Sprintf("%d", segmentDuration),
-		"-hls_list_size", fmt.Sprintf("%d", playlistWindow),
-		"-hls_flags", "delete_segments",
-		"-hls_segment_filename", segmentPattern,
-		playlistPath,
+func (s *Stream) startTranscoderLocked(profile TranscodeProfile) error {
+	factory := s.transcoderFactory
+	if factory == nil {
+		factory = NewFFmpegTranscoderFactory()
 	}
 
-	s.FFmpegCtx, s.FFmpegCancel = context.WithCancel(context.Background())
-	s.FFmpegCmd = exec.CommandContext(s.FFmpegCtx, ffmpegPath, args...)
+	if len(profile.Renditions) > 0 && !profile.Passthrough {
+		masterPath := filepath.Join(s.OutputDir, "master.m3u8")
+		if err := hls.WriteMasterPlaylist(masterPath, masterVariants(profile)); err != nil {
+			return err
+		}
+	}
+
+	var transcoder Transcoder
+	if profile.Segmenter == SegmenterNative {
+		transcoder = NewNativeTranscoder()
+	} else {
+		transcoder = factory()
+	}
+	if err := transcoder.Start(s.OutputDir, profile); err != nil {
+		return fmt.Errorf("failed to start transcoder: %w", err)
+	}
+
+	s.statsMu.Lock()
+	s.stats = TranscodeStats{}
+	s.statsMu.Unlock()
+
+	go s.readProgress(transcoder)
+	go s.readStderr(transcoder)
+
+	s.feedSub = s.subscribeTranscoder()
+	s.fed = make(chan struct{})
+	go s.feedTranscoder(transcoder, s.feedSub, s.fed)
 
-	s.FFmpegCmd.Stdout = os.Stdout
-	s.FFmpegCmd.Stderr = os.Stderr
+	s.writeMu.Lock()
+	s.transcoder = transcoder
+	s.writeMu.Unlock()
+
+	s.profile = profile
+	s.hasProfile = true
+
+	go s.monitorTranscoder(transcoder)
+
+	return nil
+}
+
+// RestartTranscoder starts transcoding a live stream again with its current
+// profile, after it was stopped or its restarts gave up.
+func (s *Stream) RestartTranscoder() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if err := s.FFmpegCmd.Start(); err != nil {
-		s.FFmpegCancel()
-		return fmt.Errorf("failed to start FFmpeg: %w", err)
+	if s.IsActive {
+		return fmt.Errorf("%w: %s", ErrStreamActive, s.ID)
+	}
+	s.writeMu.Lock()
+	ended := s.ended
+	s.writeMu.Unlock()
+	if ended {
+		return fmt.Errorf("%w: %s", ErrStreamEnded, s.ID)
+	}
+	if !s.hasProfile {
+		return fmt.Errorf("%w: %s", ErrNoProfile, s.ID)
+	}
+
+	profile := s.profile
+	profile.Discontinuity = true
+	if err := s.startTranscoderLocked(profile); err != nil {
+		return err
 	}
 
+	s.restartTimes = nil
 	s.IsActive = true
-	s.logger.Infof("Started FFmpeg for stream: %s", s.ID)
+	s.logger.Infof("Restarted transcoder for stream: %s", s.ID)
 
-	go s.monitorFFmpeg()
+	return nil
+}
 
+// StopTranscoder stops transcoding while the publisher stays connected, so
+// players, recordings and pushes keep receiving the stream.
+func (s *Stream) StopTranscoder() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.IsActive {
+		return fmt.Errorf("%w: %s", ErrStreamInactive, s.ID)
+	}
+
+	s.stopLocked()
+	s.logger.Infof("Stopped transcoder for stream: %s", s.ID)
 	return nil
 }
 
@@ -155,30 +303,203 @@ func (s *Stream) Stop() {
 		return
 	}
 
-	if s.FFmpegCancel != nil {
-		s.FFmpegCancel()
+	s.stopLocked()
+	s.logger.Infof("Stopped stream: %s", s.ID)
+}
+
+func (s *Stream) stopLocked() {
+	if s.restartTimer != nil {
+		s.restartTimer.Stop()
+		s.restartTimer = nil
 	}
 
-	if s.FFmpegCmd != nil && s.FFmpegCmd.Process != nil {
-		if err := s.FFmpegCmd.Process.Kill(); err != nil {
-			s.logger.Errorf("failed to kill FFmpeg process for stream %s: %v", s.ID, err)
+	s.writeMu.Lock()
+	ended := s.ended
+	s.writeMu.Unlock()
+
+	if s.transcoder != nil {
+		// A stream that ended has its queued packets and the trailer written
+		// before the transcoder is stopped.
+		if ended {
+			select {
+			case <-s.fed:
+			case <-time.After(ffmpegDrainTimeout):
+			}
+		}
+		s.unsubscribeTranscoder(s.feedSub, errTranscoderStopped)
+
+		if err := s.transcoder.Stop(); err != nil {
+			s.logger.Errorf("failed to stop transcoder for stream %s: %v", s.ID, err)
 		}
 	}
 
+	s.writeMu.Lock()
+	s.transcoder = nil
+	s.writeMu.Unlock()
+
+	if ended {
+		s.finalizeDVRLocked()
+	}
+
 	s.IsActive = false
-	s.logger.Infof("Stopped stream: %s", s.ID)
 }
 
-func (s *Stream) monitorFFmpeg() {
-	err := s.FFmpegCmd.Wait()
+func (s *Stream) monitorTranscoder(transcoder Transcoder) {
+	err := transcoder.Wait()
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err != nil && s.IsActive {
-		s.logger.Errorf("FFmpeg process for stream %s exited with error: %v", s.ID, err)
+	if s.transcoder != transcoder || !s.IsActive {
+		return
+	}
+
+	if err != nil {
+		s.logger.Errorf("Transcoder for stream %s exited with error: %v", s.ID, err)
+	} else {
+		s.logger.Infof("Transcoder for stream %s exited", s.ID)
+	}
+
+	s.unsubscribeTranscoder(s.feedSub, errTranscoderStopped)
+
+	s.writeMu.Lock()
+	s.transcoder = nil
+	ended := s.ended
+	s.writeMu.Unlock()
+
+	if ended {
+		s.finalizeDVRLocked()
 		s.IsActive = false
+		return
+	}
+
+	s.scheduleRestartLocked()
+}
+
+// finalizeDVRLocked turns the DVR playlists of a stream whose publisher has
+// left into VOD playlists, so the recorded window stays watchable.
+func (s *Stream) finalizeDVRLocked() {
+	if s.profile.DVRWindow <= 0 {
+		return
 	}
+	for _, name := range s.profile.playlistNames() {
+		err := hls.FinalizePlaylist(filepath.Join(s.OutputDir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.logger.Errorf("failed to finalize DVR playlist %s for stream %s: %v", name, s.ID, err)
+		}
+	}
+}
+
+func (s *Stream) SetGOPCacheSize(size int) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	s.gopCache.maxGOPs = size
+}
+
+// WriteHeader, WritePacket and WriteTrailer hand the stream to its
+// subscribers and transcoder, which read it from their own queues.
+func (s *Stream) WriteHeader(streams []av.CodecData) error {
+	s.broadcastHeader(streams)
+	return nil
+}
+
+func (s *Stream) WritePacket(pkt av.Packet) error {
+	s.broadcastPacket(pkt)
+	return nil
+}
+
+func (s *Stream) WriteTrailer() error {
+	s.writeMu.Lock()
+	s.ended = true
+	s.writeMu.Unlock()
+
+	s.closeSubscribers()
+	return nil
+}
+
+// WaitForPart holds an LL-HLS blocking playlist reload until the requested
+// segment or part is available, for at most three target durations.
+func (s *Stream) WaitForPart(ctx context.Context, msn, part int) error {
+	s.mu.RLock()
+	lowLatency := s.profile.PartDuration > 0
+	timeout := 3 * time.Duration(s.profile.SegmentDuration) * time.Second
+	s.mu.RUnlock()
+
+	s.writeMu.Lock()
+	waiter, ok := s.transcoder.(PartWaiter)
+	s.writeMu.Unlock()
+
+	if !lowLatency || !ok {
+		return ErrBlockingUnsupported
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return waiter.WaitForPart(ctx, msn, part)
+}
+
+func (s *Stream) segmenterName() string {
+	if s.profile.Segmenter == "" {
+		return SegmenterFFmpeg
+	}
+	return s.profile.Segmenter
+}
+
+func (s *Stream) containerName() string {
+	if s.profile.Container == "" {
+		return ContainerTS
+	}
+	return s.profile.Container
+}
+
+func (s *Stream) readProgress(transcoder Transcoder) {
+	parseProgress(transcoder.Progress(), func(stats TranscodeStats) {
+		s.statsMu.Lock()
+		s.stats = stats
+		s.statsMu.Unlock()
+	})
+	// The parser stops early on an over-long line; FFmpeg must not block on
+	// a full pipe then.
+	io.Copy(io.Discard, transcoder.Progress())
+}
+
+func (s *Stream) readStderr(transcoder Transcoder) {
+	logger := s.logger.WithField("stream_id", s.ID)
+
+	scanner := bufio.NewScanner(transcoder.Stderr())
+	for scanner.Scan() {
+		line := scanner.Text()
+		if s.logs != nil {
+			s.logs.add(line)
+		}
+		logger.Info(line)
+	}
+	io.Copy(io.Discard, transcoder.Stderr())
+}
+
+func (s *Stream) Logs(tail int) []LogLine {
+	if s.logs == nil {
+		return nil
+	}
+	return s.logs.tail(tail)
+}
+
+func (s *Stream) FollowLogs() (<-chan LogLine, func()) {
+	if s.logs == nil {
+		ch := make(chan LogLine)
+		close(ch)
+		return ch, func() {}
+	}
+	return s.logs.follow()
+}
+
+func (s *Stream) Stats() TranscodeStats {
+	s.statsMu.RLock()
+	defer s.statsMu.RUnlock()
+	return s.stats
 }
 
 func (s *Stream) UpdateLastActivity() {
@@ -199,5 +520,15 @@ func (s *Stream) GetStatus() map[string]interface{} {
 		"start_time":  s.StartTime,
 		"last_update": s.LastUpdate,
 		"output_dir":  s.OutputDir,
+		"subscribers": s.SubscriberCount(),
+		"restarts":    s.restarts,
+		"restarting":  s.restartTimer != nil,
+		"transcode":   s.Stats(),
+		"passthrough": s.profile.Passthrough,
+		"segmenter":   s.segmenterName(),
+		"container":   s.containerName(),
+		"dash":        s.profile.DASH,
+		"low_latency": s.profile.PartDuration > 0,
+		"dvr_window":  int(s.profile.DVRWindow.Seconds()),
 	}
 }
@@ -0,0 +1,304 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+var (
+	ErrSubscriberTooSlow = errors.New("subscriber fell too far behind the publisher")
+	ErrViewerKicked      = errors.New("viewer was kicked")
+	ErrViewerNotFound    = errors.New("viewer not found")
+)
+
+// Viewer is a subscriber that plays a stream for a client, as opposed to a
+// recorder or push, and can be kicked through the API.
+type Viewer struct {
+	ID         string    `json:"id"`
+	Protocol   string    `json:"protocol"`
+	RemoteAddr string    `json:"remote_addr"`
+	StartTime  time.Time `json:"start_time"`
+}
+
+type Subscriber struct {
+	ID string
+
+	viewer     *Viewer
+	disconnect func()
+
+	stream  *Stream
+	pending []av.Packet
+	packets chan av.Packet
+	header  chan struct{}
+	done    chan struct{}
+	codecs  []av.CodecData
+	err     error
+	once    sync.Once
+}
+
+func (s *Stream) Subscribe(id string, queueSize int) *Subscriber {
+	sub := s.newSubscriber(id, queueSize)
+
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	// A stream that has ended will never send anything again.
+	if s.subscribersClosed {
+		sub.closeWithError(io.EOF)
+		return sub
+	}
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[*Subscriber]struct{})
+	}
+	s.subscribers[sub] = struct{}{}
+
+	if s.codecs != nil {
+		sub.codecs = s.codecs
+		sub.pending = s.gopCache.packets()
+		close(sub.header)
+	}
+
+	s.logger.Infof("Subscriber %s joined stream %s", id, s.ID)
+
+	return sub
+}
+
+func (s *Stream) newSubscriber(id string, queueSize int) *Subscriber {
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+
+	return &Subscriber{
+		ID:      id,
+		stream:  s,
+		packets: make(chan av.Packet, queueSize),
+		header:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *Stream) Unsubscribe(sub *Subscriber) {
+	s.subMu.Lock()
+	_, exists := s.subscribers[sub]
+	delete(s.subscribers, sub)
+	s.subMu.Unlock()
+
+	sub.closeWithError(io.EOF)
+
+	if exists {
+		s.logger.Infof("Subscriber %s left stream %s", sub.ID, s.ID)
+	}
+}
+
+// SetViewer lists the subscriber as a client's player and returns its viewer
+// ID. disconnect, if set, closes the client's connection when it is kicked.
+func (sub *Subscriber) SetViewer(protocol, remoteAddr string, disconnect func()) string {
+	s := sub.stream
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.nextViewerID++
+	sub.viewer = &Viewer{
+		ID:         strconv.FormatUint(s.nextViewerID, 10),
+		Protocol:   protocol,
+		RemoteAddr: remoteAddr,
+		StartTime:  time.Now(),
+	}
+	sub.disconnect = disconnect
+	return sub.viewer.ID
+}
+
+func (s *Stream) Viewers() []Viewer {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	viewers := make([]Viewer, 0, len(s.subscribers))
+	for sub := range s.subscribers {
+		if sub.viewer != nil {
+			viewers = append(viewers, *sub.viewer)
+		}
+	}
+	sort.Slice(viewers, func(i, j int) bool {
+		return viewers[i].StartTime.Before(viewers[j].StartTime)
+	})
+	return viewers
+}
+
+// KickViewer ends a viewer's subscription and closes its connection.
+func (s *Stream) KickViewer(id string) error {
+	s.subMu.Lock()
+	var kicked *Subscriber
+	for sub := range s.subscribers {
+		if sub.viewer != nil && sub.viewer.ID == id {
+			kicked = sub
+			break
+		}
+	}
+	if kicked == nil {
+		s.subMu.Unlock()
+		return ErrViewerNotFound
+	}
+	delete(s.subscribers, kicked)
+	kicked.closeWithError(ErrViewerKicked)
+	disconnect := kicked.disconnect
+	s.subMu.Unlock()
+
+	if disconnect != nil {
+		disconnect()
+	}
+	s.logger.Infof("Kicked %s viewer %s (%s) from stream %s", kicked.viewer.Protocol, id, kicked.viewer.RemoteAddr, s.ID)
+	return nil
+}
+
+func (s *Stream) SubscriberCount() int {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	return len(s.subscribers)
+}
+
+func (s *Stream) broadcastHeader(codecs []av.CodecData) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.codecs = codecs
+	s.gopCache.reset(codecs)
+
+	for sub := range s.subscribers {
+		sub.sendHeader(codecs)
+	}
+	if s.transcoderSub != nil {
+		s.transcoderSub.sendHeader(codecs)
+	}
+}
+
+func (sub *Subscriber) sendHeader(codecs []av.CodecData) {
+	if sub.codecs == nil {
+		sub.codecs = codecs
+		close(sub.header)
+	}
+}
+
+func (s *Stream) broadcastPacket(pkt av.Packet) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.gopCache.add(pkt)
+
+	for sub := range s.subscribers {
+		select {
+		case sub.packets <- pkt:
+		default:
+			delete(s.subscribers, sub)
+			sub.closeWithError(ErrSubscriberTooSlow)
+			s.logger.Warnf("Dropped slow subscriber %s from stream %s", sub.ID, s.ID)
+		}
+	}
+
+	if sub := s.transcoderSub; sub != nil {
+		select {
+		case sub.packets <- pkt:
+		default:
+			s.transcoderSub = nil
+			sub.closeWithError(ErrSubscriberTooSlow)
+		}
+	}
+}
+
+func (s *Stream) closeSubscribers() {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	s.subscribersClosed = true
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		sub.closeWithError(io.EOF)
+	}
+	if s.transcoderSub != nil {
+		s.transcoderSub.closeWithError(io.EOF)
+		s.transcoderSub = nil
+	}
+}
+
+func (sub *Subscriber) Streams() ([]av.CodecData, error) {
+	select {
+	case <-sub.header:
+		return sub.codecs, nil
+	default:
+	}
+
+	select {
+	case <-sub.header:
+		return sub.codecs, nil
+	case <-sub.done:
+		return nil, sub.err
+	}
+}
+
+func (sub *Subscriber) ReadPacket() (av.Packet, error) {
+	select {
+	case <-sub.done:
+		// Subscribers of a stream that ended normally still get the packets
+		// already queued, so recordings keep the tail of the stream.
+		if sub.err != io.EOF {
+			return av.Packet{}, sub.err
+		}
+	default:
+	}
+
+	if len(sub.pending) > 0 {
+		pkt := sub.pending[0]
+		sub.pending = sub.pending[1:]
+		return pkt, nil
+	}
+
+	select {
+	case pkt := <-sub.packets:
+		return pkt, nil
+	case <-sub.done:
+	}
+
+	if sub.err == io.EOF {
+		select {
+		case pkt := <-sub.packets:
+			return pkt, nil
+		default:
+		}
+	}
+	return av.Packet{}, sub.err
+}
+
+func (sub *Subscriber) Buffered() int {
+	return len(sub.pending) + len(sub.packets)
+}
+
+func (sub *Subscriber) Done() <-chan struct{} {
+	return sub.done
+}
+
+func (sub *Subscriber) Err() error {
+	select {
+	case <-sub.done:
+		return sub.err
+	default:
+		return nil
+	}
+}
+
+func (sub *Subscriber) Close() error {
+	sub.stream.Unsubscribe(sub)
+	return nil
+}
+
+func (sub *Subscriber) closeWithError(err error) {
+	sub.once.Do(func() {
+		sub.err = err
+		close(sub.done)
+	})
+}
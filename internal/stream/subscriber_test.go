@@ -0,0 +1,224 @@
+package stream
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/sirupsen/logrus"
+)
+
+type testCodec struct {
+	codecType av.CodecType
+}
+
+func (c testCodec) Type() av.CodecType {
+	return c.codecType
+}
+
+func newTestStream() *Stream {
+	return &Stream{
+		ID:         "testapp/teststream",
+		AppName:    "testapp",
+		StreamName: "teststream",
+		OutputDir:  "/tmp/test",
+		StartTime:  time.Now(),
+		LastUpdate: time.Now(),
+		logger:     logrus.New(),
+	}
+}
+
+func testCodecs() []av.CodecData {
+	return []av.CodecData{testCodec{av.H264}, testCodec{av.AAC}}
+}
+
+func TestStream_SubscribersReceiveHeaderAndPackets(t *testing.T) {
+	stream := newTestStream()
+
+	early := stream.Subscribe("early", 8)
+	if err := stream.WriteHeader(testCodecs()); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	late := stream.Subscribe("late", 8)
+
+	if stream.SubscriberCount() != 2 {
+		t.Fatalf("Expected 2 subscribers, got %d", stream.SubscriberCount())
+	}
+
+	if err := stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{1}}); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	for _, sub := range []*Subscriber{early, late} {
+		codecs, err := sub.Streams()
+		if err != nil {
+			t.Fatalf("Streams failed for %s: %v", sub.ID, err)
+		}
+		if len(codecs) != 2 {
+			t.Errorf("Expected 2 codecs for %s, got %d", sub.ID, len(codecs))
+		}
+
+		pkt, err := sub.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed for %s: %v", sub.ID, err)
+		}
+		if !pkt.IsKeyFrame || len(pkt.Data) != 1 {
+			t.Errorf("Unexpected packet for %s: %+v", sub.ID, pkt)
+		}
+	}
+}
+
+func TestStream_SlowSubscriberIsDropped(t *testing.T) {
+	stream := newTestStream()
+	stream.WriteHeader(testCodecs())
+
+	slow := stream.Subscribe("slow", 2)
+	for i := 0; i < 3; i++ {
+		stream.WritePacket(av.Packet{Idx: 1})
+	}
+
+	if stream.SubscriberCount() != 0 {
+		t.Errorf("Expected slow subscriber to be removed, got %d subscribers", stream.SubscriberCount())
+	}
+
+	if _, err := slow.ReadPacket(); err != ErrSubscriberTooSlow {
+		t.Errorf("Expected ErrSubscriberTooSlow, got %v", err)
+	}
+}
+
+func TestStream_WriteTrailerClosesSubscribers(t *testing.T) {
+	stream := newTestStream()
+
+	sub := stream.Subscribe("viewer", 4)
+	stream.WriteTrailer()
+
+	if _, err := sub.Streams(); err != io.EOF {
+		t.Errorf("Expected io.EOF from Streams, got %v", err)
+	}
+
+	if _, err := sub.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected io.EOF from ReadPacket, got %v", err)
+	}
+}
+
+func TestStream_SubscribeAfterTrailerEndsImmediately(t *testing.T) {
+	stream := newTestStream()
+	stream.WriteHeader(testCodecs())
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true})
+	stream.WriteTrailer()
+
+	sub := stream.Subscribe("late", 4)
+	if _, err := sub.Streams(); err != io.EOF {
+		t.Errorf("Expected io.EOF from Streams, got %v", err)
+	}
+	if count := stream.SubscriberCount(); count != 0 {
+		t.Errorf("Expected no subscribers on an ended stream, got %d", count)
+	}
+}
+
+func TestStream_SubscriberDrainsQueueAfterTrailer(t *testing.T) {
+	stream := newTestStream()
+
+	sub := stream.Subscribe("recorder", 4)
+	stream.WriteHeader(testCodecs())
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true})
+	stream.WritePacket(av.Packet{Idx: 1})
+	stream.WriteTrailer()
+
+	if _, err := sub.Streams(); err != nil {
+		t.Fatalf("Expected codecs after trailer, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sub.ReadPacket(); err != nil {
+			t.Fatalf("Expected queued packet %d after trailer, got %v", i, err)
+		}
+	}
+	if _, err := sub.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected io.EOF once the queue is drained, got %v", err)
+	}
+}
+
+func TestStream_GOPCacheReplaysFromLastKeyframe(t *testing.T) {
+	stream := newTestStream()
+	stream.SetGOPCacheSize(1)
+	stream.WriteHeader(testCodecs())
+
+	stream.WritePacket(av.Packet{Idx: 1, Data: []byte{0}})
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{1}})
+	stream.WritePacket(av.Packet{Idx: 0, Data: []byte{2}})
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{3}})
+	stream.WritePacket(av.Packet{Idx: 1, Data: []byte{4}})
+
+	sub := stream.Subscribe("viewer", 4)
+	stream.WritePacket(av.Packet{Idx: 0, Data: []byte{5}})
+
+	for _, want := range []byte{3, 4, 5} {
+		pkt, err := sub.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if pkt.Data[0] != want {
+			t.Errorf("Expected packet %d, got %d", want, pkt.Data[0])
+		}
+	}
+}
+
+func TestStream_GOPCacheKeepsConfiguredDepth(t *testing.T) {
+	stream := newTestStream()
+	stream.SetGOPCacheSize(2)
+	stream.WriteHeader(testCodecs())
+
+	for i := byte(0); i < 6; i++ {
+		stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: i%2 == 0, Data: []byte{i}})
+	}
+
+	sub := stream.Subscribe("viewer", 4)
+	pkt, err := sub.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if pkt.Data[0] != 2 || !pkt.IsKeyFrame {
+		t.Errorf("Expected replay to start at keyframe 2, got %d", pkt.Data[0])
+	}
+	if len(sub.pending) != 3 {
+		t.Errorf("Expected 3 more cached packets, got %d", len(sub.pending))
+	}
+}
+
+func TestStream_KickViewer(t *testing.T) {
+	stream := newTestStream()
+
+	recorder := stream.Subscribe("recorder", 8)
+	defer recorder.Close()
+	player := stream.Subscribe("player", 8)
+	disconnected := false
+	id := player.SetViewer("rtmp", "127.0.0.1:5000", func() {
+		disconnected = true
+	})
+
+	viewers := stream.Viewers()
+	if len(viewers) != 1 || viewers[0].ID != id || viewers[0].Protocol != "rtmp" || viewers[0].RemoteAddr != "127.0.0.1:5000" {
+		t.Fatalf("Expected only the player to be listed as a viewer, got %+v", viewers)
+	}
+
+	if err := stream.KickViewer("missing"); err != ErrViewerNotFound {
+		t.Errorf("Expected ErrViewerNotFound, got %v", err)
+	}
+	if err := stream.KickViewer(id); err != nil {
+		t.Fatalf("KickViewer failed: %v", err)
+	}
+
+	if !disconnected {
+		t.Error("Expected the viewer's connection to be closed")
+	}
+	if _, err := player.ReadPacket(); err != ErrViewerKicked {
+		t.Errorf("Expected ErrViewerKicked, got %v", err)
+	}
+	if stream.SubscriberCount() != 1 || len(stream.Viewers()) != 0 {
+		t.Errorf("Expected only the recorder to remain, got %d subscribers", stream.SubscriberCount())
+	}
+	if err := stream.KickViewer(id); err != ErrViewerNotFound {
+		t.Errorf("Expected ErrViewerNotFound for a kicked viewer, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package stream
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultBackoffFactor  = 2.0
+	defaultMaxRestarts    = 5
+	defaultRestartWindow  = time.Minute
+)
+
+// RestartPolicy controls how a crashed transcoder is restarted while the
+// publisher is still connected. Zero values fall back to the defaults and a
+// negative MaxRestarts disables restarts altogether.
+type RestartPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	MaxRestarts    int
+	Window         time.Duration
+}
+
+func DefaultRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     defaultMaxBackoff,
+		Multiplier:     defaultBackoffFactor,
+		MaxRestarts:    defaultMaxRestarts,
+		Window:         defaultRestartWindow,
+	}
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaultMaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaultBackoffFactor
+	}
+	if p.MaxRestarts == 0 {
+		p.MaxRestarts = defaultMaxRestarts
+	}
+	if p.Window <= 0 {
+		p.Window = defaultRestartWindow
+	}
+	return p
+}
+
+func (p RestartPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt))
+	if delay > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(delay)
+}
+
+// scheduleRestartLocked must be called with s.mu held after the transcoder
+// has exited unexpectedly.
+func (s *Stream) scheduleRestartLocked() {
+	policy := s.restartPolicy.withDefaults()
+
+	if policy.MaxRestarts < 0 {
+		s.IsActive = false
+		return
+	}
+
+	now := time.Now()
+	recent := s.restartTimes[:0]
+	for _, at := range s.restartTimes {
+		if now.Sub(at) < policy.Window {
+			recent = append(recent, at)
+		}
+	}
+	s.restartTimes = recent
+
+	if len(recent) >= policy.MaxRestarts {
+		s.logger.Errorf("Transcoder for stream %s restarted %d times within %s, giving up", s.ID, len(recent), policy.Window)
+		s.IsActive = false
+		return
+	}
+
+	delay := policy.backoff(len(recent))
+	s.restartTimes = append(s.restartTimes, now)
+	s.restartTimer = time.AfterFunc(delay, s.restartTranscoder)
+
+	s.logger.Warnf("Restarting transcoder for stream %s in %s (attempt %d/%d)", s.ID, delay, len(s.restartTimes), policy.MaxRestarts)
+}
+
+func (s *Stream) restartTranscoder() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restartTimer = nil
+
+	if !s.IsActive || s.transcoder != nil {
+		return
+	}
+
+	profile := s.profile
+	profile.Discontinuity = true
+
+	if err := s.startTranscoderLocked(profile); err != nil {
+		s.logger.Errorf("Failed to restart transcoder for stream %s: %v", s.ID, err)
+		s.scheduleRestartLocked()
+		return
+	}
+
+	s.restarts++
+	s.logger.Infof("Restarted transcoder for stream %s (%d restarts)", s.ID, s.restarts)
+}
+
+func (s *Stream) Restarts() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.restarts
+}
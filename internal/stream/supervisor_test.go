@@ -0,0 +1,234 @@
+package stream
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+)
+
+func TestRestartPolicy_Backoff(t *testing.T) {
+	policy := RestartPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}.withDefaults()
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+	}
+	for attempt, want := range expected {
+		if got := policy.backoff(attempt); got != want {
+			t.Errorf("attempt %d: expected backoff %s, got %s", attempt, want, got)
+		}
+	}
+}
+
+func TestStream_RestartsCrashedTranscoder(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	sm.SetRestartPolicy(RestartPolicy{InitialBackoff: time.Millisecond, MaxRestarts: 3, Window: time.Minute})
+	outputDir := t.TempDir()
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	stream.WriteHeader(testCodecs())
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("before")})
+	waitForPackets(t, fakes.get(0), 1)
+
+	fakes.get(0).Fail(errors.New("exit status 1"))
+
+	testutil.WaitFor(t, "transcoder restart", func() bool {
+		return stream.Restarts() == 1
+	})
+
+	if !stream.IsActive {
+		t.Error("expected stream to stay active across restart")
+	}
+
+	restarted := fakes.get(1)
+	if !restarted.Profile().Discontinuity {
+		t.Error("expected restarted transcoder to continue the playlist with a discontinuity")
+	}
+
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("after")})
+	waitForPackets(t, restarted, 1)
+
+	playlist, err := os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	expected := "segment_000.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:4.000000,\nsegment_001.ts"
+	if !strings.Contains(string(playlist), expected) {
+		t.Errorf("expected discontinuity between segments, got:\n%s", playlist)
+	}
+
+	if status := stream.GetStatus(); status["restarts"] != 1 {
+		t.Errorf("expected restarts in status, got %v", status["restarts"])
+	}
+}
+
+func TestStream_GivesUpAfterMaxRestarts(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	sm.SetRestartPolicy(RestartPolicy{InitialBackoff: time.Millisecond, MaxRestarts: 2, Window: time.Minute})
+
+	stream := sm.CreateStream("live", "test", t.TempDir())
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		testutil.WaitFor(t, "transcoder to be running", func() bool {
+			return fakes.count() == i+1
+		})
+		fakes.get(i).Fail(errors.New("exit status 1"))
+	}
+
+	testutil.WaitFor(t, "stream to become inactive", func() bool {
+		stream.mu.RLock()
+		defer stream.mu.RUnlock()
+		return !stream.IsActive
+	})
+
+	if stream.Restarts() != 2 {
+		t.Errorf("expected 2 restarts, got %d", stream.Restarts())
+	}
+}
+
+func TestStream_StopCancelsPendingRestart(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	sm.SetRestartPolicy(RestartPolicy{InitialBackoff: 50 * time.Millisecond, MaxRestarts: 3, Window: time.Minute})
+
+	stream := sm.CreateStream("live", "test", t.TempDir())
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+
+	fakes.get(0).Fail(errors.New("exit status 1"))
+	testutil.WaitFor(t, "restart to be scheduled", func() bool {
+		return stream.GetStatus()["restarting"] == true
+	})
+
+	stream.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	if fakes.count() != 1 {
+		t.Errorf("expected no restart after Stop, got %d transcoders", fakes.count())
+	}
+}
+
+func TestStream_StopAndRestartTranscoder(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	outputDir := t.TempDir()
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.RestartTranscoder(); !errors.Is(err, ErrNoProfile) {
+		t.Errorf("expected ErrNoProfile before the first start, got %v", err)
+	}
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	stream.WriteHeader(testCodecs())
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("before")})
+	waitForPackets(t, fakes.get(0), 1)
+
+	if err := stream.StopTranscoder(); err != nil {
+		t.Fatalf("StopTranscoder failed: %v", err)
+	}
+	if err := stream.StopTranscoder(); !errors.Is(err, ErrStreamInactive) {
+		t.Errorf("expected ErrStreamInactive for a stopped transcoder, got %v", err)
+	}
+
+	// The publisher keeps writing while transcoding is stopped.
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("paused")})
+	if packets := fakes.get(0).Packets(); packets != 1 {
+		t.Errorf("expected no packets for a stopped transcoder, got %d", packets)
+	}
+
+	if err := stream.RestartTranscoder(); err != nil {
+		t.Fatalf("RestartTranscoder failed: %v", err)
+	}
+	if err := stream.RestartTranscoder(); !errors.Is(err, ErrStreamActive) {
+		t.Errorf("expected ErrStreamActive for a running transcoder, got %v", err)
+	}
+
+	restarted := fakes.get(1)
+	if !restarted.Profile().Discontinuity || restarted.Profile().SegmentDuration != testProfile().SegmentDuration {
+		t.Errorf("expected the restarted transcoder to continue with the stream's profile, got %+v", restarted.Profile())
+	}
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("after")})
+	waitForPackets(t, restarted, 1)
+	if packets := restarted.Packets(); packets != 1 {
+		t.Errorf("expected the restarted transcoder to receive packets, got %d", packets)
+	}
+
+	stream.WriteTrailer()
+	stream.Stop()
+	if err := stream.RestartTranscoder(); !errors.Is(err, ErrStreamEnded) {
+		t.Errorf("expected ErrStreamEnded once the publisher left, got %v", err)
+	}
+}
+
+func TestStream_RestartedTranscoderStartsAtKeyframe(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		gopCache int
+		packets  int
+	}{
+		// The latest GOP, written partly while transcoding was stopped, is
+		// replayed before the packets written after the restart.
+		{name: "GOP cache", gopCache: 1, packets: 9},
+		// Without a cache the transcoder waits for the next keyframe.
+		{name: "no GOP cache", gopCache: 0, packets: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sm, fakes := newFakeStreamManager()
+			sm.SetGOPCacheSize(tc.gopCache)
+
+			stream := sm.CreateStream("live", "test", t.TempDir())
+			if err := stream.StartTranscoder(testProfile()); err != nil {
+				t.Fatalf("StartTranscoder failed: %v", err)
+			}
+
+			stream.WriteHeader(testCodecs())
+			stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("key")})
+			stream.WritePacket(av.Packet{Idx: 0, Data: []byte("delta")})
+			waitForPackets(t, fakes.get(0), 2)
+
+			if err := stream.StopTranscoder(); err != nil {
+				t.Fatalf("StopTranscoder failed: %v", err)
+			}
+			for i := 0; i < 3; i++ {
+				stream.WritePacket(av.Packet{Idx: 1, Data: []byte("audio")})
+			}
+			stream.WritePacket(av.Packet{Idx: 0, Data: []byte("delta")})
+
+			if err := stream.RestartTranscoder(); err != nil {
+				t.Fatalf("RestartTranscoder failed: %v", err)
+			}
+			stream.WritePacket(av.Packet{Idx: 1, Data: []byte("audio")})
+			stream.WritePacket(av.Packet{Idx: 0, Data: []byte("delta")})
+			stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("key")})
+
+			// Ending the stream feeds the rest of the queue before the
+			// transcoder is stopped.
+			stream.WriteTrailer()
+			stream.Stop()
+
+			if packets := fakes.get(1).Packets(); packets != tc.packets {
+				t.Errorf("expected the restarted transcoder to get %d packets, got %d", tc.packets, packets)
+			}
+		})
+	}
+}
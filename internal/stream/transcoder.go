@@ -0,0 +1,600 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang-rtmp/internal/hls"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+)
+
+const (
+	ContainerTS   = "ts"
+	ContainerFMP4 = "fmp4"
+
+	defaultFrameRate = 30
+
+	// DASH streams write each track to its own media playlist, because DASH
+	// players need audio and video in separate representations.
+	dashVideoTrack = "video"
+	dashAudioTrack = "audio"
+)
+
+type TranscodeProfile struct {
+	BinaryPath      string
+	Params          map[string]string
+	Renditions      []Rendition
+	Passthrough     bool
+	Container       string
+	DASH            bool
+	Segmenter       string
+	PartDuration    time.Duration
+	SegmentDuration int
+	PlaylistWindow  int
+	DVRWindow       time.Duration
+	Discontinuity   bool
+
+	// Codecs are the published codecs, which decide the tracks that are
+	// mapped and advertised. Nil means unknown, taken as video and audio.
+	Codecs []av.CodecData
+}
+
+type Rendition struct {
+	Name         string
+	Resolution   string
+	VideoBitrate string
+	AudioBitrate string
+	Profile      string
+}
+
+func (p TranscodeProfile) Validate() error {
+	switch p.Container {
+	case "", ContainerTS, ContainerFMP4:
+	default:
+		return fmt.Errorf("unknown container %q", p.Container)
+	}
+	if p.DASH && p.Container != ContainerFMP4 {
+		return fmt.Errorf("DASH output requires the fmp4 container")
+	}
+
+	switch p.Segmenter {
+	case "", SegmenterFFmpeg:
+	case SegmenterNative:
+		if !p.Passthrough {
+			return fmt.Errorf("the native segmenter only supports passthrough streams")
+		}
+		if p.Container == ContainerFMP4 {
+			return fmt.Errorf("the native segmenter only writes MPEG-TS segments")
+		}
+	default:
+		return fmt.Errorf("unknown segmenter %q", p.Segmenter)
+	}
+
+	if p.DVRWindow < 0 {
+		return fmt.Errorf("DVR window must not be negative")
+	}
+
+	if p.PartDuration > 0 && p.Segmenter != SegmenterNative {
+		return fmt.Errorf("low-latency HLS requires the native segmenter")
+	}
+
+	seen := make(map[string]bool, len(p.Renditions))
+	for _, rendition := range p.Renditions {
+		if !validRenditionName(rendition.Name) {
+			return fmt.Errorf("invalid rendition name %q", rendition.Name)
+		}
+		if seen[rendition.Name] {
+			return fmt.Errorf("duplicate rendition name %q", rendition.Name)
+		}
+		seen[rendition.Name] = true
+		if p.DASH && rendition.Name == dashAudioTrack {
+			return fmt.Errorf("rendition name %q is reserved for the DASH audio track", rendition.Name)
+		}
+
+		if _, err := hls.ParseBitrate(rendition.VideoBitrate); err != nil {
+			return fmt.Errorf("rendition %s: %w", rendition.Name, err)
+		}
+		if _, err := hls.ParseBitrate(rendition.AudioBitrate); err != nil {
+			return fmt.Errorf("rendition %s: %w", rendition.Name, err)
+		}
+	}
+	return nil
+}
+
+// PassthroughCompatible reports whether the published codecs can be remuxed
+// into HLS without re-encoding.
+func PassthroughCompatible(codecs []av.CodecData) bool {
+	if len(codecs) == 0 {
+		return false
+	}
+	for _, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.AAC:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validRenditionName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// SegmentExtension is the file extension of the media segments the profile
+// produces.
+func (p TranscodeProfile) SegmentExtension() string {
+	if p.Container == ContainerFMP4 {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// hasAudio reports whether the published stream has an audio track.
+func (p TranscodeProfile) hasAudio() bool {
+	if p.Codecs == nil {
+		return true
+	}
+	for _, codec := range p.Codecs {
+		if codec.Type().IsAudio() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasVideo reports whether the published stream has a video track.
+func (p TranscodeProfile) hasVideo() bool {
+	if p.Codecs == nil {
+		return true
+	}
+	for _, codec := range p.Codecs {
+		if codec.Type().IsVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// frameRate is the output frame rate of transcoded streams.
+func (p TranscodeProfile) frameRate() float64 {
+	fps, err := strconv.ParseFloat(p.Params["fps"], 64)
+	if err != nil || fps <= 0 {
+		return defaultFrameRate
+	}
+	return fps
+}
+
+// h264Level is the level of a rendition at the profile's frame rate.
+func (p TranscodeProfile) h264Level(rendition Rendition) int {
+	width, height := parseResolution(rendition.Resolution)
+	return hls.H264Level(width, height, p.frameRate())
+}
+
+// windowSegments is the number of segments kept in each media playlist. A DVR
+// window replaces the live playlist window with enough segments to cover it.
+func (p TranscodeProfile) windowSegments() int {
+	if p.DVRWindow > 0 && p.SegmentDuration > 0 {
+		segmentDuration := time.Duration(p.SegmentDuration) * time.Second
+		return int((p.DVRWindow + segmentDuration - 1) / segmentDuration)
+	}
+	return p.PlaylistWindow
+}
+
+// playlistNames are the media playlists the profile produces.
+func (p TranscodeProfile) playlistNames() []string {
+	var names []string
+	if len(p.Renditions) == 0 || p.Passthrough {
+		if !p.DASH {
+			return []string{"playlist.m3u8"}
+		}
+		if p.hasVideo() {
+			names = append(names, VariantPlaylistName(dashVideoTrack))
+		}
+	} else {
+		for _, rendition := range p.Renditions {
+			names = append(names, VariantPlaylistName(rendition.Name))
+		}
+	}
+	if p.DASH && p.hasAudio() {
+		names = append(names, VariantPlaylistName(dashAudioTrack))
+	}
+	return names
+}
+
+func VariantPlaylistName(rendition string) string {
+	return "playlist_" + rendition + ".m3u8"
+}
+
+func masterVariants(profile TranscodeProfile) []hls.Variant {
+	audio := profile.hasAudio()
+
+	variants := make([]hls.Variant, 0, len(profile.Renditions))
+	for _, rendition := range profile.Renditions {
+		bandwidth, _ := hls.ParseBitrate(rendition.VideoBitrate)
+		codecs := hls.H264CodecString(rendition.Profile, profile.h264Level(rendition))
+		variant := hls.Variant{
+			URI:        VariantPlaylistName(rendition.Name),
+			Resolution: rendition.Resolution,
+		}
+		if audio {
+			audioBitrate, _ := hls.ParseBitrate(rendition.AudioBitrate)
+			if profile.DASH {
+				audioBitrate, _ = hls.ParseBitrate(profile.Renditions[0].AudioBitrate)
+				variant.Audio = VariantPlaylistName(dashAudioTrack)
+			}
+			bandwidth += audioBitrate
+			codecs += "," + hls.AACCodecString
+		}
+
+		variant.Bandwidth = bandwidth + bandwidth/10
+		variant.Codecs = codecs
+		variants = append(variants, variant)
+	}
+	return variants
+}
+
+type Transcoder interface {
+	av.Muxer
+	Start(outputDir string, profile TranscodeProfile) error
+	Stop() error
+	Wait() error
+	Progress() io.Reader
+	Stderr() io.Reader
+}
+
+type TranscoderFactory func() Transcoder
+
+func NewFFmpegTranscoderFactory() TranscoderFactory {
+	return func() Transcoder {
+		return NewFFmpegTranscoder()
+	}
+}
+
+const ffmpegDrainTimeout = 5 * time.Second
+
+type FFmpegTranscoder struct {
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	bufw   *bufio.Writer
+	muxer  *flv.Muxer
+
+	progressR *io.PipeReader
+	progressW *io.PipeWriter
+	stderrR   *io.PipeReader
+	stderrW   *io.PipeWriter
+
+	// draining is set once WriteTrailer has closed stdin. Stop reads it
+	// without t.mu, which a write blocked on the pipe may be holding.
+	draining atomic.Bool
+
+	done    chan struct{}
+	waitErr error
+	mu      sync.Mutex
+	stateMu sync.Mutex
+}
+
+func NewFFmpegTranscoder() *FFmpegTranscoder {
+	t := &FFmpegTranscoder{
+		done: make(chan struct{}),
+	}
+	t.progressR, t.progressW = io.Pipe()
+	t.stderrR, t.stderrW = io.Pipe()
+	return t
+}
+
+func (t *FFmpegTranscoder) Start(outputDir string, profile TranscodeProfile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+
+	if t.cmd != nil {
+		return fmt.Errorf("transcoder already started")
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	binaryPath := profile.BinaryPath
+	if binaryPath == "" {
+		binaryPath = "ffmpeg"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, binaryPath, buildFFmpegArgs(outputDir, profile)...)
+	cmd.Stdout = t.progressW
+	cmd.Stderr = t.stderrW
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start FFmpeg: %w", err)
+	}
+
+	t.cmd = cmd
+	t.cancel = cancel
+	t.stdin = stdin
+	t.bufw = bufio.NewWriter(stdin)
+	t.muxer = flv.NewMuxerWriteFlusher(t.bufw)
+
+	go func() {
+		t.waitErr = cmd.Wait()
+		t.progressW.Close()
+		t.stderrW.Close()
+		close(t.done)
+	}()
+
+	return nil
+}
+
+func buildFFmpegArgs(outputDir string, profile TranscodeProfile) []string {
+	if len(profile.Renditions) > 0 && !profile.Passthrough {
+		return buildFFmpegLadderArgs(outputDir, profile)
+	}
+
+	params := profile.Params
+	playlistPath := filepath.Join(outputDir, "playlist.m3u8")
+	segmentPattern := filepath.Join(outputDir, "segment_%03d"+profile.SegmentExtension())
+
+	args := []string{
+		"-progress", "pipe:1",
+		"-nostats",
+		"-f", "flv",
+		"-i", "pipe:0",
+	}
+
+	if profile.Passthrough {
+		args = append(args, "-c", "copy")
+	} else {
+		args = append(args,
+			"-c:v", params["video_codec"],
+			"-c:a", params["audio_codec"],
+			"-b:v", params["video_bitrate"],
+			"-b:a", params["audio_bitrate"],
+			"-s", params["resolution"],
+			"-r", params["fps"],
+		)
+	}
+	if !profile.DASH {
+		args = append(args, hlsOutputArgs(profile, "init.mp4")...)
+		return append(args, "-hls_segment_filename", segmentPattern, playlistPath)
+	}
+
+	// Each track gets its own media playlist, and playlist.m3u8 becomes the
+	// master playlist tying them together for HLS players.
+	var streamMap []string
+	if profile.hasVideo() {
+		streamMap = append(streamMap, profile.dashVideoStream(0, dashVideoTrack))
+	}
+	if profile.hasAudio() {
+		streamMap = append(streamMap, profile.dashAudioStream())
+	}
+
+	args = append(args, hlsOutputArgs(profile, "init_%v.mp4")...)
+	return append(args,
+		"-hls_segment_filename", filepath.Join(outputDir, "segment_%v_%03d"+profile.SegmentExtension()),
+		"-master_pl_name", "playlist.m3u8",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outputDir, "playlist_%v.m3u8"),
+	)
+}
+
+// dashVideoStream is the var_stream_map entry of a video track of a DASH
+// stream, which refers to the separate audio track if there is one.
+func (p TranscodeProfile) dashVideoStream(index int, name string) string {
+	if p.hasAudio() {
+		return fmt.Sprintf("v:%d,agroup:audio,name:%s", index, name)
+	}
+	return fmt.Sprintf("v:%d,name:%s", index, name)
+}
+
+// dashAudioStream is the var_stream_map entry of the audio track of a DASH
+// stream.
+func (p TranscodeProfile) dashAudioStream() string {
+	if p.hasVideo() {
+		return "a:0,agroup:audio,name:" + dashAudioTrack
+	}
+	return "a:0,name:" + dashAudioTrack
+}
+
+func buildFFmpegLadderArgs(outputDir string, profile TranscodeProfile) []string {
+	params := profile.Params
+
+	args := []string{
+		"-progress", "pipe:1",
+		"-nostats",
+		"-f", "flv",
+		"-i", "pipe:0",
+	}
+
+	// Mapping an audio track the input does not have makes FFmpeg fail.
+	audio := profile.hasAudio()
+
+	// DASH streams share a single audio track between the renditions,
+	// encoded at the audio bitrate of the first rendition.
+	streamMap := make([]string, 0, len(profile.Renditions)+1)
+	for i, rendition := range profile.Renditions {
+		switch {
+		case profile.DASH:
+			args = append(args, "-map", "0:v:0")
+			streamMap = append(streamMap, profile.dashVideoStream(i, rendition.Name))
+		case audio:
+			args = append(args, "-map", "0:v:0", "-map", "0:a:0")
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, rendition.Name))
+		default:
+			args = append(args, "-map", "0:v:0")
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%s", i, rendition.Name))
+		}
+	}
+	if profile.DASH && audio {
+		args = append(args, "-map", "0:a:0")
+		streamMap = append(streamMap, profile.dashAudioStream())
+	}
+
+	args = append(args, "-c:v", params["video_codec"])
+	if audio {
+		args = append(args, "-c:a", params["audio_codec"])
+	}
+	args = append(args,
+		"-r", params["fps"],
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", profile.SegmentDuration),
+	)
+
+	// The level is set explicitly so the stream matches the CODECS of the
+	// master playlist.
+	for i, rendition := range profile.Renditions {
+		args = append(args,
+			fmt.Sprintf("-s:v:%d", i), rendition.Resolution,
+			fmt.Sprintf("-b:v:%d", i), rendition.VideoBitrate,
+		)
+		if audio && (!profile.DASH || i == 0) {
+			args = append(args, fmt.Sprintf("-b:a:%d", i), rendition.AudioBitrate)
+		}
+		args = append(args, fmt.Sprintf("-level:v:%d", i), hls.FormatH264Level(profile.h264Level(rendition)))
+		if rendition.Profile != "" {
+			args = append(args, fmt.Sprintf("-profile:v:%d", i), rendition.Profile)
+		}
+	}
+
+	args = append(args, hlsOutputArgs(profile, "init_%v.mp4")...)
+
+	return append(args,
+		"-hls_segment_filename", filepath.Join(outputDir, "segment_%v_%03d"+profile.SegmentExtension()),
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outputDir, "playlist_%v.m3u8"),
+	)
+}
+
+// hlsOutputArgs returns the HLS muxer options. initName is relative to the
+// playlist and only used for fMP4 output.
+func hlsOutputArgs(profile TranscodeProfile, initName string) []string {
+	hlsFlags := "delete_segments"
+	if profile.Discontinuity {
+		hlsFlags += "+append_list+discont_start"
+	}
+	// The DASH manifest ties the media timeline to the wall clock by the
+	// date of the first segment.
+	if profile.DASH {
+		hlsFlags += "+program_date_time"
+	}
+
+	args := []string{
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%d", profile.SegmentDuration),
+		"-hls_list_size", fmt.Sprintf("%d", profile.windowSegments()),
+		"-hls_flags", hlsFlags,
+	}
+	if profile.Container == ContainerFMP4 {
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", initName)
+	}
+	return args
+}
+
+func (t *FFmpegTranscoder) WriteHeader(streams []av.CodecData) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.muxer == nil {
+		return fmt.Errorf("transcoder not running")
+	}
+
+	if err := t.muxer.WriteHeader(streams); err != nil {
+		return err
+	}
+	return t.bufw.Flush()
+}
+
+func (t *FFmpegTranscoder) WritePacket(pkt av.Packet) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.muxer == nil {
+		return fmt.Errorf("transcoder not running")
+	}
+
+	if err := t.muxer.WritePacket(pkt); err != nil {
+		return err
+	}
+	return t.bufw.Flush()
+}
+
+func (t *FFmpegTranscoder) WriteTrailer() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.muxer == nil {
+		return nil
+	}
+
+	err := t.muxer.WriteTrailer()
+	t.stdin.Close()
+	t.muxer = nil
+	t.draining.Store(true)
+	return err
+}
+
+func (t *FFmpegTranscoder) Stop() error {
+	t.stateMu.Lock()
+	cmd := t.cmd
+	cancel := t.cancel
+	t.stateMu.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+
+	// Once WriteTrailer has closed stdin FFmpeg is writing its last segment
+	// and ending the playlist; give it a moment before killing it. Killing
+	// FFmpeg also fails any write still blocked on stdin.
+	if t.draining.Load() {
+		select {
+		case <-t.done:
+		case <-time.After(ffmpegDrainTimeout):
+		}
+	}
+
+	cancel()
+	<-t.done
+	return nil
+}
+
+func (t *FFmpegTranscoder) Wait() error {
+	<-t.done
+	return t.waitErr
+}
+
+func (t *FFmpegTranscoder) Progress() io.Reader {
+	return t.progressR
+}
+
+func (t *FFmpegTranscoder) Stderr() io.Reader {
+	return t.stderrR
+}
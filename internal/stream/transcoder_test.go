@@ -0,0 +1,816 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/testutil"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/sirupsen/logrus"
+)
+
+type fakeTranscoders struct {
+	fakes []*FakeTranscoder
+	mu    sync.Mutex
+}
+
+func (f *fakeTranscoders) get(i int) *FakeTranscoder {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fakes[i]
+}
+
+func (f *fakeTranscoders) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.fakes)
+}
+
+func newFakeStreamManager() (*StreamManager, *fakeTranscoders) {
+	fakes := &fakeTranscoders{}
+
+	sm := NewStreamManager(logrus.New())
+	sm.SetTranscoderFactory(func() Transcoder {
+		fake := NewFakeTranscoder()
+		fakes.mu.Lock()
+		fakes.fakes = append(fakes.fakes, fake)
+		fakes.mu.Unlock()
+		return fake
+	})
+
+	return sm, fakes
+}
+
+// waitForPackets waits for a transcoder to be fed count packets from its
+// queue.
+func waitForPackets(t *testing.T, fake *FakeTranscoder, count int) {
+	t.Helper()
+
+	testutil.WaitFor(t, fmt.Sprintf("transcoder to receive %d packets", count), func() bool {
+		return fake.Packets() >= count
+	})
+}
+
+func testProfile() TranscodeProfile {
+	return TranscodeProfile{
+		BinaryPath:      "ffmpeg",
+		Params:          map[string]string{"video_codec": "libx264", "audio_codec": "aac"},
+		SegmentDuration: 4,
+		PlaylistWindow:  2,
+	}
+}
+
+func TestBuildFFmpegArgs_ReadsFLVFromStdin(t *testing.T) {
+	args := buildFFmpegArgs("/tmp/out", testProfile())
+
+	if !strings.Contains(strings.Join(args, " "), "-f flv -i pipe:0") {
+		t.Errorf("expected FLV input from stdin, got %v", args)
+	}
+
+	if !strings.Contains(strings.Join(args, " "), "-progress pipe:1") {
+		t.Errorf("expected progress output on stdout, got %v", args)
+	}
+
+	if args[len(args)-1] != filepath.Join("/tmp/out", "playlist.m3u8") {
+		t.Errorf("expected playlist output path last, got %s", args[len(args)-1])
+	}
+}
+
+func TestStream_TranscoderLifecycle(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	outputDir := t.TempDir()
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+
+	if !stream.IsActive {
+		t.Error("expected stream to be active")
+	}
+
+	if err := stream.StartTranscoder(testProfile()); err == nil {
+		t.Error("expected error when starting an active stream")
+	}
+
+	stream.WriteHeader(testCodecs())
+	for i := 0; i < 3; i++ {
+		stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("frame")})
+		stream.WritePacket(av.Packet{Idx: 1, Data: []byte("audio")})
+	}
+
+	fake := fakes.get(0)
+	waitForPackets(t, fake, 6)
+	if fake.Packets() != 6 {
+		t.Errorf("expected transcoder to receive 6 packets, got %d", fake.Packets())
+	}
+
+	if segments := fake.Segments(); len(segments) != 2 || segments[0] != "segment_001.ts" {
+		t.Errorf("expected sliding window of segments 1-2, got %v", segments)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, "segment_000.ts")); !os.IsNotExist(err) {
+		t.Error("expected segment_000.ts to be removed from the window")
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	if !strings.Contains(string(playlist), "#EXT-X-MEDIA-SEQUENCE:1") {
+		t.Errorf("unexpected playlist:\n%s", playlist)
+	}
+
+	stream.Stop()
+	if stream.IsActive {
+		t.Error("expected stream to be inactive after Stop")
+	}
+}
+
+func TestStream_TranscoderExitMarksInactiveWithoutRestarts(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	sm.SetRestartPolicy(RestartPolicy{MaxRestarts: -1})
+
+	stream := sm.CreateStream("live", "test", t.TempDir())
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+
+	fakes.get(0).Fail(errors.New("exit status 1"))
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		stream.mu.RLock()
+		active := stream.IsActive
+		stream.mu.RUnlock()
+		if !active {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected stream to become inactive after transcoder exit")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func ladderProfile() TranscodeProfile {
+	profile := testProfile()
+	profile.Renditions = []Rendition{
+		{Name: "720p", Resolution: "1280x720", VideoBitrate: "2800k", AudioBitrate: "128k", Profile: "main"},
+		{Name: "360p", Resolution: "640x360", VideoBitrate: "800k", AudioBitrate: "96k", Profile: "baseline"},
+	}
+	return profile
+}
+
+func TestBuildFFmpegArgs_Renditions(t *testing.T) {
+	args := strings.Join(buildFFmpegArgs("/tmp/out", ladderProfile()), " ")
+
+	for _, expected := range []string{
+		"-map 0:v:0 -map 0:a:0 -map 0:v:0 -map 0:a:0",
+		"-s:v:0 1280x720 -b:v:0 2800k -b:a:0 128k -level:v:0 3.1 -profile:v:0 main",
+		"-s:v:1 640x360 -b:v:1 800k -b:a:1 96k -level:v:1 3.0 -profile:v:1 baseline",
+		"-var_stream_map v:0,a:0,name:720p v:1,a:1,name:360p",
+		filepath.Join("/tmp/out", "playlist_%v.m3u8"),
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("expected args to contain %q, got %s", expected, args)
+		}
+	}
+}
+
+func TestBuildFFmpegArgs_RenditionsWithoutAudio(t *testing.T) {
+	profile := ladderProfile()
+	profile.Codecs = []av.CodecData{testCodec{av.H264}}
+
+	args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+
+	for _, expected := range []string{
+		"-map 0:v:0 -map 0:v:0 -c:v libx264 -r",
+		"-var_stream_map v:0,name:720p v:1,name:360p",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("expected args to contain %q, got %s", expected, args)
+		}
+	}
+	if strings.Contains(args, "0:a:0") || strings.Contains(args, "-b:a:") || strings.Contains(args, "-c:a") {
+		t.Errorf("expected no audio options for a video-only stream, got %s", args)
+	}
+
+	variants := masterVariants(profile)
+	if variants[0].Codecs != "avc1.4d401f" || variants[0].Bandwidth != 3080000 {
+		t.Errorf("expected a video-only variant, got %+v", variants[0])
+	}
+}
+
+func TestMasterVariants_LevelFollowsRendition(t *testing.T) {
+	profile := ladderProfile()
+	profile.Params["fps"] = "60"
+	profile.Renditions[0].Resolution = "1920x1080"
+
+	variants := masterVariants(profile)
+	if variants[0].Codecs != "avc1.4d402a,mp4a.40.2" {
+		t.Errorf("expected level 4.2 for 1080p60, got %s", variants[0].Codecs)
+	}
+	if variants[1].Codecs != "avc1.42e01f,mp4a.40.2" {
+		t.Errorf("expected level 3.1 for 360p60, got %s", variants[1].Codecs)
+	}
+}
+
+func TestTranscodeProfile_ValidateRenditions(t *testing.T) {
+	if err := ladderProfile().Validate(); err != nil {
+		t.Errorf("expected ladder profile to be valid: %v", err)
+	}
+
+	profile := ladderProfile()
+	profile.Renditions[1].Name = "../360p"
+	if err := profile.Validate(); err == nil {
+		t.Error("expected error for unsafe rendition name")
+	}
+
+	profile = ladderProfile()
+	profile.Renditions[1].Name = "720p"
+	if err := profile.Validate(); err == nil {
+		t.Error("expected error for duplicate rendition name")
+	}
+
+	profile = ladderProfile()
+	profile.Renditions[0].VideoBitrate = "fast"
+	if err := profile.Validate(); err == nil {
+		t.Error("expected error for invalid bitrate")
+	}
+}
+
+func TestStream_WritesMasterPlaylistForRenditions(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	outputDir := t.TempDir()
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.StartTranscoder(ladderProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	defer stream.Stop()
+
+	stream.WriteHeader(testCodecs())
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("frame")})
+	waitForPackets(t, fakes.get(0), 1)
+
+	master, err := os.ReadFile(filepath.Join(outputDir, "master.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read master playlist: %v", err)
+	}
+
+	expected := "#EXT-X-STREAM-INF:BANDWIDTH=3220800,RESOLUTION=1280x720,CODECS=\"avc1.4d401f,mp4a.40.2\"\nplaylist_720p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=985600,RESOLUTION=640x360,CODECS=\"avc1.42e01e,mp4a.40.2\"\nplaylist_360p.m3u8\n"
+	if !strings.Contains(string(master), expected) {
+		t.Errorf("unexpected master playlist:\n%s", master)
+	}
+
+	for _, name := range []string{"playlist_720p.m3u8", "playlist_360p.m3u8", "segment_720p_000.ts", "segment_360p_000.ts"} {
+		if _, err := os.Stat(filepath.Join(outputDir, name)); err != nil {
+			t.Errorf("expected %s to exist: %v", name, err)
+		}
+	}
+}
+
+func TestBuildFFmpegArgs_Passthrough(t *testing.T) {
+	profile := ladderProfile()
+	profile.Passthrough = true
+
+	args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+
+	if !strings.Contains(args, "-c copy") {
+		t.Errorf("expected codecs to be copied, got %s", args)
+	}
+	if strings.Contains(args, "libx264") || strings.Contains(args, "var_stream_map") {
+		t.Errorf("expected no encoding options in passthrough mode, got %s", args)
+	}
+}
+
+func TestBuildFFmpegArgs_FMP4(t *testing.T) {
+	profile := testProfile()
+	profile.Container = ContainerFMP4
+
+	args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+	for _, expected := range []string{
+		"-hls_segment_type fmp4 -hls_fmp4_init_filename init.mp4",
+		filepath.Join("/tmp/out", "segment_%03d.m4s"),
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("expected args to contain %q, got %s", expected, args)
+		}
+	}
+
+	profile = ladderProfile()
+	profile.Container = ContainerFMP4
+
+	args = strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+	for _, expected := range []string{
+		"-hls_fmp4_init_filename init_%v.mp4",
+		filepath.Join("/tmp/out", "segment_%v_%03d.m4s"),
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("expected args to contain %q, got %s", expected, args)
+		}
+	}
+
+	if args := strings.Join(buildFFmpegArgs("/tmp/out", testProfile()), " "); strings.Contains(args, "fmp4") {
+		t.Errorf("expected MPEG-TS output by default, got %s", args)
+	}
+}
+
+func TestBuildFFmpegArgs_DASHSplitsTracks(t *testing.T) {
+	profile := testProfile()
+	profile.Container = ContainerFMP4
+	profile.DASH = true
+
+	args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+	for _, expected := range []string{
+		"-hls_fmp4_init_filename init_%v.mp4",
+		"-master_pl_name playlist.m3u8",
+		"-var_stream_map v:0,agroup:audio,name:video a:0,agroup:audio,name:audio",
+		filepath.Join("/tmp/out", "playlist_%v.m3u8"),
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("expected args to contain %q, got %s", expected, args)
+		}
+	}
+	if names := profile.playlistNames(); strings.Join(names, " ") != "playlist_video.m3u8 playlist_audio.m3u8" {
+		t.Errorf("unexpected playlists %v", names)
+	}
+
+	profile.Codecs = []av.CodecData{testCodec{av.H264}}
+	if args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " "); !strings.Contains(args, "-var_stream_map v:0,name:video /") {
+		t.Errorf("expected only a video track, got %s", args)
+	}
+
+	profile = ladderProfile()
+	profile.Container = ContainerFMP4
+	profile.DASH = true
+
+	args = strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+	for _, expected := range []string{
+		"-map 0:v:0 -map 0:v:0 -map 0:a:0 -c:v libx264",
+		"-b:v:0 2800k -b:a:0 128k -level:v:0",
+		"-b:v:1 800k -level:v:1",
+		"-var_stream_map v:0,agroup:audio,name:720p v:1,agroup:audio,name:360p a:0,agroup:audio,name:audio",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("expected args to contain %q, got %s", expected, args)
+		}
+	}
+
+	variants := masterVariants(profile)
+	if variants[1].Audio != "playlist_audio.m3u8" || variants[1].Bandwidth != 1020800 {
+		t.Errorf("expected variant to share the audio track, got %+v", variants[1])
+	}
+
+	profile.Renditions[1].Name = "audio"
+	if err := profile.Validate(); err == nil {
+		t.Error("expected the audio track name to be reserved")
+	}
+}
+
+func TestBuildFFmpegArgs_DVRWindow(t *testing.T) {
+	profile := testProfile()
+	profile.DVRWindow = 2*time.Hour + time.Second
+
+	// A partial segment still needs a slot to cover the whole window.
+	args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " ")
+	if !strings.Contains(args, "-hls_list_size 1801") {
+		t.Errorf("expected the DVR window to set the list size, got %s", args)
+	}
+
+	profile.DVRWindow = -time.Second
+	if err := profile.Validate(); err == nil {
+		t.Error("expected a negative DVR window to be rejected")
+	}
+}
+
+func TestStream_DVRBecomesVODWhenPublisherLeaves(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	outputDir := t.TempDir()
+
+	profile := testProfile()
+	profile.DVRWindow = time.Minute
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.StartTranscoder(profile); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+
+	stream.WriteHeader(testCodecs())
+	for i := 0; i < 3; i++ {
+		stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("frame")})
+	}
+	waitForPackets(t, fakes.get(0), 3)
+
+	if segments := fakes.get(0).Segments(); len(segments) != 3 {
+		t.Errorf("expected the DVR window to keep all 3 segments, got %v", segments)
+	}
+
+	playlistPath := filepath.Join(outputDir, "playlist.m3u8")
+	playlist, err := os.ReadFile(playlistPath)
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	if strings.Contains(string(playlist), "#EXT-X-ENDLIST") {
+		t.Errorf("expected a live playlist while publishing:\n%s", playlist)
+	}
+
+	sm.RemoveStream(stream.ID)
+
+	playlist, err = os.ReadFile(playlistPath)
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	for _, expected := range []string{"#EXT-X-PLAYLIST-TYPE:VOD", "segment_000.ts", "#EXT-X-ENDLIST"} {
+		if !strings.Contains(string(playlist), expected) {
+			t.Errorf("expected VOD playlist to contain %q:\n%s", expected, playlist)
+		}
+	}
+}
+
+func TestStream_StopWithoutTrailerKeepsLivePlaylist(t *testing.T) {
+	sm, _ := newFakeStreamManager()
+	outputDir := t.TempDir()
+
+	profile := testProfile()
+	profile.DVRWindow = time.Minute
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.StartTranscoder(profile); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	stream.Stop()
+
+	playlist, err := os.ReadFile(filepath.Join(outputDir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatalf("failed to read playlist: %v", err)
+	}
+	if strings.Contains(string(playlist), "#EXT-X-ENDLIST") {
+		t.Errorf("expected a stopped but still published stream to stay live:\n%s", playlist)
+	}
+}
+
+func TestPassthroughCompatible(t *testing.T) {
+	if !PassthroughCompatible(testCodecs()) {
+		t.Error("expected H.264/AAC to be passthrough compatible")
+	}
+	if !PassthroughCompatible([]av.CodecData{testCodec{av.H264}}) {
+		t.Error("expected video-only H.264 to be passthrough compatible")
+	}
+	if PassthroughCompatible([]av.CodecData{testCodec{av.H264}, testCodec{av.SPEEX}}) {
+		t.Error("expected Speex audio to require transcoding")
+	}
+	if PassthroughCompatible(nil) {
+		t.Error("expected unknown codecs to require transcoding")
+	}
+}
+
+func TestTranscodeProfile_ValidateSegmenter(t *testing.T) {
+	profile := testProfile()
+	profile.Segmenter = SegmenterNative
+	if err := profile.Validate(); err == nil {
+		t.Error("expected native segmenter to require passthrough")
+	}
+
+	profile.Passthrough = true
+	if err := profile.Validate(); err != nil {
+		t.Errorf("expected native passthrough profile to be valid: %v", err)
+	}
+
+	profile.PartDuration = 500 * time.Millisecond
+	if err := profile.Validate(); err != nil {
+		t.Errorf("expected low-latency native profile to be valid: %v", err)
+	}
+
+	profile.Segmenter = SegmenterFFmpeg
+	if err := profile.Validate(); err == nil {
+		t.Error("expected low-latency HLS to require the native segmenter")
+	}
+
+	profile.Segmenter = "gstreamer"
+	if err := profile.Validate(); err == nil {
+		t.Error("expected error for unknown segmenter")
+	}
+}
+
+func TestTranscodeProfile_ValidateContainer(t *testing.T) {
+	profile := testProfile()
+	profile.Container = ContainerFMP4
+	if err := profile.Validate(); err != nil {
+		t.Errorf("expected fMP4 profile to be valid: %v", err)
+	}
+
+	profile.Passthrough = true
+	profile.Segmenter = SegmenterNative
+	if err := profile.Validate(); err == nil {
+		t.Error("expected native segmenter to reject fMP4")
+	}
+
+	profile = testProfile()
+	profile.Container = "webm"
+	if err := profile.Validate(); err == nil {
+		t.Error("expected error for unknown container")
+	}
+
+	profile = testProfile()
+	profile.DASH = true
+	if err := profile.Validate(); err == nil {
+		t.Error("expected DASH to require the fmp4 container")
+	}
+
+	profile.Container = ContainerFMP4
+	if err := profile.Validate(); err != nil {
+		t.Errorf("expected DASH fMP4 profile to be valid: %v", err)
+	}
+	if args := strings.Join(buildFFmpegArgs("/tmp/out", profile), " "); !strings.Contains(args, "-hls_flags delete_segments+program_date_time") {
+		t.Errorf("expected program date time for DASH, got %s", args)
+	}
+}
+
+// fakeFFmpeg writes a shell script to stand in for the FFmpeg binary. It
+// runs in dir and ignores the FFmpeg arguments.
+func fakeFFmpeg(t *testing.T, dir, script string) string {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("fake FFmpeg needs a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\ncd '"+dir+"' || exit 1\n"+script+"\n"), 0755); err != nil {
+		t.Fatalf("failed to write fake FFmpeg: %v", err)
+	}
+	return path
+}
+
+func TestFFmpegTranscoder_WritesFLVToStdin(t *testing.T) {
+	outputDir := t.TempDir()
+	profile := testProfile()
+	profile.BinaryPath = fakeFFmpeg(t, outputDir, "exec cat > stdin.flv")
+
+	transcoder := NewFFmpegTranscoder()
+	if err := transcoder.Start(outputDir, profile); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	codecs := testutil.Codecs(t)
+	if err := transcoder.WriteHeader(codecs); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+	packets := []av.Packet{
+		{Idx: 0, IsKeyFrame: true, Data: []byte{0, 0, 0, 2, 0x65, 0x88}},
+		{Idx: 1, Time: 20 * time.Millisecond, Data: []byte{0x21, 0x10}},
+		{Idx: 0, Time: 40 * time.Millisecond, Data: []byte{0, 0, 0, 2, 0x41, 0x9a}},
+	}
+	for _, pkt := range packets {
+		if err := transcoder.WritePacket(pkt); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+
+	// The trailer closes stdin, which is what makes FFmpeg end the playlist.
+	if err := transcoder.WriteTrailer(); err != nil {
+		t.Fatalf("WriteTrailer failed: %v", err)
+	}
+	if err := transcoder.Wait(); err != nil {
+		t.Fatalf("expected FFmpeg to exit once stdin is closed, got %v", err)
+	}
+	if err := transcoder.WritePacket(packets[0]); err == nil {
+		t.Error("expected WritePacket to fail after the trailer")
+	}
+	transcoder.Stop()
+
+	file, err := os.Open(filepath.Join(outputDir, "stdin.flv"))
+	if err != nil {
+		t.Fatalf("failed to open FFmpeg input: %v", err)
+	}
+	defer file.Close()
+
+	demuxer := flv.NewDemuxer(file)
+	streams, err := demuxer.Streams()
+	if err != nil {
+		t.Fatalf("failed to read FLV header: %v", err)
+	}
+	if len(streams) != 2 || streams[0].Type() != av.H264 || streams[1].Type() != av.AAC {
+		t.Fatalf("expected H.264 and AAC streams, got %v", streams)
+	}
+	for i, expected := range packets {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			t.Fatalf("failed to read packet %d: %v", i, err)
+		}
+		if pkt.Idx != expected.Idx || pkt.IsKeyFrame != expected.IsKeyFrame || pkt.Time != expected.Time || !bytes.Equal(pkt.Data, expected.Data) {
+			t.Errorf("packet %d: expected %+v, got %+v", i, expected, pkt)
+		}
+	}
+	if _, err := demuxer.ReadPacket(); err != io.EOF {
+		t.Errorf("expected the FLV input to end after the packets, got %v", err)
+	}
+}
+
+// closedStdinFFmpeg stands in for an FFmpeg that has stopped reading its
+// input but is still running. It creates the file closed once it has closed
+// stdin.
+func closedStdinFFmpeg(t *testing.T, outputDir string) string {
+	return fakeFFmpeg(t, outputDir, "exec 0<&-\ntouch closed\nexec sleep 10")
+}
+
+func waitForClosedStdin(t *testing.T, outputDir string) {
+	t.Helper()
+
+	testutil.WaitFor(t, "FFmpeg to close stdin", func() bool {
+		_, err := os.Stat(filepath.Join(outputDir, "closed"))
+		return err == nil
+	})
+}
+
+func TestFFmpegTranscoder_WriteFailsWhenFFmpegStopsReading(t *testing.T) {
+	outputDir := t.TempDir()
+	profile := testProfile()
+	profile.BinaryPath = closedStdinFFmpeg(t, outputDir)
+
+	transcoder := NewFFmpegTranscoder()
+	if err := transcoder.Start(outputDir, profile); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	waitForClosedStdin(t, outputDir)
+
+	if err := transcoder.WriteHeader(testutil.Codecs(t)); err == nil {
+		t.Error("expected WriteHeader to fail once FFmpeg stopped reading")
+	}
+	if err := transcoder.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{1}}); err == nil {
+		t.Error("expected WritePacket to fail once FFmpeg stopped reading")
+	}
+
+	if err := transcoder.Stop(); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	if err := transcoder.Wait(); err == nil {
+		t.Error("expected the killed FFmpeg to exit with an error")
+	}
+}
+
+func TestStream_StopsWritingToFailedTranscoder(t *testing.T) {
+	sm := NewStreamManager(logrus.New())
+	sm.SetRestartPolicy(RestartPolicy{MaxRestarts: -1})
+
+	outputDir := t.TempDir()
+	profile := testProfile()
+	profile.BinaryPath = closedStdinFFmpeg(t, outputDir)
+
+	stream := sm.CreateStream("live", "test", outputDir)
+	if err := stream.StartTranscoder(profile); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	defer stream.Stop()
+	waitForClosedStdin(t, outputDir)
+
+	sub := stream.Subscribe("viewer", 8)
+	defer sub.Close()
+
+	if err := stream.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Errorf("expected the transcoder write error to stay off the publisher, got %v", err)
+	}
+
+	// Once a write failed the transcoder is no longer fed, but viewers keep
+	// getting the stream.
+	testutil.WaitFor(t, "the failed transcoder to stop being fed", func() bool {
+		stream.subMu.Lock()
+		defer stream.subMu.Unlock()
+		return stream.transcoderSub == nil
+	})
+	pkt := av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte{1}}
+	if err := stream.WritePacket(pkt); err != nil {
+		t.Errorf("expected packets to skip the failed transcoder, got %v", err)
+	}
+	if err := stream.WriteTrailer(); err != nil {
+		t.Errorf("expected the trailer to skip the failed transcoder, got %v", err)
+	}
+
+	if codecs, err := sub.Streams(); err != nil || len(codecs) != 2 {
+		t.Fatalf("expected the viewer to get the header, got %v %v", codecs, err)
+	}
+	if got, err := sub.ReadPacket(); err != nil || !bytes.Equal(got.Data, pkt.Data) {
+		t.Errorf("expected the viewer to get the packet, got %+v %v", got, err)
+	}
+}
+
+func TestFFmpegTranscoder_StopKillsFFmpegBlockingWrites(t *testing.T) {
+	outputDir := t.TempDir()
+	profile := testProfile()
+	// FFmpeg hangs without exiting or reading stdin.
+	profile.BinaryPath = fakeFFmpeg(t, outputDir, "exec sleep 10")
+
+	transcoder := NewFFmpegTranscoder()
+	if err := transcoder.Start(outputDir, profile); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if err := transcoder.WriteHeader(testutil.Codecs(t)); err != nil {
+		t.Fatalf("WriteHeader failed: %v", err)
+	}
+
+	// The packet is larger than the pipe buffer, so the write blocks while
+	// holding the transcoder's lock.
+	written := make(chan error, 1)
+	go func() {
+		written <- transcoder.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: make([]byte, 1<<20)})
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("expected the write to block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- transcoder.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Stop failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Stop to kill FFmpeg while a write is blocked")
+	}
+
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Error("expected the blocked write to fail once FFmpeg was killed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the blocked write to return once FFmpeg was killed")
+	}
+}
+
+// stuckTranscoder stands in for an FFmpeg that stops reading its input
+// without exiting: writes block until it is stopped.
+type stuckTranscoder struct {
+	*FakeTranscoder
+}
+
+func (t stuckTranscoder) WritePacket(pkt av.Packet) error {
+	<-t.done
+	return errors.New("transcoder not running")
+}
+
+func TestStream_RestartsTranscoderThatFallsBehind(t *testing.T) {
+	sm, fakes := newFakeStreamManager()
+	sm.SetRestartPolicy(RestartPolicy{InitialBackoff: time.Millisecond, MaxRestarts: 3, Window: time.Minute})
+	factory := sm.transcoderFactory
+	stuck := stuckTranscoder{NewFakeTranscoder()}
+	sm.SetTranscoderFactory(func() Transcoder {
+		if fakes.count() == 0 {
+			fakes.mu.Lock()
+			fakes.fakes = append(fakes.fakes, stuck.FakeTranscoder)
+			fakes.mu.Unlock()
+			return stuck
+		}
+		return factory()
+	})
+
+	stream := sm.CreateStream("live", "test", t.TempDir())
+	if err := stream.StartTranscoder(testProfile()); err != nil {
+		t.Fatalf("StartTranscoder failed: %v", err)
+	}
+	defer stream.Stop()
+
+	sub := stream.Subscribe("viewer", 2*transcoderQueueSize)
+	defer sub.Close()
+
+	// The publisher is never held up by the stuck transcoder.
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		stream.WriteHeader(testCodecs())
+		for i := 0; i < transcoderQueueSize+10; i++ {
+			stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("frame")})
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the publisher not to block on a stuck transcoder")
+	}
+
+	testutil.WaitFor(t, "the stuck transcoder to be restarted", func() bool {
+		return stream.Restarts() == 1
+	})
+	if buffered := sub.Buffered(); buffered != transcoderQueueSize+10 {
+		t.Errorf("expected the viewer to get every packet, got %d", buffered)
+	}
+
+	stream.WritePacket(av.Packet{Idx: 0, IsKeyFrame: true, Data: []byte("frame")})
+	waitForPackets(t, fakes.get(1), 1)
+}
@@ -0,0 +1,53 @@
+// Package testutil holds the fixtures shared by the tests of several
+// packages.
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// Codecs returns the codec data of an H.264 baseline video track and an
+// AAC-LC stereo track at 44.1 kHz.
+func Codecs(t testing.TB) []av.CodecData {
+	t.Helper()
+
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(
+		[]byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8},
+		[]byte{0x68, 0xce, 0x3c, 0x80},
+	)
+	if err != nil {
+		t.Fatalf("failed to create H264 codec data: %v", err)
+	}
+
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+		SampleRate:      44100,
+		ChannelLayout:   av.CH_STEREO,
+	})
+	if err != nil {
+		t.Fatalf("failed to create AAC codec data: %v", err)
+	}
+
+	return []av.CodecData{video, audio}
+}
+
+// WaitFor polls cond until it holds, failing the test if it does not within
+// two seconds.
+func WaitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
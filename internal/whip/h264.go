@@ -0,0 +1,77 @@
+package whip
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// H.264 NAL unit types. joy4's h264parser constants for SPS and PPS are
+// swapped, so they are not used here.
+const (
+	naluIDR = 5
+	naluSPS = 7
+	naluPPS = 8
+	naluAUD = 9
+)
+
+// splitAnnexB splits an Annex B access unit, as WebRTC depacketizes it, into
+// NAL units without start codes.
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			// The zero byte of a four-byte start code belongs to it.
+			if end > start && data[end-1] == 0 {
+				end--
+			}
+			nalus = append(nalus, data[start:end])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// splitAVCC splits a length-prefixed access unit, as RTMP carries it, into
+// NAL units.
+func splitAVCC(data []byte) ([][]byte, error) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated AVCC NAL unit length")
+		}
+		size := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("AVCC NAL unit of %d bytes exceeds packet", size)
+		}
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+	return nalus, nil
+}
+
+func appendAVCC(dst, nalu []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(nalu)))
+	return append(dst, nalu...)
+}
+
+func appendAnnexB(dst, nalu []byte) []byte {
+	dst = append(dst, 0, 0, 0, 1)
+	return append(dst, nalu...)
+}
+
+func naluType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
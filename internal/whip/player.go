@@ -0,0 +1,126 @@
+package whip
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang-rtmp/internal/stream"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+const (
+	viewerQueueSize = 256
+
+	// Used for the first sample, before the frame rate is known.
+	defaultFrameDuration = 33 * time.Millisecond
+)
+
+// player sends the H.264 track of a stream to one WHEP viewer.
+type player struct {
+	stream   *stream.Stream
+	sub      *stream.Subscriber
+	videoIdx int
+	codec    h264parser.CodecData
+	track    *webrtc.TrackLocalStaticSample
+}
+
+func newPlayer(liveStream *stream.Stream, sub *stream.Subscriber, codecs []av.CodecData) (*player, error) {
+	for i, codec := range codecs {
+		if h264, ok := codec.(h264parser.CodecData); ok {
+			return &player{stream: liveStream, sub: sub, videoIdx: i, codec: h264}, nil
+		}
+	}
+	return nil, ErrNoH264
+}
+
+// attach adds the video track to the peer connection. The track asks for the
+// stream's own H.264 profile so the closest negotiated codec is used.
+func (p *player) attach(pc *webrtc.PeerConnection) error {
+	sps := p.codec.SPS()
+	if len(sps) < 4 {
+		return fmt.Errorf("invalid SPS in stream %s", p.stream.ID)
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: h264Fmtp(hex.EncodeToString(sps[1:4])),
+	}, "video", p.stream.AppName+"-"+p.stream.StreamName)
+	if err != nil {
+		return err
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return err
+	}
+	// RTCP must be read for NACKs and keyframe requests to be processed.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	p.track = track
+	return nil
+}
+
+// play sends video once the peer is connected, starting at a keyframe with
+// the SPS and PPS in front of it. It returns when the stream ends or the
+// subscription is closed.
+func (p *player) play(connected <-chan struct{}) error {
+	started := false
+	var last time.Duration
+	duration := defaultFrameDuration
+
+	for {
+		pkt, err := p.sub.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if int(pkt.Idx) != p.videoIdx {
+			continue
+		}
+
+		if !started {
+			select {
+			case <-connected:
+			default:
+				continue
+			}
+			if !pkt.IsKeyFrame {
+				continue
+			}
+			started = true
+		} else if pkt.Time > last {
+			duration = pkt.Time - last
+		}
+		last = pkt.Time
+
+		nalus, err := splitAVCC(pkt.Data)
+		if err != nil {
+			continue
+		}
+		var data []byte
+		if pkt.IsKeyFrame {
+			data = appendAnnexB(data, p.codec.SPS())
+			data = appendAnnexB(data, p.codec.PPS())
+		}
+		for _, nalu := range nalus {
+			data = appendAnnexB(data, nalu)
+		}
+
+		if err := p.track.WriteSample(media.Sample{Data: data, Duration: duration}); err != nil {
+			return err
+		}
+		p.stream.UpdateLastActivity()
+	}
+}
@@ -0,0 +1,369 @@
+package whip
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Publishers that send no keyframe for this long are dropped.
+	keyframeTimeout = 10 * time.Second
+
+	// Keyframes are requested at this interval until the first one arrives.
+	pliInterval = 2 * time.Second
+
+	// How long the stream waits for converted audio once video is ready.
+	audioWait = 3 * time.Second
+
+	// Packets the samplebuilder holds back to reorder late RTP packets.
+	maxLatePackets = 256
+
+	sourceQueueSize = 1024
+
+	videoIdx = 0
+	audioIdx = 1
+)
+
+var errNoKeyframe = errors.New("no H.264 keyframe received")
+
+// source turns the tracks of a WHIP peer into an av.Demuxer: H.264 is
+// repackaged as is and Opus is converted to AAC by FFmpeg.
+type source struct {
+	streamID    string
+	pc          *webrtc.PeerConnection
+	ffmpegPath  string
+	logger      *logrus.Logger
+	expectAudio bool
+
+	packets    chan av.Packet
+	videoReady chan struct{}
+	audioReady chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	// start is when the first media arrived; every track is timed from it.
+	start     time.Time
+	startOnce sync.Once
+
+	video   av.CodecData
+	audio   av.CodecData
+	streams int
+	mu      sync.Mutex
+}
+
+func newSource(streamID string, pc *webrtc.PeerConnection, ffmpegPath string, logger *logrus.Logger) *source {
+	return &source{
+		streamID:   streamID,
+		pc:         pc,
+		ffmpegPath: ffmpegPath,
+		logger:     logger,
+		packets:    make(chan av.Packet, sourceQueueSize),
+		videoReady: make(chan struct{}),
+		audioReady: make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+}
+
+// Streams waits for the first keyframe and, if the peer sends audio, for the
+// first converted audio frame.
+func (s *source) Streams() ([]av.CodecData, error) {
+	select {
+	case <-s.videoReady:
+	case <-s.closed:
+		return nil, io.EOF
+	case <-time.After(keyframeTimeout):
+		return nil, errNoKeyframe
+	}
+
+	if s.expectAudio {
+		select {
+		case <-s.audioReady:
+		case <-s.closed:
+			return nil, io.EOF
+		case <-time.After(audioWait):
+			s.logger.Warnf("No audio from WHIP publisher of stream %s, publishing video only", s.streamID)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codecs := []av.CodecData{s.video}
+	if s.audio != nil {
+		codecs = append(codecs, s.audio)
+	}
+	s.streams = len(codecs)
+	return codecs, nil
+}
+
+func (s *source) ReadPacket() (av.Packet, error) {
+	s.mu.Lock()
+	streams := s.streams
+	s.mu.Unlock()
+
+	for {
+		select {
+		case pkt := <-s.packets:
+			// Audio that was not ready when the stream started is dropped.
+			if int(pkt.Idx) < streams {
+				return pkt, nil
+			}
+		case <-s.closed:
+			return av.Packet{}, io.EOF
+		}
+	}
+}
+
+func (s *source) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *source) handleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	mimeType := track.Codec().MimeType
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		go s.readVideo(track)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		go s.readAudio(track)
+	default:
+		s.logger.Warnf("Ignoring %s track of WHIP publisher of stream %s", mimeType, s.streamID)
+	}
+}
+
+func (s *source) elapsed() time.Duration {
+	s.startOnce.Do(func() {
+		s.start = time.Now()
+	})
+	return time.Since(s.start)
+}
+
+func (s *source) push(pkt av.Packet) {
+	select {
+	case s.packets <- pkt:
+	case <-s.closed:
+	}
+}
+
+func (s *source) readVideo(track *webrtc.TrackRemote) {
+	keyframe := make(chan struct{})
+	var keyframeOnce sync.Once
+	go s.requestKeyframes(track, keyframe)
+
+	builder := samplebuilder.New(maxLatePackets, &codecs.H264Packet{}, track.Codec().ClockRate)
+	clock := trackClock{rate: track.Codec().ClockRate}
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+
+		builder.Push(pkt)
+		for sample, timestamp := builder.PopWithTimestamp(); sample != nil; sample, timestamp = builder.PopWithTimestamp() {
+			pkt, ok := s.videoPacket(sample.Data)
+			if !ok {
+				continue
+			}
+			keyframeOnce.Do(func() {
+				close(keyframe)
+			})
+			pkt.Time = clock.at(timestamp, s.elapsed)
+			s.push(pkt)
+		}
+	}
+}
+
+// videoPacket converts an Annex B access unit to a length-prefixed packet.
+// Access units before the first keyframe with SPS and PPS are dropped.
+func (s *source) videoPacket(data []byte) (av.Packet, bool) {
+	var sps, pps, avcc []byte
+	keyframe := false
+	for _, nalu := range splitAnnexB(data) {
+		switch naluType(nalu) {
+		case naluSPS:
+			sps = nalu
+		case naluPPS:
+			pps = nalu
+		case naluAUD:
+		case naluIDR:
+			keyframe = true
+			avcc = appendAVCC(avcc, nalu)
+		default:
+			avcc = appendAVCC(avcc, nalu)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.video == nil {
+		if !keyframe || sps == nil || pps == nil {
+			return av.Packet{}, false
+		}
+		codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+		if err != nil {
+			s.logger.Warnf("Invalid SPS/PPS from WHIP publisher of stream %s: %v", s.streamID, err)
+			return av.Packet{}, false
+		}
+		s.video = codec
+		close(s.videoReady)
+	}
+	if len(avcc) == 0 {
+		return av.Packet{}, false
+	}
+	return av.Packet{Idx: videoIdx, IsKeyFrame: keyframe, Data: avcc}, true
+}
+
+// requestKeyframes sends picture loss indications until the first keyframe
+// arrives, since the publisher may have started its GOP before connecting.
+func (s *source) requestKeyframes(track *webrtc.TrackRemote, keyframe <-chan struct{}) {
+	ticker := time.NewTicker(pliInterval)
+	defer ticker.Stop()
+
+	for {
+		s.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+		select {
+		case <-keyframe:
+			return
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readAudio pipes the Opus track through FFmpeg as Ogg and reads it back as
+// AAC in ADTS frames.
+func (s *source) readAudio(track *webrtc.TrackRemote) {
+	if s.ffmpegPath == "" {
+		s.logger.Warnf("No FFmpeg to convert Opus audio of stream %s, publishing video only", s.streamID)
+		return
+	}
+
+	cmd := exec.Command(s.ffmpegPath,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "ogg", "-i", "pipe:0",
+		"-c:a", "aac", "-b:a", "128k",
+		"-f", "adts", "pipe:1",
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.logger.Errorf("Failed to convert audio of stream %s: %v", s.streamID, err)
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.logger.Errorf("Failed to convert audio of stream %s: %v", s.streamID, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.logger.Errorf("Failed to start FFmpeg to convert audio of stream %s: %v", s.streamID, err)
+		return
+	}
+	defer cmd.Wait()
+
+	go s.readADTS(stdout)
+
+	channels := track.Codec().Channels
+	if channels == 0 {
+		channels = 2
+	}
+	ogg, err := oggwriter.NewWith(stdin, track.Codec().ClockRate, channels)
+	if err != nil {
+		stdin.Close()
+		s.logger.Errorf("Failed to convert audio of stream %s: %v", s.streamID, err)
+		return
+	}
+	// Closing the writer closes FFmpeg's stdin, which makes it exit.
+	defer ogg.Close()
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if err := ogg.WriteRTP(pkt); err != nil {
+			s.logger.Errorf("Failed to convert audio of stream %s: %v", s.streamID, err)
+			return
+		}
+	}
+}
+
+func (s *source) readADTS(r io.Reader) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, 7)
+
+	var offset time.Duration
+	samples := 0
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		config, hdrlen, framelen, frameSamples, err := aacparser.ParseADTSHeader(header)
+		if err != nil || framelen < len(header) {
+			s.logger.Errorf("Invalid AAC from audio conversion of stream %s: %v", s.streamID, err)
+			return
+		}
+		frame := make([]byte, framelen)
+		copy(frame, header)
+		if _, err := io.ReadFull(reader, frame[len(header):]); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.audio == nil {
+			codec, err := aacparser.NewCodecDataFromMPEG4AudioConfig(config)
+			if err != nil {
+				s.mu.Unlock()
+				s.logger.Errorf("Invalid AAC from audio conversion of stream %s: %v", s.streamID, err)
+				return
+			}
+			s.audio = codec
+			close(s.audioReady)
+			offset = s.elapsed()
+		}
+		s.mu.Unlock()
+
+		s.push(av.Packet{
+			Idx:  audioIdx,
+			Data: frame[hdrlen:],
+			Time: offset + time.Duration(samples)*time.Second/time.Duration(config.SampleRate),
+		})
+		samples += frameSamples
+	}
+}
+
+// trackClock converts RTP timestamps to stream time, starting at the time
+// the track's first sample arrived.
+type trackClock struct {
+	rate   uint32
+	first  uint32
+	offset time.Duration
+	set    bool
+}
+
+func (c *trackClock) at(timestamp uint32, elapsed func() time.Duration) time.Duration {
+	if !c.set {
+		c.first = timestamp
+		c.offset = elapsed()
+		c.set = true
+	}
+	ticks := uint64(timestamp - c.first)
+	return c.offset + time.Duration(ticks*uint64(time.Second)/uint64(c.rate))
+}
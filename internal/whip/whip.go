@@ -0,0 +1,398 @@
+package whip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang-rtmp/internal/rtmp"
+	"golang-rtmp/internal/stream"
+
+	"github.com/nareix/joy4/av"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrStreamActive    = errors.New("stream is already being published")
+	ErrStreamNotFound  = errors.New("stream not found")
+	ErrNoH264          = errors.New("stream has no H.264 video")
+	ErrInvalidOffer    = errors.New("invalid SDP offer")
+)
+
+const (
+	KindWHIP = "whip"
+	KindWHEP = "whep"
+
+	// Answers are sent once all ICE candidates are gathered, so clients do
+	// not need trickle ICE.
+	gatherTimeout = 10 * time.Second
+)
+
+// h264Profiles are the H.264 profiles negotiated with browsers: constrained
+// baseline, baseline, main and high.
+var h264Profiles = []string{"42e01f", "42001f", "4d001f", "64001f"}
+
+// Publisher runs WHIP streams through the same pipeline as RTMP publishers.
+// AbortPublish ends an accepted publisher that fails before Publish.
+type Publisher interface {
+	AcceptPublish(ctx context.Context, path *rtmp.StreamPath, remoteAddr string) error
+	AbortPublish(path *rtmp.StreamPath, remoteAddr string)
+	Publish(path *rtmp.StreamPath, remoteAddr string, src av.Demuxer) error
+}
+
+type Manager struct {
+	publisher     Publisher
+	streamManager *stream.StreamManager
+	logger        *logrus.Logger
+	ffmpegPath    string
+	configuration webrtc.Configuration
+	settings      webrtc.SettingEngine
+	sessions      map[string]*session
+	wg            sync.WaitGroup
+	mu            sync.Mutex
+}
+
+func NewManager(publisher Publisher, streamManager *stream.StreamManager, logger *logrus.Logger) *Manager {
+	return &Manager{
+		publisher:     publisher,
+		streamManager: streamManager,
+		logger:        logger,
+		sessions:      make(map[string]*session),
+	}
+}
+
+// SetICEServers sets the STUN and TURN server URLs offered to peers.
+func (m *Manager) SetICEServers(urls []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configuration.ICEServers = nil
+	if len(urls) > 0 {
+		m.configuration.ICEServers = []webrtc.ICEServer{{URLs: urls}}
+	}
+}
+
+// SetNAT1To1IPs announces these public IPs in host candidates, for servers
+// behind a 1:1 NAT.
+func (m *Manager) SetNAT1To1IPs(ips []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.settings.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+}
+
+// SetFFmpegPath sets the FFmpeg binary that converts the Opus audio of WHIP
+// publishers to AAC. Without it WHIP streams are published without audio.
+func (m *Manager) SetFFmpegPath(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ffmpegPath = path
+}
+
+// Publish authorizes a WHIP publisher and answers its SDP offer. The stream
+// is published once the peer connects and sends a keyframe, and ends when
+// the peer disconnects or the session is closed.
+func (m *Manager) Publish(ctx context.Context, path *rtmp.StreamPath, remoteAddr, offer string) (string, string, error) {
+	if err := m.publisher.AcceptPublish(ctx, path, remoteAddr); err != nil {
+		return "", "", err
+	}
+	streamID := path.ID()
+	if _, exists := m.streamManager.GetStream(streamID); exists {
+		m.publisher.AbortPublish(path, remoteAddr)
+		return "", "", ErrStreamActive
+	}
+
+	pc, err := m.newPeerConnection()
+	if err != nil {
+		m.publisher.AbortPublish(path, remoteAddr)
+		return "", "", err
+	}
+
+	m.mu.Lock()
+	ffmpegPath := m.ffmpegPath
+	m.mu.Unlock()
+
+	src := newSource(streamID, pc, ffmpegPath, m.logger)
+	pc.OnTrack(src.handleTrack)
+
+	answer, err := negotiate(pc, offer)
+	if err != nil {
+		pc.Close()
+		m.publisher.AbortPublish(path, remoteAddr)
+		return "", "", err
+	}
+	src.expectAudio = ffmpegPath != "" && receivesAudio(pc)
+
+	sess := m.addSession(KindWHIP, streamID, pc)
+	m.logger.Infof("WHIP publisher %s connecting to stream %s", remoteAddr, streamID)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer m.removeSession(sess)
+
+		go func() {
+			<-sess.done
+			src.Close()
+		}()
+
+		if err := m.publisher.Publish(path, remoteAddr, src); err != nil {
+			m.logger.Infof("WHIP stream %s ended: %v", streamID, err)
+		}
+		sess.close()
+	}()
+
+	return sess.id, answer, nil
+}
+
+// Play answers the SDP offer of a WHEP viewer and sends it the stream's
+// H.264 track until the peer disconnects or the session is closed. done is
+// called once the viewer has left.
+func (m *Manager) Play(streamID, remoteAddr, offer string, done func()) (string, string, error) {
+	liveStream, exists := m.streamManager.GetStream(streamID)
+	if !exists {
+		return "", "", ErrStreamNotFound
+	}
+
+	id := newSessionID()
+	sub := liveStream.Subscribe(KindWHEP+"-"+id, viewerQueueSize)
+	codecs, err := sub.Streams()
+	if err != nil {
+		sub.Close()
+		return "", "", ErrStreamNotFound
+	}
+
+	p, err := newPlayer(liveStream, sub, codecs)
+	if err != nil {
+		sub.Close()
+		return "", "", err
+	}
+
+	pc, err := m.newPeerConnection()
+	if err != nil {
+		sub.Close()
+		return "", "", err
+	}
+	if err := p.attach(pc); err != nil {
+		sub.Close()
+		pc.Close()
+		return "", "", err
+	}
+
+	answer, err := negotiate(pc, offer)
+	if err != nil {
+		sub.Close()
+		pc.Close()
+		return "", "", err
+	}
+
+	sess := m.addSessionWithID(id, KindWHEP, streamID, pc)
+	sub.SetViewer(KindWHEP, remoteAddr, sess.close)
+	m.logger.Infof("WHEP viewer %s connecting to stream %s", remoteAddr, streamID)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer done()
+		defer m.removeSession(sess)
+
+		go func() {
+			<-sess.done
+			sub.Close()
+		}()
+
+		err := p.play(sess.connected)
+		sess.close()
+		m.logger.Infof("WHEP viewer %s of stream %s left: %v", remoteAddr, streamID, err)
+	}()
+
+	return sess.id, answer, nil
+}
+
+// Close ends a WHIP or WHEP session, as a client's DELETE of its session
+// resource does.
+func (m *Manager) Close(id string) error {
+	m.mu.Lock()
+	sess, exists := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+
+	if !exists {
+		return ErrSessionNotFound
+	}
+	sess.close()
+	return nil
+}
+
+// CloseAll ends every session, for shutdown.
+func (m *Manager) CloseAll() {
+	m.mu.Lock()
+	sessions := make([]*session, 0, len(m.sessions))
+	for _, sess := range m.sessions {
+		sessions = append(sessions, sess)
+	}
+	m.mu.Unlock()
+
+	for _, sess := range sessions {
+		sess.close()
+	}
+}
+
+// Wait blocks until every session has ended.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+func (m *Manager) newPeerConnection() (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	for i, profile := range h264Profiles {
+		err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeH264,
+				ClockRate:   90000,
+				SDPFmtpLine: h264Fmtp(profile),
+			},
+			PayloadType: webrtc.PayloadType(102 + 2*i),
+		}, webrtc.RTPCodecTypeVideo)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(m.settings),
+	)
+	configuration := m.configuration
+	m.mu.Unlock()
+
+	return api.NewPeerConnection(configuration)
+}
+
+func (m *Manager) addSession(kind, streamID string, pc *webrtc.PeerConnection) *session {
+	return m.addSessionWithID(newSessionID(), kind, streamID, pc)
+}
+
+func (m *Manager) addSessionWithID(id, kind, streamID string, pc *webrtc.PeerConnection) *session {
+	sess := &session{
+		id:        id,
+		kind:      kind,
+		streamID:  streamID,
+		pc:        pc,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			sess.connectedOnce.Do(func() {
+				close(sess.connected)
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			sess.close()
+		}
+	})
+
+	m.mu.Lock()
+	m.sessions[id] = sess
+	m.mu.Unlock()
+	return sess
+}
+
+func (m *Manager) removeSession(sess *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[sess.id] == sess {
+		delete(m.sessions, sess.id)
+	}
+}
+
+type session struct {
+	id       string
+	kind     string
+	streamID string
+	pc       *webrtc.PeerConnection
+
+	connected     chan struct{}
+	connectedOnce sync.Once
+	done          chan struct{}
+	doneOnce      sync.Once
+}
+
+func (s *session) close() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+		// PeerConnection.Close waits for the connection state callback,
+		// which may be the caller.
+		go s.pc.Close()
+	})
+}
+
+// negotiate answers an offer once ICE gathering has completed.
+func negotiate(pc *webrtc.PeerConnection, offer string) (string, error) {
+	err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		return "", fmt.Errorf("timed out gathering ICE candidates")
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// receivesAudio reports whether the peer offered to send audio.
+func receivesAudio(pc *webrtc.PeerConnection) bool {
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeAudio && transceiver.Direction() == webrtc.RTPTransceiverDirectionRecvonly {
+			return true
+		}
+	}
+	return false
+}
+
+func h264Fmtp(profileLevelID string) string {
+	return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profileLevelID
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,352 @@
+package whip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang-rtmp/internal/rtmp"
+	"golang-rtmp/internal/stream"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	testP   = []byte{0x41, 0x9a, 0x02, 0x04}
+)
+
+type fakePublisher struct {
+	streams  chan []av.CodecData
+	packets  chan av.Packet
+	done     chan error
+	accepted atomic.Int32
+	aborted  atomic.Int32
+}
+
+func newFakePublisher() *fakePublisher {
+	return &fakePublisher{
+		streams: make(chan []av.CodecData, 1),
+		packets: make(chan av.Packet, 100),
+		done:    make(chan error, 1),
+	}
+}
+
+func (p *fakePublisher) AcceptPublish(ctx context.Context, path *rtmp.StreamPath, remoteAddr string) error {
+	if path.Query.Get("key") != "secret" {
+		return rtmp.ErrPublishDenied
+	}
+	p.accepted.Add(1)
+	return nil
+}
+
+func (p *fakePublisher) AbortPublish(path *rtmp.StreamPath, remoteAddr string) {
+	p.aborted.Add(1)
+}
+
+func (p *fakePublisher) Publish(path *rtmp.StreamPath, remoteAddr string, src av.Demuxer) error {
+	codecs, err := src.Streams()
+	if err != nil {
+		p.done <- err
+		return err
+	}
+	p.streams <- codecs
+
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			p.done <- err
+			return err
+		}
+		select {
+		case p.packets <- pkt:
+		default:
+		}
+	}
+}
+
+func newTestManager(t *testing.T) (*Manager, *fakePublisher, *stream.StreamManager) {
+	t.Helper()
+
+	logger := logrus.New()
+	publisher := newFakePublisher()
+	sm := stream.NewStreamManager(logger)
+	m := NewManager(publisher, sm, logger)
+	t.Cleanup(func() {
+		m.CloseAll()
+		m.Wait()
+	})
+	return m, publisher, sm
+}
+
+// newOffer creates a peer's offer with all of its ICE candidates.
+func newOffer(t *testing.T, pc *webrtc.PeerConnection) string {
+	t.Helper()
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("CreateOffer failed: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("SetLocalDescription failed: %v", err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func setAnswer(t *testing.T, pc *webrtc.PeerConnection, answer string) {
+	t.Helper()
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatalf("SetRemoteDescription failed: %v", err)
+	}
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var data []byte
+	for _, nalu := range nalus {
+		data = appendAnnexB(data, nalu)
+	}
+	return data
+}
+
+func TestSplitNALUs(t *testing.T) {
+	nalus := splitAnnexB([]byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 1, 0x68, 0xce, 0, 0, 0, 1, 0x65, 0x88})
+	if len(nalus) != 3 || !bytes.Equal(nalus[0], []byte{0x67, 0x42}) || !bytes.Equal(nalus[1], []byte{0x68, 0xce}) || !bytes.Equal(nalus[2], []byte{0x65, 0x88}) {
+		t.Errorf("unexpected Annex B split: %x", nalus)
+	}
+
+	avcc := appendAVCC(appendAVCC(nil, testSPS), testIDR)
+	nalus, err := splitAVCC(avcc)
+	if err != nil || len(nalus) != 2 || !bytes.Equal(nalus[1], testIDR) {
+		t.Errorf("unexpected AVCC split: %x %v", nalus, err)
+	}
+	if _, err := splitAVCC([]byte{0, 0, 0, 9, 0x65}); err == nil {
+		t.Error("expected an error for a truncated AVCC packet")
+	}
+}
+
+func TestManager_WHIPPublish(t *testing.T) {
+	m, publisher, _ := newTestManager(t)
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection failed: %v", err)
+	}
+	defer client.Close()
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: h264Fmtp("42e01f"),
+	}, "video", "test")
+	if err != nil {
+		t.Fatalf("NewTrackLocalStaticSample failed: %v", err)
+	}
+	if _, err := client.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("AddTransceiverFromTrack failed: %v", err)
+	}
+	offer := newOffer(t, client)
+
+	path := &rtmp.StreamPath{App: "live", Stream: "whip", Query: url.Values{}}
+	if _, _, err := m.Publish(context.Background(), path, "127.0.0.1:5000", offer); !errors.Is(err, rtmp.ErrPublishDenied) {
+		t.Fatalf("expected publish without a key to be denied, got %v", err)
+	}
+
+	path.Query.Set("key", "secret")
+	id, answer, err := m.Publish(context.Background(), path, "127.0.0.1:5000", offer)
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	setAnswer(t, client, answer)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			data := annexB(testP)
+			if frame%10 == 0 {
+				data = annexB(testSPS, testPPS, testIDR)
+			}
+			track.WriteSample(media.Sample{Data: data, Duration: 33 * time.Millisecond})
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	select {
+	case codecs := <-publisher.streams:
+		if len(codecs) != 1 || codecs[0].Type() != av.H264 {
+			t.Fatalf("expected an H.264 stream, got %v", codecs)
+		}
+		if sps := codecs[0].(h264parser.CodecData).SPS(); !bytes.Equal(sps, testSPS) {
+			t.Errorf("expected SPS %x, got %x", testSPS, sps)
+		}
+	case err := <-publisher.done:
+		t.Fatalf("publish ended before the stream started: %v", err)
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for the WHIP stream")
+	}
+
+	pkt := <-publisher.packets
+	if !pkt.IsKeyFrame || pkt.Idx != videoIdx {
+		t.Errorf("expected the stream to start with a keyframe, got %+v", pkt)
+	}
+	if nalus, err := splitAVCC(pkt.Data); err != nil || len(nalus) != 1 || !bytes.Equal(nalus[0], testIDR) {
+		t.Errorf("expected the IDR slice without parameter sets, got %x %v", pkt.Data, err)
+	}
+
+	if err := m.Close(id); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	select {
+	case <-publisher.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to end when the session is closed")
+	}
+	m.Wait()
+	if err := m.Close(id); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound for a closed session, got %v", err)
+	}
+}
+
+func TestManager_WHIPPublishAbortsAcceptedPublisher(t *testing.T) {
+	m, publisher, sm := newTestManager(t)
+
+	path := &rtmp.StreamPath{App: "live", Stream: "whip", Query: url.Values{"key": {"secret"}}}
+	if _, _, err := m.Publish(context.Background(), path, "127.0.0.1:5000", "not an offer"); err == nil {
+		t.Error("expected an invalid offer to be rejected")
+	}
+
+	sm.CreateStream("live", "whip", t.TempDir())
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection failed: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatalf("AddTransceiverFromKind failed: %v", err)
+	}
+	if _, _, err := m.Publish(context.Background(), path, "127.0.0.1:5000", newOffer(t, client)); !errors.Is(err, ErrStreamActive) {
+		t.Errorf("expected ErrStreamActive, got %v", err)
+	}
+
+	// Publishers that fail after on_publish still get their on_publish_done.
+	if accepted, aborted := publisher.accepted.Load(), publisher.aborted.Load(); accepted != 2 || aborted != 2 {
+		t.Errorf("expected both accepted publishers to be aborted, got %d accepted and %d aborted", accepted, aborted)
+	}
+}
+
+func TestManager_WHEPPlay(t *testing.T) {
+	m, _, sm := newTestManager(t)
+
+	if _, _, err := m.Play("live/missing", "127.0.0.1:5000", "", func() {}); !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("expected ErrStreamNotFound, got %v", err)
+	}
+
+	st := sm.CreateStream("live", "whep", filepath.Join(t.TempDir(), "live", "whep"))
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(testSPS, testPPS)
+	if err != nil {
+		t.Fatalf("failed to create H264 codec data: %v", err)
+	}
+	if err := st.WriteHeader([]av.CodecData{video}); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(33 * time.Millisecond)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			pkt := av.Packet{Idx: 0, Time: time.Duration(frame) * 33 * time.Millisecond, Data: appendAVCC(nil, testP)}
+			if frame%10 == 0 {
+				pkt.IsKeyFrame = true
+				pkt.Data = appendAVCC(nil, testIDR)
+			}
+			st.WritePacket(pkt)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("NewPeerConnection failed: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatalf("AddTransceiverFromKind failed: %v", err)
+	}
+
+	keyframes := make(chan []byte, 1)
+	client.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		builder := samplebuilder.New(256, &codecs.H264Packet{}, 90000)
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			builder.Push(pkt)
+			for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+				if bytes.Contains(sample.Data, testIDR) {
+					select {
+					case keyframes <- sample.Data:
+					default:
+					}
+				}
+			}
+		}
+	})
+
+	left := make(chan struct{})
+	id, answer, err := m.Play("live/whep", "127.0.0.1:5000", newOffer(t, client), func() { close(left) })
+	if err != nil {
+		t.Fatalf("Play failed: %v", err)
+	}
+	setAnswer(t, client, answer)
+
+	select {
+	case data := <-keyframes:
+		want := annexB(testSPS, testPPS, testIDR)
+		if !bytes.Equal(data, want) {
+			t.Errorf("expected keyframe %x with parameter sets, got %x", want, data)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("timed out waiting for a keyframe over WHEP")
+	}
+
+	if err := m.Close(id); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	select {
+	case <-left:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the viewer to leave when the session is closed")
+	}
+	if count := st.SubscriberCount(); count != 0 {
+		t.Errorf("expected no subscribers after the viewer left, got %d", count)
+	}
+}